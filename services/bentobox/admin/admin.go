@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/ipfs"
+	"github.com/metamask/mustekala/services/bentobox/logs"
+	gorp "gopkg.in/gorp.v1"
+)
+
+// AdminServer is the HTTP API operators use to inspect and steer bentobox.
+// Every request must carry the configured token, as in
+// "Authorization: Bearer <token>".
+type AdminServer struct {
+	addr        string
+	token       string
+	ethManager  *eth.EthManager
+	ipfsManager *ipfs.IpfsManager
+	dbMap       *gorp.DbMap
+	logs        *logs.Querier
+
+	// background work started by the requests (i.e. backfills),
+	// stopped alongside the server
+	ctx        context.Context
+	background sync.WaitGroup
+}
+
+// NewServer builds the admin API, to be served on the given address
+func NewServer(addr, token string, ethManager *eth.EthManager,
+	ipfsManager *ipfs.IpfsManager, dbMap *gorp.DbMap) *AdminServer {
+	return &AdminServer{
+		addr:        addr,
+		token:       token,
+		ethManager:  ethManager,
+		ipfsManager: ipfsManager,
+		dbMap:       dbMap,
+		logs:        logs.NewQuerier(dbMap),
+	}
+}
+
+// Serve serves the admin API until the context is done,
+// then waits for the background work to stop
+func (a *AdminServer) Serve(ctx context.Context) {
+	a.ctx = ctx
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.method("GET", a.handleStatus))
+	mux.HandleFunc("/wants", a.handleWants)
+	mux.HandleFunc("/wants/requeue", a.method("POST", a.handleRequeue))
+	mux.HandleFunc("/wants/cancel", a.method("POST", a.handleCancel))
+	mux.HandleFunc("/dispatcher/pause", a.method("POST", a.handlePause(a.ethManager)))
+	mux.HandleFunc("/dispatcher/resume", a.method("POST", a.handleResume(a.ethManager)))
+	mux.HandleFunc("/loader/pause", a.method("POST", a.handlePause(a.ipfsManager)))
+	mux.HandleFunc("/loader/resume", a.method("POST", a.handleResume(a.ipfsManager)))
+	mux.HandleFunc("/backfills", a.handleBackfills)
+	mux.HandleFunc("/logs", a.method("POST", a.handleLogs))
+
+	server := &http.Server{
+		Addr:    a.addr,
+		Handler: a.authenticated(mux),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving admin API on %v", a.addr)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving admin API: %v", err)
+	}
+
+	a.background.Wait()
+}
+
+// authenticated rejects the requests without the configured token
+func (a *AdminServer) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// method rejects the requests not made with the given HTTP method
+func (a *AdminServer) method(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// apiError is the body of the error responses
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes the value as the JSON body of the response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error writing admin API response: %v", err)
+	}
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &apiError{Error: message})
+}
+
+// readJSON parses the JSON body of the request into target,
+// writing the error response when it can't
+func readJSON(w http.ResponseWriter, r *http.Request, target interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return false
+	}
+
+	return true
+}
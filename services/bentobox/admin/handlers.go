@@ -0,0 +1,523 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/logs"
+)
+
+const headSQLQuery = `
+SELECT number_id, hash, inserted_ts
+FROM lastblock
+ORDER BY inserted_ts DESC
+LIMIT 1;
+`
+
+const storedBlockSQLQuery = `
+SELECT COALESCE(max(number_id), -1)
+FROM ethdata
+WHERE
+	kind = $1
+	AND
+	NOT orphaned;
+`
+
+// wantStates are the conditions of the wanted elements in each state
+var wantStates = map[string]string{
+	"pending":   "success_ts = 0 AND dead_ts = 0 AND last_error = ''",
+	"failed":    "success_ts = 0 AND dead_ts = 0 AND last_error <> ''",
+	"dead":      "dead_ts > 0",
+	"succeeded": "success_ts > 0",
+}
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// The state condition is taken from wantStates, the kind is optional
+const wantsSQLQuery = `
+SELECT inserted_ts, kind, key, last_request_ts, success_ts,
+	attempts, last_error, next_attempt_ts, dead_ts, priority
+FROM wantfromdevp2p
+WHERE
+	%v
+	AND
+	($1 = '' OR kind = $1)
+ORDER BY priority DESC, next_attempt_ts, inserted_ts
+LIMIT $2
+OFFSET $3;
+`
+
+const requeueWantSQLQuery = `
+UPDATE wantfromdevp2p
+SET
+	success_ts = 0, last_request_ts = 0,
+	attempts = 0, last_error = '', next_attempt_ts = 0, dead_ts = 0
+WHERE
+	kind = $1
+	AND
+	key = $2;
+`
+
+const requeueDeadSQLQuery = `
+UPDATE wantfromdevp2p
+SET
+	last_request_ts = 0,
+	attempts = 0, last_error = '', next_attempt_ts = 0, dead_ts = 0
+WHERE
+	kind = $1
+	AND
+	dead_ts > 0;
+`
+
+// cancelWantSQLQuery moves a pending element to the dead letters,
+// so it can still be requeued
+const cancelWantSQLQuery = `
+UPDATE wantfromdevp2p
+SET dead_ts = $3, last_error = 'cancelled'
+WHERE
+	kind = $1
+	AND
+	key = $2
+	AND
+	success_ts = 0
+	AND
+	dead_ts = 0;
+`
+
+const backfillsSQLQuery = `
+SELECT from_number, to_number, next_number, inserted_ts, updated_ts, done_ts
+FROM backfills
+ORDER BY inserted_ts DESC;
+`
+
+// MAX_WANTS_LIMIT caps the wanted elements listed in a request
+const MAX_WANTS_LIMIT = 1000
+
+// status is the response of GET /status
+type status struct {
+	Head             *head `json:"head"`
+	NetworkHead      int64 `json:"network_head"`
+	StoredBlock      int64 `json:"stored_block"`
+	HeadLag          int64 `json:"head_lag"`
+	StoredLag        int64 `json:"stored_lag"`
+	DispatcherPaused bool  `json:"dispatcher_paused"`
+	LoaderPaused     bool  `json:"loader_paused"`
+}
+
+// head is the last chain head we stored
+type head struct {
+	Number     int64   `json:"number"`
+	Hash       string  `json:"hash"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// want is a wanted element, as listed by the API
+type want struct {
+	Kind          string `json:"kind"`
+	Key           string `json:"key"`
+	Priority      int    `json:"priority"`
+	Attempts      int    `json:"attempts"`
+	LastError     string `json:"last_error,omitempty"`
+	InsertedTS    int64  `json:"inserted_ts"`
+	LastRequestTS int64  `json:"last_request_ts"`
+	NextAttemptTS int64  `json:"next_attempt_ts"`
+	SuccessTS     int64  `json:"success_ts"`
+	DeadTS        int64  `json:"dead_ts"`
+}
+
+// wantRequest is the body of the requests on a single wanted element
+type wantRequest struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	Priority *int   `json:"priority"`
+}
+
+// affected is the response of the requests updating wanted elements
+type affected struct {
+	Affected int64 `json:"affected"`
+}
+
+// handleStatus shows our last head, the one of the network, and how
+// far behind we are: the head lag is how many blocks our head is behind
+// the network one, and the stored lag how many blocks our last stored
+// block is behind our head
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var lastBlock db.LastBlock
+	err := a.dbMap.SelectOne(&lastBlock, headSQLQuery)
+	if err != nil && err != sql.ErrNoRows {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := &status{
+		NetworkHead:      -1,
+		DispatcherPaused: a.ethManager.Paused(),
+		LoaderPaused:     a.ipfsManager.Paused(),
+	}
+
+	if err == nil {
+		response.Head = &head{
+			Number:     lastBlock.NumberId,
+			Hash:       lastBlock.Hash,
+			AgeSeconds: time.Since(time.Unix(0, lastBlock.InsertedTS)).Seconds(),
+		}
+	}
+
+	response.StoredBlock, err = a.dbMap.SelectInt(storedBlockSQLQuery, eth.KindBlockHeader)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	networkHead, _, err := a.ethManager.NetworkHead(r.Context())
+	if err != nil {
+		log.Printf("Error requesting the network head: %v", err)
+	} else {
+		response.NetworkHead = networkHead
+	}
+
+	if response.Head != nil {
+		if response.NetworkHead >= 0 {
+			response.HeadLag = response.NetworkHead - response.Head.Number
+		}
+		response.StoredLag = response.Head.Number - response.StoredBlock
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleWants lists the wanted elements (GET), filtered by state
+// (pending, failed, dead or succeeded) and kind, or adds one (POST)
+func (a *AdminServer) handleWants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.listWants(w, r)
+	case "POST":
+		a.enqueueWant(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listWants handles GET /wants?state=&kind=&limit=&offset=
+func (a *AdminServer) listWants(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	state := query.Get("state")
+	if state == "" {
+		state = "pending"
+	}
+	condition, ok := wantStates[state]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "unknown state "+state)
+		return
+	}
+
+	limit, err := intParam(query.Get("limit"), 100)
+	if err != nil || limit < 1 || limit > MAX_WANTS_LIMIT {
+		writeError(w, http.StatusBadRequest,
+			fmt.Sprintf("limit must be between 1 and %v", MAX_WANTS_LIMIT))
+		return
+	}
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid offset")
+		return
+	}
+
+	var rows []*db.WantFromDevp2p
+	_, err = a.dbMap.Select(&rows,
+		fmt.Sprintf(wantsSQLQuery, condition),
+		query.Get("kind"),
+		limit,
+		offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	wants := make([]*want, 0, len(rows))
+	for _, row := range rows {
+		wants = append(wants, &want{
+			Kind:          row.Kind,
+			Key:           row.Key,
+			Priority:      row.Priority,
+			Attempts:      row.Attempts,
+			LastError:     row.LastError,
+			InsertedTS:    row.InsertedTS,
+			LastRequestTS: row.LastRequestTS,
+			NextAttemptTS: row.NextAttemptTS,
+			SuccessTS:     row.SuccessTS,
+			DeadTS:        row.DeadTS,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, wants)
+}
+
+// enqueueWant handles POST /wants, adding an element to the wanted
+// list. Elements already wanted only get their priority raised.
+func (a *AdminServer) enqueueWant(w http.ResponseWriter, r *http.Request) {
+	var request wantRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if !wantedKind(request.Kind) {
+		writeError(w, http.StatusBadRequest, "unknown kind "+request.Kind)
+		return
+	}
+	if request.Key == "" {
+		writeError(w, http.StatusBadRequest, "missing key")
+		return
+	}
+
+	priority := eth.PriorityHeadChildren
+	if request.Priority != nil {
+		priority = *request.Priority
+	}
+
+	err := db.Upsert(a.dbMap, &db.WantFromDevp2p{
+		InsertedTS: time.Now().UnixNano(),
+		Kind:       request.Kind,
+		Key:        request.Key,
+		Priority:   priority,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &affected{Affected: 1})
+}
+
+// handleRequeue asks again for a wanted element, whatever its state.
+// Without a key, it requeues every dead element of the kind.
+func (a *AdminServer) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	var request wantRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if !wantedKind(request.Kind) {
+		writeError(w, http.StatusBadRequest, "unknown kind "+request.Kind)
+		return
+	}
+
+	var result sql.Result
+	var err error
+	if request.Key == "" {
+		result, err = a.dbMap.Exec(requeueDeadSQLQuery, request.Kind)
+	} else {
+		result, err = a.dbMap.Exec(requeueWantSQLQuery, request.Kind, request.Key)
+	}
+
+	a.writeAffected(w, result, err)
+}
+
+// handleCancel gives up on a pending wanted element
+func (a *AdminServer) handleCancel(w http.ResponseWriter, r *http.Request) {
+	var request wantRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if request.Kind == "" || request.Key == "" {
+		writeError(w, http.StatusBadRequest, "missing kind or key")
+		return
+	}
+
+	result, err := a.dbMap.Exec(cancelWantSQLQuery,
+		request.Kind, request.Key, time.Now().UnixNano())
+	if err == nil {
+		a.ethManager.Forget(request.Kind, request.Key)
+	}
+
+	a.writeAffected(w, result, err)
+}
+
+// writeAffected writes how many rows the update affected
+func (a *AdminServer) writeAffected(w http.ResponseWriter, result sql.Result, err error) {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &affected{Affected: count})
+}
+
+// pausable is a loop we can pause and resume
+type pausable interface {
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+// pausedResponse is the response of the pause and resume requests
+type pausedResponse struct {
+	Paused bool `json:"paused"`
+}
+
+// handlePause pauses the given loop
+func (a *AdminServer) handlePause(loop pausable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loop.Pause()
+		writeJSON(w, http.StatusOK, &pausedResponse{Paused: loop.Paused()})
+	}
+}
+
+// handleResume resumes the given loop
+func (a *AdminServer) handleResume(loop pausable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loop.Resume()
+		writeJSON(w, http.StatusOK, &pausedResponse{Paused: loop.Paused()})
+	}
+}
+
+// backfillRequest is the body of POST /backfills
+type backfillRequest struct {
+	From  *int64 `json:"from"`
+	To    *int64 `json:"to"`
+	Chunk int64  `json:"chunk"`
+}
+
+// backfill is a backfill, as listed by the API
+type backfill struct {
+	From       int64 `json:"from"`
+	To         int64 `json:"to"`
+	NextNumber int64 `json:"next_number"`
+	InsertedTS int64 `json:"inserted_ts"`
+	UpdatedTS  int64 `json:"updated_ts"`
+	DoneTS     int64 `json:"done_ts"`
+}
+
+// handleBackfills lists the backfills (GET), or starts one in the
+// background (POST), the same way the backfill command does
+func (a *AdminServer) handleBackfills(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.listBackfills(w, r)
+	case "POST":
+		a.startBackfill(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listBackfills handles GET /backfills
+func (a *AdminServer) listBackfills(w http.ResponseWriter, r *http.Request) {
+	var rows []*db.Backfill
+	if _, err := a.dbMap.Select(&rows, backfillsSQLQuery); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	backfills := make([]*backfill, 0, len(rows))
+	for _, row := range rows {
+		backfills = append(backfills, &backfill{
+			From:       row.FromNumber,
+			To:         row.ToNumber,
+			NextNumber: row.NextNumber,
+			InsertedTS: row.InsertedTS,
+			UpdatedTS:  row.UpdatedTS,
+			DoneTS:     row.DoneTS,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, backfills)
+}
+
+// startBackfill handles POST /backfills. The backfill goes on in the
+// background, its progress is listed by GET /backfills
+func (a *AdminServer) startBackfill(w http.ResponseWriter, r *http.Request) {
+	var request backfillRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if request.From == nil || request.To == nil || *request.From < 0 || *request.To < *request.From {
+		writeError(w, http.StatusBadRequest, "invalid range")
+		return
+	}
+	if request.Chunk <= 0 {
+		request.Chunk = eth.BACKFILL_CHUNK_SIZE
+	}
+
+	from, to := *request.From, *request.To
+
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+
+		_, err := a.ethManager.Backfill(a.ctx, from, to, request.Chunk, nil)
+		if err == context.Canceled {
+			log.Printf("Backfill %v-%v interrupted, start it again to resume", from, to)
+			return
+		}
+		if err != nil {
+			log.Printf("Error on backfill %v-%v: %v", from, to, err)
+			return
+		}
+		log.Printf("Backfill %v-%v done", from, to)
+	}()
+
+	writeJSON(w, http.StatusAccepted, &backfill{From: from, To: to})
+}
+
+// handleLogs returns the logs matching the filter object of eth_getLogs
+// in the body, as eth_getLogs does
+func (a *AdminServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	query, err := logs.ParseFilter(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := a.logs.GetLogs(r.Context(), query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// wantedKind tells whether the dispatcher knows how to query for the kind
+func wantedKind(kind string) bool {
+	for _, k := range eth.WantedKinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// intParam parses an integer query parameter, with a default value
+func intParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	return strconv.Atoi(value)
+}
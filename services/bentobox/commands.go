@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/rpcserver"
+	gorp "gopkg.in/gorp.v1"
+)
+
+// runCommand executes the subcommand given after the options
+func runCommand(cfg *Config, dbmap *gorp.DbMap) error {
+	switch cfg.Command[0] {
+	case "migrate":
+		return migrateCommand(dbmap, cfg.Command[1:])
+	case "backfill":
+		return backfillCommand(dbmap, cfg.Command[1:])
+	case "rpc":
+		return rpcCommand(dbmap, cfg.ChainConfig, cfg.Command[1:])
+	default:
+		return fmt.Errorf("unknown command %v", cfg.Command[0])
+	}
+}
+
+// migrateCommand handles "migrate up|down|status"
+func migrateCommand(dbmap *gorp.DbMap, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: bentobox migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := db.MigrateUp(dbmap)
+		for _, m := range done {
+			fmt.Printf("applied %v %v\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("database is up to date")
+		}
+
+	case "down":
+		reverted, err := db.MigrateDown(dbmap)
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			fmt.Println("no migration to revert")
+			return nil
+		}
+		fmt.Printf("reverted %v %v\n", reverted.Version, reverted.Name)
+
+	case "status":
+		status, err := db.Migrations(dbmap)
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			state := "pending"
+			if m.Applied {
+				state = "applied " + time.Unix(0, m.AppliedTS).Format(time.RFC3339)
+			}
+			fmt.Printf("%3d  %-30v %v\n", m.Version, m.Name, state)
+		}
+
+	default:
+		return fmt.Errorf("usage: bentobox migrate up|down|status")
+	}
+
+	return nil
+}
+
+// backfillCommand handles "backfill --from N --to M [--chunk C]".
+// It can be interrupted, and resumes when run again with the same range.
+func backfillCommand(dbmap *gorp.DbMap, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := flags.Int64("from", -1, "first block number of the range")
+	to := flags.Int64("to", -1, "last block number of the range")
+	chunk := flags.Int64("chunk", eth.BACKFILL_CHUNK_SIZE, "blocks wanted per transaction")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from < 0 || *to < 0 {
+		return fmt.Errorf("usage: bentobox backfill --from N --to M [--chunk C]")
+	}
+
+	// stop between chunks on interruption, the progress is kept
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	total := *to - *from + 1
+	state, err := eth.Backfill(ctx, dbmap, *from, *to, *chunk,
+		func(p *eth.BackfillProgress) {
+			done := p.Backfill.NextNumber - p.Backfill.FromNumber
+			fmt.Printf("backfill %v-%v: %v/%v blocks (%.1f%%), %v wanted, %v skipped\n",
+				p.Backfill.FromNumber, p.Backfill.ToNumber, done, total,
+				float64(done)*100/float64(total), p.Enqueued, p.Skipped)
+		})
+
+	if err == context.Canceled {
+		fmt.Printf("backfill %v-%v interrupted at block %v, run it again to resume\n",
+			*from, *to, state.Backfill.NextNumber)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("backfill %v-%v done\n", *from, *to)
+	return nil
+}
+
+// rpcCommand handles "rpc [--addr ADDR]", serving the read only
+// eth JSON RPC out of the database until interrupted
+func rpcCommand(dbmap *gorp.DbMap, chainConfig *params.ChainConfig, args []string) error {
+	flags := flag.NewFlagSet("rpc", flag.ContinueOnError)
+	addr := flags.String("addr", rpcserver.DEFAULT_ADDR, "address to serve the eth JSON RPC on")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	rpcserver.NewServer(*addr, dbmap, chainConfig).Serve(ctx)
+	return nil
+}
+
+// interruptible returns a context cancelled on SIGINT or SIGTERM
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
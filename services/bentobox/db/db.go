@@ -20,8 +20,29 @@ type Options struct {
 // We index using the last inserted value, as there are
 // always chances to rewrites.
 type LastBlock struct {
-	InsertedTS int64 `db:"inserted_ts"` // doubles as PK
-	NumberId   int64 `db:"number_id"`
+	InsertedTS int64  `db:"inserted_ts"` // doubles as PK
+	NumberId   int64  `db:"number_id"`
+	Hash       string `db:"hash"`
+	ParentHash string `db:"parent_hash"`
+}
+
+// CanonicalBlock is our view of the canonical chain, one block per height.
+// Comparing new heads against it is how we detect reorgs.
+type CanonicalBlock struct {
+	NumberId   int64  `db:"number_id"` // doubles as PK
+	Hash       string `db:"hash"`
+	ParentHash string `db:"parent_hash"`
+	InsertedTS int64  `db:"inserted_ts"`
+}
+
+// ReorgEvent keeps record of every reorg we found, for auditing
+type ReorgEvent struct {
+	InsertedTS       int64  `db:"inserted_ts"`        // doubles as PK
+	NumberId         int64  `db:"number_id"`          // height of the new head
+	AncestorNumberId int64  `db:"ancestor_number_id"` // last block both chains share
+	Depth            int64  `db:"depth"`              // number of orphaned blocks
+	OrphanedHashes   string `db:"orphaned_hashes"`    // comma separated
+	CanonicalHashes  string `db:"canonical_hashes"`   // comma separated
 }
 
 // WantFromDevp2p is the least of wanted data for our agents
@@ -32,22 +53,30 @@ type WantFromDevp2p struct {
 	Key           string `db:"key"`             // id or hash required
 	LastRequestTS int64  `db:"last_request_ts"` // last time we sent a req for this key
 	SuccessTS     int64  `db:"success_ts"`      // so we know to not ask again for it
+	Attempts      int    `db:"attempts"`        // requests sent for this key so far
+	LastError     string `db:"last_error"`      // why the last request failed
+	NextAttemptTS int64  `db:"next_attempt_ts"` // not to be requested before this time
+	DeadTS        int64  `db:"dead_ts"`         // gave up on it, after too many attempts
+	Priority      int    `db:"priority"`        // the higher, the sooner we ask for it
 }
 
 // EthData is the data retrieved from the devp2p clients
 // we try to keep for the longest time possible our data in
 // here, to give the chance to agents to add it into several libp2p
-// availabilities, however in the future we may want to prune
-// this table.
+// availabilities, however the pruner (see the prune package) drops
+// the values already in IPFS, as configured.
 type EthData struct {
-	InsertedTS    int64  `db:"inserted_ts"`
-	Kind          string `db:"kind"`             // block body, tx receipt, etc
-	Hash          string `db:"hash"`             // ethereum hash id
-	CID           string `db:"cid"`              // ipld cid, useful, so we compute it once
-	Value         string `db:"value"`            // stored in stringed hex
-	LastIPFSAddTS int64  `db:"last_ipfs_add_ts"` // last time a client tried to add it into IPFS
-	IPFSSuccessTS int64  `db:"ipfs_success_ts"`  // so we know that we have add it at least once
-
+	InsertedTS    int64         `db:"inserted_ts"`
+	Kind          string        `db:"kind"`             // block body, tx receipt, etc
+	Hash          string        `db:"hash"`             // ethereum hash id
+	CID           string        `db:"cid"`              // ipld cid, useful, so we compute it once
+	Value         string        `db:"value"`            // stored in stringed hex
+	LastIPFSAddTS int64         `db:"last_ipfs_add_ts"` // last time a client tried to add it into IPFS
+	IPFSSuccessTS int64         `db:"ipfs_success_ts"`  // so we know that we have add it at least once
+	Orphaned      bool          `db:"orphaned"`         // its block is no longer canonical
+	NumberId      sql.NullInt64 `db:"number_id"`        // number of the block it came in, if any
+	PrunedTS      int64         `db:"pruned_ts"`        // its value was dropped, keeping its CID
+	IPFSAuditTS   int64         `db:"ipfs_audit_ts"`    // last time we checked it is still in IPFS
 }
 
 // BlockTx is useful to find out whether we have all the
@@ -57,6 +86,8 @@ type BlockTX struct {
 	InsertedTS int64  `db:"inserted_ts"`
 	BlockID    string `db:"block_id"`
 	TxId       string `db:"tx_id"`
+	Orphaned   bool   `db:"orphaned"` // the block is no longer canonical
+	TxIndex    int64  `db:"tx_index"` // position in the block, -1 if unknown
 }
 
 // BlockNumberofTx give us how many transactions a block has
@@ -73,23 +104,110 @@ type TxReceipts struct {
 	TxReceiptsId string `db:"tx_receipts_id"`
 }
 
-func InitDb(options Options) *gorp.DbMap {
-	dbinfo := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
+// Backfill is the progress of the wanting of a range of
+// historical blocks, so it can be resumed if interrupted
+type Backfill struct {
+	FromNumber int64 `db:"from_number"`
+	ToNumber   int64 `db:"to_number"`
+	NextNumber int64 `db:"next_number"` // first block not yet wanted
+	InsertedTS int64 `db:"inserted_ts"`
+	UpdatedTS  int64 `db:"updated_ts"`
+	DoneTS     int64 `db:"done_ts"`
+}
+
+// IPFSBlock is a block whose header, transactions, receipts
+// and uncles are all in IPFS, notified once
+type IPFSBlock struct {
+	Hash       string `db:"hash"` // doubles as PK
+	NumberId   int64  `db:"number_id"`
+	InsertedTS int64  `db:"inserted_ts"`
+}
+
+// Log is an event log of a transaction receipt, kept
+// for the queries of eth_getLogs (see the logs package)
+type Log struct {
+	BlockHash  string `db:"block_hash"` // doubles as PK
+	LogIndex   int64  `db:"log_index"`  // position in the block, doubles as PK
+	NumberId   int64  `db:"number_id"`
+	TxHash     string `db:"tx_hash"`
+	TxIndex    int64  `db:"tx_index"`
+	Address    string `db:"address"`
+	Topic0     string `db:"topic0"` // empty when the log has fewer topics
+	Topic1     string `db:"topic1"`
+	Topic2     string `db:"topic2"`
+	Topic3     string `db:"topic3"`
+	Data       string `db:"data"` // stored in stringed hex
+	InsertedTS int64  `db:"inserted_ts"`
+}
+
+// Bloom is the logs bloom of a block header, so we know
+// which blocks may have the logs we look for
+type Bloom struct {
+	BlockHash  string `db:"block_hash"` // doubles as PK
+	NumberId   int64  `db:"number_id"`
+	Bloom      string `db:"bloom"` // stored in stringed hex
+	InsertedTS int64  `db:"inserted_ts"`
+}
+
+// Trace is a call of the call tree of a transaction, internal or not,
+// as the callTracer of debug_traceBlockByNumber gives it
+type Trace struct {
+	BlockHash    string `db:"block_hash"` // doubles as PK
+	NumberId     int64  `db:"number_id"`
+	TxHash       string `db:"tx_hash"`
+	TxIndex      int64  `db:"tx_index"`      // doubles as PK
+	TraceAddress string `db:"trace_address"` // path in the tree ("0,2,1"), doubles as PK
+	Depth        int64  `db:"depth"`         // 0 for the transaction itself
+	Type         string `db:"type"`          // CALL, CREATE, DELEGATECALL, SELFDESTRUCT...
+	FromAddress  string `db:"from_address"`
+	ToAddress    string `db:"to_address"`
+	Value        string `db:"value"` // wei, in base 10
+	Error        string `db:"error"` // empty unless the call failed
+	InsertedTS   int64  `db:"inserted_ts"`
+}
+
+// ConnInfo is the connection string of the database,
+// for the ones connecting on their own (i.e. to LISTEN)
+func ConnInfo(options Options) string {
+	return fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
 		options.User, options.Password, options.DBName)
+}
 
-	db, err := sql.Open("postgres", dbinfo)
+// OpenDb opens a pool of connections to the database.
+// InitDb() uses it, as do the ones who need a pool of their own.
+func OpenDb(options Options) *sql.DB {
+	db, err := sql.Open("postgres", ConnInfo(options))
 	if err != nil {
 		log.Fatalf("sql.Open failed %v", err)
 	}
 
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	return db
+}
 
-	dbmap.AddTableWithName(LastBlock{}, "lastblock")
-	dbmap.AddTableWithName(WantFromDevp2p{}, "wantfromdevp2p")
-	dbmap.AddTableWithName(EthData{}, "ethdata")
-	dbmap.AddTableWithName(BlockTX{}, "blocktx")
-	dbmap.AddTableWithName(BlockNumberofTx{}, "blocknumberoftx")
-	dbmap.AddTableWithName(TxReceipts{}, "txreceipts")
+func InitDb(options Options) *gorp.DbMap {
+	db := OpenDb(options)
+
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	AddTables(dbmap)
 
 	return dbmap
 }
+
+// AddTables maps our tables into the given DbMap,
+// with the keys as defined by the schema migrations
+func AddTables(dbmap *gorp.DbMap) {
+	dbmap.AddTableWithName(LastBlock{}, "lastblock").SetKeys(false, "inserted_ts")
+	dbmap.AddTableWithName(WantFromDevp2p{}, "wantfromdevp2p").SetKeys(false, "kind", "key")
+	dbmap.AddTableWithName(EthData{}, "ethdata").SetKeys(false, "kind", "hash")
+	dbmap.AddTableWithName(BlockTX{}, "blocktx").SetKeys(false, "block_id", "tx_id")
+	dbmap.AddTableWithName(BlockNumberofTx{}, "blocknumberoftx").SetKeys(false, "block_id")
+	dbmap.AddTableWithName(TxReceipts{}, "txreceipts").SetKeys(false, "tx_id", "tx_receipts_id")
+	dbmap.AddTableWithName(CanonicalBlock{}, "canonicalblocks").SetKeys(false, "number_id")
+	dbmap.AddTableWithName(Backfill{}, "backfills").SetKeys(false, "from_number", "to_number")
+	dbmap.AddTableWithName(ReorgEvent{}, "reorgevents").SetKeys(false, "inserted_ts")
+	dbmap.AddTableWithName(IPFSBlock{}, "ipfsblocks").SetKeys(false, "hash")
+	dbmap.AddTableWithName(Log{}, "logs").SetKeys(false, "block_hash", "log_index")
+	dbmap.AddTableWithName(Bloom{}, "blooms").SetKeys(false, "block_hash")
+	dbmap.AddTableWithName(Trace{}, "traces").SetKeys(false, "block_hash", "tx_index", "trace_address")
+	dbmap.AddTableWithName(SchemaMigration{}, "schema_migrations").SetKeys(false, "version")
+}
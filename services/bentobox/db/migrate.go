@@ -0,0 +1,157 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	gorp "gopkg.in/gorp.v1"
+)
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int    `db:"version"`
+	Name      string `db:"name"`
+	AppliedTS int64  `db:"applied_ts"`
+}
+
+// MigrationStatus tells whether a migration is applied or pending
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedTS int64
+}
+
+const createSchemaMigrationsSQLQuery = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer PRIMARY KEY,
+	name text NOT NULL,
+	applied_ts bigint NOT NULL
+);
+`
+
+// MigrateUp applies every pending migration, in order.
+// Each migration runs in its own transaction.
+func MigrateUp(dbMap *gorp.DbMap) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(dbMap)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []MigrationStatus{}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		err = runMigration(dbMap, m.Up, func(tx *gorp.Transaction) error {
+			return tx.Insert(&SchemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedTS: now,
+			})
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %v (%v) failed: %v", m.Version, m.Name, err)
+		}
+
+		done = append(done, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   true,
+			AppliedTS: now,
+		})
+	}
+
+	return done, nil
+}
+
+// MigrateDown reverts the last applied migration.
+// Returns nil if there was nothing to revert.
+func MigrateDown(dbMap *gorp.DbMap) (*MigrationStatus, error) {
+	applied, err := appliedMigrations(dbMap)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err = runMigration(dbMap, m.Down, func(tx *gorp.Transaction) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("migration %v (%v) revert failed: %v", m.Version, m.Name, err)
+		}
+
+		return &MigrationStatus{Version: m.Version, Name: m.Name}, nil
+	}
+
+	return nil, nil
+}
+
+// Migrations returns the status of every known migration
+func Migrations(dbMap *gorp.DbMap) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(dbMap)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			s.Applied = true
+			s.AppliedTS = a.AppliedTS
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// appliedMigrations returns the applied migrations by version,
+// creating the tracking table if needed
+func appliedMigrations(dbMap *gorp.DbMap) (map[int]*SchemaMigration, error) {
+	if _, err := dbMap.Exec(createSchemaMigrationsSQLQuery); err != nil {
+		return nil, err
+	}
+
+	var rows []*SchemaMigration
+	if _, err := dbMap.Select(&rows, "SELECT version, name, applied_ts FROM schema_migrations"); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]*SchemaMigration)
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// runMigration executes the given DDL and the bookkeeping
+// in the same transaction
+func runMigration(dbMap *gorp.DbMap, ddl string, bookkeeping func(*gorp.Transaction) error) error {
+	tx, err := dbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(ddl); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = bookkeeping(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,482 @@
+package db
+
+// migration is a versioned change of the database schema.
+// Versions must be consecutive, starting from 1, and once released
+// a migration must never be edited: add a new one instead.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations is the whole history of the bentobox schema
+var migrations = []migration{
+	{
+		// Same schema as the former database.sql dump, so databases
+		// restored from it can be upgraded without losing data.
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+CREATE TABLE IF NOT EXISTS lastblock (
+	inserted_ts bigint,
+	number_id bigint
+);
+
+CREATE TABLE IF NOT EXISTS wantfromdevp2p (
+	inserted_ts bigint,
+	kind text,
+	key text,
+	last_request_ts bigint,
+	success_ts bigint
+);
+
+CREATE TABLE IF NOT EXISTS ethdata (
+	inserted_ts bigint,
+	kind text,
+	hash text,
+	cid text,
+	value text,
+	last_ipfs_add_ts bigint,
+	ipfs_success_ts bigint
+);
+
+CREATE TABLE IF NOT EXISTS blocktx (
+	inserted_ts bigint,
+	block_id text,
+	tx_id text
+);
+
+CREATE TABLE IF NOT EXISTS blocknumberoftx (
+	inserted_ts bigint,
+	block_id text,
+	number_of_txs bigint
+);
+
+CREATE TABLE IF NOT EXISTS txreceipts (
+	inserted_ts bigint,
+	tx_id text,
+	tx_receipts_id text
+);
+
+CREATE INDEX IF NOT EXISTS inserted_ts_lb_idx ON lastblock USING btree (inserted_ts);
+CREATE INDEX IF NOT EXISTS number_id_lb_idx ON lastblock USING btree (number_id);
+
+CREATE INDEX IF NOT EXISTS inserted_ts_wfd_idx ON wantfromdevp2p USING btree (inserted_ts);
+CREATE INDEX IF NOT EXISTS key_wfd_idx ON wantfromdevp2p USING btree (key);
+CREATE INDEX IF NOT EXISTS last_request_ts_wfd_idx ON wantfromdevp2p USING btree (last_request_ts);
+CREATE INDEX IF NOT EXISTS success_ts_wfd_idx ON wantfromdevp2p USING btree (success_ts);
+
+CREATE INDEX IF NOT EXISTS inserted_ts_ed_idx ON ethdata USING btree (inserted_ts);
+CREATE INDEX IF NOT EXISTS hash_ed_idx ON ethdata USING btree (hash);
+CREATE INDEX IF NOT EXISTS cid_ed_idx ON ethdata USING btree (cid);
+CREATE INDEX IF NOT EXISTS last_ipfs_add_ts_ed_idx ON ethdata USING btree (last_ipfs_add_ts);
+CREATE INDEX IF NOT EXISTS ipfs_success_ts_ed_idx ON ethdata USING btree (ipfs_success_ts);
+
+CREATE INDEX IF NOT EXISTS inserted_ts_bt_idx ON blocktx USING btree (inserted_ts);
+CREATE INDEX IF NOT EXISTS block_id_bt_idx ON blocktx USING btree (block_id);
+CREATE INDEX IF NOT EXISTS tx_id_bt_idx ON blocktx USING btree (tx_id);
+
+CREATE INDEX IF NOT EXISTS inserted_ts_bnot_idx ON blocknumberoftx USING btree (inserted_ts);
+CREATE INDEX IF NOT EXISTS block_id_bnot_idx ON blocknumberoftx USING btree (block_id);
+
+CREATE INDEX IF NOT EXISTS inserted_ts_tr_idx ON txreceipts USING btree (inserted_ts);
+CREATE INDEX IF NOT EXISTS tx_id_tr_idx ON txreceipts USING btree (tx_id);
+CREATE INDEX IF NOT EXISTS tx_receipts_id_tr_idx ON txreceipts USING btree (tx_receipts_id);
+`,
+		Down: `
+DROP TABLE IF EXISTS txreceipts;
+DROP TABLE IF EXISTS blocknumberoftx;
+DROP TABLE IF EXISTS blocktx;
+DROP TABLE IF EXISTS ethdata;
+DROP TABLE IF EXISTS wantfromdevp2p;
+DROP TABLE IF EXISTS lastblock;
+`,
+	},
+	{
+		// Before adding the keys we get rid of the duplicates
+		// piled up so far, keeping the most advanced tuple of each group.
+		Version: 2,
+		Name:    "primary keys and uniqueness",
+		Up: `
+DELETE FROM lastblock
+WHERE ctid NOT IN (
+	SELECT DISTINCT ON (inserted_ts) ctid
+	FROM lastblock
+);
+
+DELETE FROM wantfromdevp2p
+WHERE ctid NOT IN (
+	SELECT DISTINCT ON (kind, key) ctid
+	FROM wantfromdevp2p
+	ORDER BY kind, key, success_ts DESC, inserted_ts ASC
+);
+
+DELETE FROM ethdata
+WHERE ctid NOT IN (
+	SELECT DISTINCT ON (kind, hash) ctid
+	FROM ethdata
+	ORDER BY kind, hash, ipfs_success_ts DESC, inserted_ts ASC
+);
+
+DELETE FROM blocktx
+WHERE ctid NOT IN (
+	SELECT DISTINCT ON (block_id, tx_id) ctid
+	FROM blocktx
+	ORDER BY block_id, tx_id, inserted_ts ASC
+);
+
+DELETE FROM blocknumberoftx
+WHERE ctid NOT IN (
+	SELECT DISTINCT ON (block_id) ctid
+	FROM blocknumberoftx
+	ORDER BY block_id, inserted_ts ASC
+);
+
+DELETE FROM txreceipts
+WHERE ctid NOT IN (
+	SELECT DISTINCT ON (tx_id, tx_receipts_id) ctid
+	FROM txreceipts
+	ORDER BY tx_id, tx_receipts_id, inserted_ts ASC
+);
+
+UPDATE wantfromdevp2p SET last_request_ts = 0 WHERE last_request_ts IS NULL;
+UPDATE wantfromdevp2p SET success_ts = 0 WHERE success_ts IS NULL;
+ALTER TABLE wantfromdevp2p
+	ALTER COLUMN last_request_ts SET DEFAULT 0,
+	ALTER COLUMN last_request_ts SET NOT NULL,
+	ALTER COLUMN success_ts SET DEFAULT 0,
+	ALTER COLUMN success_ts SET NOT NULL;
+
+UPDATE ethdata SET last_ipfs_add_ts = 0 WHERE last_ipfs_add_ts IS NULL;
+UPDATE ethdata SET ipfs_success_ts = 0 WHERE ipfs_success_ts IS NULL;
+ALTER TABLE ethdata
+	ALTER COLUMN last_ipfs_add_ts SET DEFAULT 0,
+	ALTER COLUMN last_ipfs_add_ts SET NOT NULL,
+	ALTER COLUMN ipfs_success_ts SET DEFAULT 0,
+	ALTER COLUMN ipfs_success_ts SET NOT NULL;
+
+ALTER TABLE lastblock ADD CONSTRAINT lastblock_pkey PRIMARY KEY (inserted_ts);
+ALTER TABLE wantfromdevp2p ADD CONSTRAINT wantfromdevp2p_pkey PRIMARY KEY (kind, key);
+ALTER TABLE ethdata ADD CONSTRAINT ethdata_pkey PRIMARY KEY (kind, hash);
+ALTER TABLE blocktx ADD CONSTRAINT blocktx_pkey PRIMARY KEY (block_id, tx_id);
+ALTER TABLE blocknumberoftx ADD CONSTRAINT blocknumberoftx_pkey PRIMARY KEY (block_id);
+ALTER TABLE txreceipts ADD CONSTRAINT txreceipts_pkey PRIMARY KEY (tx_id, tx_receipts_id);
+
+-- the dispatcher and the loader only care about the pending elements
+CREATE INDEX pending_wfd_idx ON wantfromdevp2p USING btree (last_request_ts) WHERE success_ts = 0;
+CREATE INDEX pending_ed_idx ON ethdata USING btree (last_ipfs_add_ts) WHERE ipfs_success_ts = 0;
+`,
+		Down: `
+DROP INDEX IF EXISTS pending_ed_idx;
+DROP INDEX IF EXISTS pending_wfd_idx;
+
+ALTER TABLE txreceipts DROP CONSTRAINT IF EXISTS txreceipts_pkey;
+ALTER TABLE blocknumberoftx DROP CONSTRAINT IF EXISTS blocknumberoftx_pkey;
+ALTER TABLE blocktx DROP CONSTRAINT IF EXISTS blocktx_pkey;
+ALTER TABLE ethdata DROP CONSTRAINT IF EXISTS ethdata_pkey;
+ALTER TABLE wantfromdevp2p DROP CONSTRAINT IF EXISTS wantfromdevp2p_pkey;
+ALTER TABLE lastblock DROP CONSTRAINT IF EXISTS lastblock_pkey;
+
+ALTER TABLE ethdata
+	ALTER COLUMN last_ipfs_add_ts DROP NOT NULL,
+	ALTER COLUMN last_ipfs_add_ts DROP DEFAULT,
+	ALTER COLUMN ipfs_success_ts DROP NOT NULL,
+	ALTER COLUMN ipfs_success_ts DROP DEFAULT;
+
+ALTER TABLE wantfromdevp2p
+	ALTER COLUMN last_request_ts DROP NOT NULL,
+	ALTER COLUMN last_request_ts DROP DEFAULT,
+	ALTER COLUMN success_ts DROP NOT NULL,
+	ALTER COLUMN success_ts DROP DEFAULT;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "reorg tracking",
+		Up: `
+ALTER TABLE lastblock
+	ADD COLUMN hash text NOT NULL DEFAULT '',
+	ADD COLUMN parent_hash text NOT NULL DEFAULT '';
+
+ALTER TABLE ethdata ADD COLUMN orphaned boolean NOT NULL DEFAULT false;
+ALTER TABLE blocktx ADD COLUMN orphaned boolean NOT NULL DEFAULT false;
+
+CREATE TABLE canonicalblocks (
+	number_id bigint PRIMARY KEY,
+	hash text NOT NULL,
+	parent_hash text NOT NULL,
+	inserted_ts bigint NOT NULL
+);
+
+CREATE INDEX hash_cb_idx ON canonicalblocks USING btree (hash);
+
+CREATE TABLE reorgevents (
+	inserted_ts bigint PRIMARY KEY,
+	number_id bigint NOT NULL,
+	ancestor_number_id bigint NOT NULL,
+	depth bigint NOT NULL,
+	orphaned_hashes text NOT NULL,
+	canonical_hashes text NOT NULL
+);
+`,
+		Down: `
+DROP TABLE IF EXISTS reorgevents;
+DROP TABLE IF EXISTS canonicalblocks;
+
+ALTER TABLE blocktx DROP COLUMN IF EXISTS orphaned;
+ALTER TABLE ethdata DROP COLUMN IF EXISTS orphaned;
+
+ALTER TABLE lastblock
+	DROP COLUMN IF EXISTS parent_hash,
+	DROP COLUMN IF EXISTS hash;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "retries of wanted elements",
+		Up: `
+ALTER TABLE wantfromdevp2p
+	ADD COLUMN attempts integer NOT NULL DEFAULT 0,
+	ADD COLUMN last_error text NOT NULL DEFAULT '',
+	ADD COLUMN next_attempt_ts bigint NOT NULL DEFAULT 0,
+	ADD COLUMN dead_ts bigint NOT NULL DEFAULT 0;
+
+-- the dispatcher now claims by the time of the next attempt
+DROP INDEX IF EXISTS pending_wfd_idx;
+CREATE INDEX pending_wfd_idx ON wantfromdevp2p USING btree (kind, next_attempt_ts)
+	WHERE success_ts = 0 AND dead_ts = 0;
+CREATE INDEX dead_wfd_idx ON wantfromdevp2p USING btree (dead_ts) WHERE dead_ts > 0;
+`,
+		Down: `
+DROP INDEX IF EXISTS dead_wfd_idx;
+DROP INDEX IF EXISTS pending_wfd_idx;
+CREATE INDEX pending_wfd_idx ON wantfromdevp2p USING btree (last_request_ts) WHERE success_ts = 0;
+
+ALTER TABLE wantfromdevp2p
+	DROP COLUMN IF EXISTS dead_ts,
+	DROP COLUMN IF EXISTS next_attempt_ts,
+	DROP COLUMN IF EXISTS last_error,
+	DROP COLUMN IF EXISTS attempts;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "backfills",
+		Up: `
+-- so we know which blocks we already have, by number
+ALTER TABLE ethdata ADD COLUMN number_id bigint;
+CREATE INDEX number_ed_idx ON ethdata USING btree (number_id) WHERE kind = 'block_header';
+
+CREATE TABLE backfills (
+	from_number bigint NOT NULL,
+	to_number bigint NOT NULL,
+	next_number bigint NOT NULL,
+	inserted_ts bigint NOT NULL,
+	updated_ts bigint NOT NULL,
+	done_ts bigint NOT NULL DEFAULT 0,
+	PRIMARY KEY (from_number, to_number)
+);
+`,
+		Down: `
+DROP TABLE IF EXISTS backfills;
+
+DROP INDEX IF EXISTS number_ed_idx;
+ALTER TABLE ethdata DROP COLUMN IF EXISTS number_id;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "priority of wanted elements",
+		Up: `
+ALTER TABLE wantfromdevp2p ADD COLUMN priority integer NOT NULL DEFAULT 0;
+
+-- the dispatcher claims by priority, then by the time of the next attempt
+DROP INDEX IF EXISTS pending_wfd_idx;
+CREATE INDEX pending_wfd_idx ON wantfromdevp2p USING btree (kind, priority DESC, next_attempt_ts)
+	WHERE success_ts = 0 AND dead_ts = 0;
+`,
+		Down: `
+DROP INDEX IF EXISTS pending_wfd_idx;
+CREATE INDEX pending_wfd_idx ON wantfromdevp2p USING btree (kind, next_attempt_ts)
+	WHERE success_ts = 0 AND dead_ts = 0;
+
+ALTER TABLE wantfromdevp2p DROP COLUMN IF EXISTS priority;
+`,
+	},
+	{
+		Version: 7,
+		Name:    "pruning of ethdata",
+		Up: `
+-- pruned rows keep their CID, but not their value
+ALTER TABLE ethdata ADD COLUMN pruned_ts bigint NOT NULL DEFAULT 0;
+
+-- the pruner walks the rows already in IPFS, the oldest first
+CREATE INDEX prunable_ed_idx ON ethdata USING btree (ipfs_success_ts)
+	WHERE pruned_ts = 0 AND ipfs_success_ts > 0;
+
+-- the transactions and receipts know the number of their block,
+-- as the headers do, so the pruner can keep the last blocks whole
+UPDATE ethdata
+SET number_id = header.number_id
+FROM blocktx
+JOIN ethdata header ON header.kind = 'block_header' AND header.hash = blocktx.block_id
+WHERE
+	ethdata.kind = 'transaction'
+	AND
+	ethdata.hash = blocktx.tx_id
+	AND
+	ethdata.number_id IS NULL
+	AND
+	NOT blocktx.orphaned;
+
+UPDATE ethdata
+SET number_id = tx.number_id
+FROM txreceipts
+JOIN ethdata tx ON tx.kind = 'transaction' AND tx.hash = txreceipts.tx_id
+WHERE
+	ethdata.kind = 'tx_receipt'
+	AND
+	ethdata.hash = txreceipts.tx_receipts_id
+	AND
+	ethdata.number_id IS NULL;
+`,
+		Down: `
+-- the numbers of the transactions and receipts are kept,
+-- the queries by number only look at the headers
+DROP INDEX IF EXISTS prunable_ed_idx;
+ALTER TABLE ethdata DROP COLUMN IF EXISTS pruned_ts;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "audit of ethdata in IPFS",
+		Up: `
+-- last time the auditor checked the element is still in IPFS
+ALTER TABLE ethdata ADD COLUMN ipfs_audit_ts bigint NOT NULL DEFAULT 0;
+
+-- the auditor sweeps the elements in IPFS, the least recently audited first
+CREATE INDEX auditable_ed_idx ON ethdata USING btree (ipfs_audit_ts)
+	WHERE ipfs_success_ts > 0;
+`,
+		Down: `
+DROP INDEX IF EXISTS auditable_ed_idx;
+ALTER TABLE ethdata DROP COLUMN IF EXISTS ipfs_audit_ts;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "blocks fully in IPFS",
+		Up: `
+-- the blocks whose header, transactions, receipts and uncles
+-- are all in IPFS, so we notify each one of them only once
+CREATE TABLE ipfsblocks (
+	hash text PRIMARY KEY,
+	number_id bigint NOT NULL,
+	inserted_ts bigint NOT NULL
+);
+
+CREATE INDEX number_id_ib_idx ON ipfsblocks USING btree (number_id);
+
+-- the uncles of a block are found by its number, as the headers are
+CREATE INDEX uncle_number_ed_idx ON ethdata USING btree (number_id) WHERE kind = 'uncle';
+`,
+		Down: `
+DROP INDEX IF EXISTS uncle_number_ed_idx;
+DROP TABLE IF EXISTS ipfsblocks;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "logs and blooms",
+		Up: `
+-- the event logs of the receipts, for the queries of eth_getLogs,
+-- found by block. The logs of orphaned blocks are kept, the queries
+-- only look at the blocks whose header is not orphaned
+CREATE TABLE logs (
+	block_hash text NOT NULL,
+	log_index bigint NOT NULL,
+	number_id bigint NOT NULL,
+	tx_hash text NOT NULL,
+	tx_index bigint NOT NULL,
+	address text NOT NULL,
+	topic0 text NOT NULL DEFAULT '',
+	topic1 text NOT NULL DEFAULT '',
+	topic2 text NOT NULL DEFAULT '',
+	topic3 text NOT NULL DEFAULT '',
+	data text NOT NULL DEFAULT '',
+	inserted_ts bigint NOT NULL,
+	PRIMARY KEY (block_hash, log_index)
+);
+
+-- the logs bloom of every block header, so the queries skip
+-- the blocks without the addresses and topics they look for
+CREATE TABLE blooms (
+	block_hash text PRIMARY KEY,
+	number_id bigint NOT NULL,
+	bloom text NOT NULL,
+	inserted_ts bigint NOT NULL
+);
+`,
+		Down: `
+DROP TABLE IF EXISTS blooms;
+DROP TABLE IF EXISTS logs;
+`,
+	},
+	{
+		Version: 11,
+		Name:    "position of the transactions in their block",
+		Up: `
+-- the transactions of the blocks stored before keep -1, as we
+-- don't know their position (the blocks can be wanted again)
+ALTER TABLE blocktx ADD COLUMN tx_index bigint NOT NULL DEFAULT -1;
+`,
+		Down: `
+ALTER TABLE blocktx DROP COLUMN IF EXISTS tx_index;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "internal call traces",
+		Up: `
+-- the call tree of every transaction, flattened depth first, as the
+-- callTracer of debug_traceBlockByNumber gives it. trace_address is the
+-- path of the call in the tree ("0,2,1"), empty for the top call
+CREATE TABLE traces (
+	block_hash text NOT NULL,
+	number_id bigint NOT NULL,
+	tx_hash text NOT NULL,
+	tx_index bigint NOT NULL,
+	trace_address text NOT NULL,
+	depth bigint NOT NULL,
+	type text NOT NULL,
+	from_address text NOT NULL,
+	to_address text NOT NULL DEFAULT '',
+	value numeric NOT NULL DEFAULT 0,
+	error text NOT NULL DEFAULT '',
+	inserted_ts bigint NOT NULL,
+	PRIMARY KEY (block_hash, tx_index, trace_address)
+);
+
+CREATE INDEX traces_from_address_idx ON traces (from_address);
+CREATE INDEX traces_to_address_idx ON traces (to_address);
+`,
+		Down: `
+DROP TABLE IF EXISTS traces;
+`,
+	},
+	{
+		Version: 13,
+		Name:    "order of the elements loaded into IPFS",
+		Up: `
+-- the loader claims the elements of the latest blocks first
+DROP INDEX IF EXISTS pending_ed_idx;
+CREATE INDEX pending_ed_idx ON ethdata USING btree (number_id DESC NULLS LAST)
+	WHERE ipfs_success_ts = 0 AND pruned_ts = 0;
+`,
+		Down: `
+DROP INDEX IF EXISTS pending_ed_idx;
+CREATE INDEX pending_ed_idx ON ethdata USING btree (last_ipfs_add_ts) WHERE ipfs_success_ts = 0;
+`,
+	},
+}
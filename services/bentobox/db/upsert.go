@@ -0,0 +1,132 @@
+package db
+
+import (
+	"fmt"
+
+	gorp "gopkg.in/gorp.v1"
+)
+
+// below queries insert a tuple, unless there is already one
+// with the same key, in which case we keep the existing one.
+// The exception is the orphaned flag: if we store again an element,
+// it is because it belongs to a canonical block. Likewise, canonical
+// blocks are replaced, as our view of the chain changes.
+
+const upsertLastBlockSQLQuery = `
+INSERT INTO lastblock (inserted_ts, number_id, hash, parent_hash)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (inserted_ts) DO NOTHING;
+`
+
+const upsertWantFromDevp2pSQLQuery = `
+INSERT INTO wantfromdevp2p (inserted_ts, kind, key, last_request_ts, success_ts, priority)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (kind, key) DO UPDATE
+SET priority = GREATEST(wantfromdevp2p.priority, EXCLUDED.priority);
+`
+
+// a pruned row gets its value back when stored again
+const upsertEthDataSQLQuery = `
+INSERT INTO ethdata (inserted_ts, kind, hash, cid, value, last_ipfs_add_ts, ipfs_success_ts, orphaned, number_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (kind, hash) DO UPDATE
+SET orphaned = EXCLUDED.orphaned, number_id = COALESCE(EXCLUDED.number_id, ethdata.number_id),
+	value = EXCLUDED.value, pruned_ts = 0;
+`
+
+const upsertBlockTXSQLQuery = `
+INSERT INTO blocktx (inserted_ts, block_id, tx_id, orphaned, tx_index)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (block_id, tx_id) DO UPDATE SET orphaned = EXCLUDED.orphaned, tx_index = EXCLUDED.tx_index;
+`
+
+const upsertBlockNumberofTxSQLQuery = `
+INSERT INTO blocknumberoftx (inserted_ts, block_id, number_of_txs)
+VALUES ($1, $2, $3)
+ON CONFLICT (block_id) DO NOTHING;
+`
+
+const upsertCanonicalBlockSQLQuery = `
+INSERT INTO canonicalblocks (number_id, hash, parent_hash, inserted_ts)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (number_id) DO UPDATE
+SET hash = EXCLUDED.hash, parent_hash = EXCLUDED.parent_hash, inserted_ts = EXCLUDED.inserted_ts;
+`
+
+const upsertTxReceiptsSQLQuery = `
+INSERT INTO txreceipts (inserted_ts, tx_id, tx_receipts_id)
+VALUES ($1, $2, $3)
+ON CONFLICT (tx_id, tx_receipts_id) DO NOTHING;
+`
+
+const upsertLogSQLQuery = `
+INSERT INTO logs (block_hash, log_index, number_id, tx_hash, tx_index, address,
+	topic0, topic1, topic2, topic3, data, inserted_ts)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (block_hash, log_index) DO NOTHING;
+`
+
+const upsertBloomSQLQuery = `
+INSERT INTO blooms (block_hash, number_id, bloom, inserted_ts)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (block_hash) DO NOTHING;
+`
+
+const upsertTraceSQLQuery = `
+INSERT INTO traces (block_hash, number_id, tx_hash, tx_index, trace_address, depth,
+	type, from_address, to_address, value, error, inserted_ts)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (block_hash, tx_index, trace_address) DO NOTHING;
+`
+
+// Upsert inserts the given tuples, skipping the ones already stored.
+// It takes the same pointers to tuples gorp Insert() does, and works
+// with both the DbMap and a transaction.
+func Upsert(exec gorp.SqlExecutor, list ...interface{}) error {
+	var err error
+
+	for _, item := range list {
+		switch t := item.(type) {
+		case *LastBlock:
+			_, err = exec.Exec(upsertLastBlockSQLQuery,
+				t.InsertedTS, t.NumberId, t.Hash, t.ParentHash)
+		case *WantFromDevp2p:
+			_, err = exec.Exec(upsertWantFromDevp2pSQLQuery,
+				t.InsertedTS, t.Kind, t.Key, t.LastRequestTS, t.SuccessTS, t.Priority)
+		case *EthData:
+			_, err = exec.Exec(upsertEthDataSQLQuery,
+				t.InsertedTS, t.Kind, t.Hash, t.CID, t.Value, t.LastIPFSAddTS, t.IPFSSuccessTS, t.Orphaned, t.NumberId)
+		case *BlockTX:
+			_, err = exec.Exec(upsertBlockTXSQLQuery,
+				t.InsertedTS, t.BlockID, t.TxId, t.Orphaned, t.TxIndex)
+		case *BlockNumberofTx:
+			_, err = exec.Exec(upsertBlockNumberofTxSQLQuery,
+				t.InsertedTS, t.BlockID, t.NumberOfTxs)
+		case *CanonicalBlock:
+			_, err = exec.Exec(upsertCanonicalBlockSQLQuery,
+				t.NumberId, t.Hash, t.ParentHash, t.InsertedTS)
+		case *TxReceipts:
+			_, err = exec.Exec(upsertTxReceiptsSQLQuery,
+				t.InsertedTS, t.TxId, t.TxReceiptsId)
+		case *Log:
+			_, err = exec.Exec(upsertLogSQLQuery,
+				t.BlockHash, t.LogIndex, t.NumberId, t.TxHash, t.TxIndex, t.Address,
+				t.Topic0, t.Topic1, t.Topic2, t.Topic3, t.Data, t.InsertedTS)
+		case *Bloom:
+			_, err = exec.Exec(upsertBloomSQLQuery,
+				t.BlockHash, t.NumberId, t.Bloom, t.InsertedTS)
+		case *Trace:
+			_, err = exec.Exec(upsertTraceSQLQuery,
+				t.BlockHash, t.NumberId, t.TxHash, t.TxIndex, t.TraceAddress, t.Depth,
+				t.Type, t.FromAddress, t.ToAddress, t.Value, t.Error, t.InsertedTS)
+		default:
+			return fmt.Errorf("can't upsert element of type %T", item)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
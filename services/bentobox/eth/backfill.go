@@ -0,0 +1,181 @@
+package eth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	gorp "gopkg.in/gorp.v1"
+)
+
+// BACKFILL_CHUNK_SIZE is the default number of blocks wanted per transaction
+const BACKFILL_CHUNK_SIZE = 1000
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// Registers the range, unless we already started it before,
+// so the stored progress is kept
+const startBackfillSQLQuery = `
+INSERT INTO backfills (from_number, to_number, next_number, inserted_ts, updated_ts, done_ts)
+VALUES ($1, $2, $1, $3, $3, 0)
+ON CONFLICT (from_number, to_number) DO NOTHING;
+`
+
+const backfillSQLQuery = `
+SELECT from_number, to_number, next_number, inserted_ts, updated_ts, done_ts
+FROM backfills
+WHERE
+	from_number = $1
+	AND
+	to_number = $2;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * Generates the block numbers of the chunk
+// * Leaves out the ones whose (non orphaned) header we already have
+// * Wants the block body of the rest, skipping the ones already wanted
+const wantBackfillChunkSQLQuery = `
+INSERT INTO wantfromdevp2p (inserted_ts, kind, key, last_request_ts, success_ts, priority)
+SELECT $1, $2, n::text, 0, 0, $6
+FROM generate_series($3::bigint, $4::bigint) AS n
+WHERE NOT EXISTS (
+	SELECT 1
+	FROM ethdata
+	WHERE
+		kind = $5
+		AND
+		number_id = n
+		AND
+		NOT orphaned
+)
+ON CONFLICT (kind, key) DO NOTHING;
+`
+
+const updateBackfillSQLQuery = `
+UPDATE backfills
+SET next_number = $3, updated_ts = $4, done_ts = $5
+WHERE
+	from_number = $1
+	AND
+	to_number = $2;
+`
+
+// BackfillProgress is reported after every chunk of a backfill
+type BackfillProgress struct {
+	Backfill *db.Backfill
+	Enqueued int64 // blocks wanted in this run
+	Skipped  int64 // blocks we already had (or wanted) in this run
+}
+
+// Backfill wants the block bodies of a range of historical blocks
+// (both ends included), in chunks of the given size. Each chunk
+// is committed alongside the progress, so an interrupted backfill
+// resumes where it stopped when called again with the same range.
+// Returns when the range is done or the context is cancelled.
+func Backfill(ctx context.Context, dbMap *gorp.DbMap, from, to, chunkSize int64,
+	progress func(*BackfillProgress)) (*BackfillProgress, error) {
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid backfill range %v-%v", from, to)
+	}
+	if chunkSize < 1 {
+		return nil, fmt.Errorf("invalid backfill chunk size %v", chunkSize)
+	}
+
+	if _, err := dbMap.Exec(startBackfillSQLQuery, from, to, time.Now().UnixNano()); err != nil {
+		return nil, err
+	}
+
+	var backfill db.Backfill
+	if err := dbMap.SelectOne(&backfill, backfillSQLQuery, from, to); err != nil {
+		return nil, err
+	}
+
+	state := &BackfillProgress{Backfill: &backfill}
+
+	for backfill.DoneTS == 0 {
+		if err := ctx.Err(); err != nil {
+			return state, err
+		}
+
+		last := backfill.NextNumber + chunkSize - 1
+		if last > backfill.ToNumber {
+			last = backfill.ToNumber
+		}
+
+		enqueued, err := wantBackfillChunk(dbMap, &backfill, last)
+		if err != nil {
+			return state, err
+		}
+
+		state.Enqueued += enqueued
+		state.Skipped += last - backfill.NextNumber + 1 - enqueued
+
+		backfill.NextNumber = last + 1
+		backfill.UpdatedTS = time.Now().UnixNano()
+		if backfill.NextNumber > backfill.ToNumber {
+			backfill.DoneTS = backfill.UpdatedTS
+		}
+
+		if progress != nil {
+			progress(state)
+		}
+	}
+
+	return state, nil
+}
+
+// wantBackfillChunk wants the blocks from the next number of the backfill
+// up to the given one, and stores the progress, all or nothing.
+// Returns how many blocks were wanted.
+func wantBackfillChunk(dbMap *gorp.DbMap, backfill *db.Backfill, last int64) (int64, error) {
+	now := time.Now().UnixNano()
+
+	dbTx, err := dbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := dbTx.Exec(wantBackfillChunkSQLQuery,
+		now,
+		KindBlockBody,
+		backfill.NextNumber,
+		last,
+		KindBlockHeader,
+		PriorityBackfill)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, err
+	}
+
+	enqueued, err := result.RowsAffected()
+	if err != nil {
+		dbTx.Rollback()
+		return 0, err
+	}
+
+	var doneTS int64
+	if last >= backfill.ToNumber {
+		doneTS = now
+	}
+
+	_, err = dbTx.Exec(updateBackfillSQLQuery,
+		backfill.FromNumber,
+		backfill.ToNumber,
+		last+1,
+		now,
+		doneTS)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, err
+	}
+
+	return enqueued, dbTx.Commit()
+}
+
+// Backfill wants a range of historical blocks, see Backfill()
+func (e *EthManager) Backfill(ctx context.Context, from, to, chunkSize int64,
+	progress func(*BackfillProgress)) (*BackfillProgress, error) {
+	return Backfill(ctx, e.dbMap, from, to, chunkSize, progress)
+}
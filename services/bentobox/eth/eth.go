@@ -1,29 +1,238 @@
 package eth
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ethereum/go-ethereum/params"
 	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/lib/devp2p"
 )
 
 const RPC_TIMEOUT = time.Duration(5 * time.Second)
 
+// chainConfigs are the chains we know the rules of, by name
+var chainConfigs = map[string]*params.ChainConfig{
+	"mainnet": params.MainnetChainConfig,
+	"ropsten": params.TestnetChainConfig,
+	"rinkeby": params.RinkebyChainConfig,
+}
+
+// ChainConfigByName returns the rules of the chain of the given name
+func ChainConfigByName(name string) (*params.ChainConfig, error) {
+	chainConfig, ok := chainConfigs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown chain %v", name)
+	}
+
+	return chainConfig, nil
+}
+
+// Config is the configuration object for the EthManager
+type Config struct {
+	// URLs of the ethereum clients JSON RPC
+	EthJsonRPCs []string
+
+	// the rules of the chain they follow, to recover the senders
+	// of the transactions. Defaults to the mainnet ones.
+	ChainConfig *params.ChainConfig
+
+	// URL of a WebSocket JSON RPC to subscribe to the new heads.
+	// When empty, the chain head is polled from the clients above.
+	EthWebSocket string
+
+	// how to decide the chain head out of the clients answers,
+	// see HeadPolicyQuorum and HeadPolicyMedian
+	HeadPolicy string
+
+	// how many clients must agree on a head, under the quorum policy.
+	// Zero means the majority of them.
+	HeadQuorum int
+
+	// seconds between polls of the network height
+	PollInterval int
+
+	// how many requests we can have in flight
+	MaxQueries int
+
+	// how many queries we group in a single JSON RPC batch request
+	BatchSize int
+
+	// how many requests of a kind we can have in flight,
+	// on top of MaxQueries. Kinds not in here are only limited by the latter.
+	KindLimits map[string]int
+
+	// seconds to wait before asking again for a wanted element,
+	// doubled on every attempt up to MaxRetryBackoff seconds
+	RetryBackoff    int
+	MaxRetryBackoff int
+
+	// attempts on a wanted element before giving up on it
+	MaxAttempts int
+
+	// seconds a wanted element waits to gain a point of priority
+	PriorityAging int
+
+	// how many blocks we walk back from a new head,
+	// looking for the common ancestor of a reorg
+	MaxReorgDepth int
+
+	// devp2p node to ask its peers for the wanted elements,
+	// as an alternative to the JSON RPC. Optional.
+	Devp2p *devp2p.Manager
+
+	// the fetcher (FetcherRPC or FetcherDevp2p) each kind is routed to.
+	// Kinds not in here go to the JSON RPC, when it can get them.
+	FetchRoutes map[string]string
+	// slices of the state trie we take from every chain head
+	StateSlices []StateSlice
+
+	// whether we want the call traces of every block we store,
+	// the seconds the tracer can take on a transaction, and the
+	// seconds we wait for the traces of a whole block
+	Traces              bool
+	TraceTimeout        int
+	TraceRequestTimeout int
+}
+
 type EthManager struct {
-	ethJsonRPC     string
-	pollIntervalMS time.Duration
-	maxQueries     int
-	redoQueryTime  int
-	dbMap          *gorp.DbMap
-	qm             *queryManager
+	pool            *rpcPool
+	wsURL           string
+	pollIntervalMS  time.Duration
+	maxQueries      int
+	batchSize       int
+	kindLimits      map[string]int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	maxAttempts     int
+	priorityAging   time.Duration
+	maxReorgDepth   int
+	fetchers        map[string]Fetcher
+	stateSlices     []StateSlice
+	traces          bool
+	dbMap           *gorp.DbMap
+	qm              *queryManager
+
+	// set while the dispatcher must not start new queries
+	paused int32
+
+	// in-flight dispatches, and the context they work with.
+	// The latter is only cancelled when a shutdown can't wait anymore.
+	inFlight   sync.WaitGroup
+	workCtx    context.Context
+	cancelWork context.CancelFunc
 }
 
-func NewManager(ethJsonRPC string, pollInterval, maxQueries, redoQueryTime int, dbMap *gorp.DbMap) *EthManager {
+func NewManager(config *Config, dbMap *gorp.DbMap) *EthManager {
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	if config.PriorityAging < 1 {
+		config.PriorityAging = 1
+	}
+	if config.ChainConfig == nil {
+		config.ChainConfig = params.MainnetChainConfig
+	}
+
+	pool := newRPCPool(config.EthJsonRPCs, config.HeadPolicy, config.HeadQuorum)
+
+	fetchers := map[string]Fetcher{
+		FetcherRPC: newRPCFetcher(pool, dbMap,
+			time.Duration(config.TraceTimeout)*time.Second,
+			time.Duration(config.TraceRequestTimeout)*time.Second),
+	}
+	if config.Devp2p != nil {
+		fetchers[FetcherDevp2p] = &devp2pFetcher{manager: config.Devp2p, dbMap: dbMap, chainConfig: config.ChainConfig}
+	}
+
+	routes, err := newFetchRoutes(config.FetchRoutes, fetchers)
+	if err != nil {
+		log.Fatalf("EthManager: %v", err)
+	}
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+
 	return &EthManager{
-		ethJsonRPC:     ethJsonRPC,
-		pollIntervalMS: time.Duration(pollInterval * 1000),
-		maxQueries:     maxQueries,
-		redoQueryTime:  redoQueryTime,
-		dbMap:          dbMap,
-		qm:             newQueryManager(),
+		pool:            pool,
+		wsURL:           config.EthWebSocket,
+		pollIntervalMS:  time.Duration(config.PollInterval * 1000),
+		maxQueries:      config.MaxQueries,
+		batchSize:       config.BatchSize,
+		kindLimits:      config.KindLimits,
+		retryBackoff:    time.Duration(config.RetryBackoff) * time.Second,
+		maxRetryBackoff: time.Duration(config.MaxRetryBackoff) * time.Second,
+		maxAttempts:     config.MaxAttempts,
+		priorityAging:   time.Duration(config.PriorityAging) * time.Second,
+		maxReorgDepth:   config.MaxReorgDepth,
+		fetchers:        routes,
+		stateSlices:     config.StateSlices,
+		traces:          config.Traces,
+		dbMap:           dbMap,
+		qm:              newQueryManager(),
+		workCtx:         workCtx,
+		cancelWork:      cancelWork,
+	}
+}
+
+// Forget drops what the fetcher of its kind keeps about
+// a wanted element, once it is dead or cancelled
+func (e *EthManager) Forget(kind, key string) {
+	if fetcher, ok := e.fetchers[kind]; ok {
+		fetcher.Forget(kind, key)
+	}
+}
+
+// Pause stops the dispatcher from starting new queries,
+// the in-flight ones finish anyway
+func (e *EthManager) Pause() {
+	atomic.StoreInt32(&e.paused, 1)
+	log.Printf("EthManager: dispatcher paused")
+}
+
+// Resume lets the dispatcher start new queries again
+func (e *EthManager) Resume() {
+	atomic.StoreInt32(&e.paused, 0)
+	log.Printf("EthManager: dispatcher resumed")
+}
+
+// Paused tells whether the dispatcher is paused
+func (e *EthManager) Paused() bool {
+	return atomic.LoadInt32(&e.paused) == 1
+}
+
+// Shutdown waits for the in-flight dispatches to finish.
+// Must be called once the loops have returned, so no new dispatches
+// are started. Dispatches still running after the timeout are cancelled,
+// and they release the rows they claimed.
+func (e *EthManager) Shutdown(timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		e.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Printf("EthManager: all in-flight dispatches finished")
+	case <-time.After(timeout):
+		log.Printf("EthManager: shutdown timeout reached, cancelling in-flight dispatches")
+		e.cancelWork()
+		<-drained
+	}
+}
+
+// sleep waits for the given duration, unless the context is done first.
+// Returns false in the latter case, so loops know they must return.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
 	}
 }
@@ -0,0 +1,81 @@
+package eth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+)
+
+// Names of the fetchers, to route the kinds to
+const (
+	// FetcherRPC queries the ethereum clients JSON RPC
+	FetcherRPC = "rpc"
+	// FetcherDevp2p asks the peers of the devp2p network
+	FetcherDevp2p = "devp2p"
+)
+
+// Fetcher gets the values of the wanted elements from the ethereum network
+type Fetcher interface {
+	// Fetch returns the values of a batch of wanted elements, and their
+	// errors, in the order of the batch. Values come in the format of the
+	// JSON RPC result of their kind, see processEthData().
+	Fetch(ctx context.Context, batch []*db.WantFromDevp2p) ([]string, []error)
+
+	// Kinds are the kinds of wanted elements this fetcher can get
+	Kinds() []string
+
+	// Forget drops whatever the fetcher keeps about a wanted
+	// element, once we gave up on it
+	Forget(kind, key string)
+}
+
+// fetcherPreference is the order we pick the fetcher of the kinds
+// without a route in
+var fetcherPreference = []string{FetcherRPC, FetcherDevp2p}
+
+// newFetchRoutes maps every kind to the fetcher it is routed to.
+// Kinds without a route go to the first fetcher able to get them,
+// see fetcherPreference. Kinds no fetcher can get are left out,
+// so they aren't dispatched.
+func newFetchRoutes(routes map[string]string, fetchers map[string]Fetcher) (map[string]Fetcher, error) {
+	byKind := make(map[string]Fetcher)
+
+	for kind, name := range routes {
+		fetcher, ok := fetchers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown fetcher %v for kind %v", name, kind)
+		}
+		if !containsKind(fetcher.Kinds(), kind) {
+			return nil, fmt.Errorf("fetcher %v can't get kind %v", name, kind)
+		}
+
+		byKind[kind] = fetcher
+	}
+
+	for _, name := range fetcherPreference {
+		fetcher, ok := fetchers[name]
+		if !ok {
+			continue
+		}
+
+		for _, kind := range fetcher.Kinds() {
+			if _, ok := byKind[kind]; !ok {
+				byKind[kind] = fetcher
+			}
+		}
+	}
+
+	return byKind, nil
+}
+
+// containsKind tells whether the kind is in the list
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,642 @@
+package eth
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+	"github.com/metamask/mustekala/services/lib/devp2p"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+//   - The canonical block a transaction belongs to,
+//     as registered when we stored the block
+const txBlockSQLQuery = `
+SELECT block_id
+FROM blocktx
+WHERE
+	tx_id = $1
+	AND
+	orphaned = false
+LIMIT 1;
+`
+
+// storedHeaderSQLQuery gets the RLP of a block header we already stored
+const storedHeaderSQLQuery = `
+SELECT value
+FROM ethdata
+WHERE
+	kind = 'block_header'
+	AND
+	hash = $1;
+`
+
+// errNoPeer is returned when there is no devp2p peer to ask
+var errNoPeer = errors.New("no devp2p peer available")
+
+// errNotReturned is returned for the elements a devp2p peer left out
+var errNotReturned = errors.New("devp2p peer did not return it")
+
+// devp2pFetcher gets the wanted elements from the best peer of
+// the devp2p network. Peers are not trusted with the bodies and receipts,
+// which are checked against the roots of their headers. The headers we
+// ask for by number are taken as they come, though.
+//
+// As peers only know blocks by hash, the transaction receipts and uncles
+// need the header of their block to be stored already (see storeBlock()).
+type devp2pFetcher struct {
+	manager     *devp2p.Manager
+	dbMap       *gorp.DbMap
+	chainConfig *params.ChainConfig
+}
+
+// Kinds implements Fetcher
+func (f *devp2pFetcher) Kinds() []string {
+	return []string{KindBlockBody, KindTxReceipt, KindUncle, KindBlockRLP,
+		KindStateTrie, KindStorageTrie}
+}
+
+// Forget implements Fetcher, there is nothing kept by element
+func (f *devp2pFetcher) Forget(kind, key string) {}
+
+// Fetch gets the data of a batch of wanted elements from the best peer,
+// returning the values and errors in the same order of the batch
+func (f *devp2pFetcher) Fetch(ctx context.Context, batch []*db.WantFromDevp2p) ([]string, []error) {
+	values := make([]string, len(batch))
+	errs := make([]error, len(batch))
+
+	peer := f.manager.BestPeer()
+	if peer == nil {
+		for i := range batch {
+			errs[i] = errNoPeer
+		}
+		return values, errs
+	}
+
+	// positions in the batch, by kind
+	byKind := make(map[string][]int)
+	for i, wantedItem := range batch {
+		byKind[wantedItem.Kind] = append(byKind[wantedItem.Kind], i)
+	}
+
+	for kind, positions := range byKind {
+		keys := make([]string, len(positions))
+		for i, pos := range positions {
+			keys[i] = batch[pos].Key
+		}
+
+		var kindValues []string
+		var kindErrs []error
+
+		switch kind {
+		case KindBlockBody, KindBlockRLP:
+			kindValues, kindErrs = f.fetchBlocks(ctx, peer, kind, keys)
+		case KindUncle:
+			kindValues, kindErrs = f.fetchUncles(ctx, peer, keys)
+		case KindTxReceipt:
+			kindValues, kindErrs = f.fetchReceipts(ctx, peer, keys)
+		case KindStateTrie, KindStorageTrie:
+			kindValues, kindErrs = f.fetchNodeData(ctx, peer, keys)
+		default:
+			kindValues = make([]string, len(keys))
+			kindErrs = make([]error, len(keys))
+			for i := range keys {
+				kindErrs[i] = &UnknownKindError{Kind: kind}
+			}
+		}
+
+		for i, pos := range positions {
+			values[pos], errs[pos] = kindValues[i], kindErrs[i]
+		}
+	}
+
+	return values, errs
+}
+
+// fetchBlocks gets the blocks with the given numbers: first their headers,
+// in runs of consecutive numbers, then their bodies.
+// Values are built as the ones of eth_getBlockByNumber (block_body)
+// or debug_getBlockRlp (block_rlp).
+func (f *devp2pFetcher) fetchBlocks(ctx context.Context, peer *devp2p.Peer,
+	kind string, keys []string) ([]string, []error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	numbers := []uint64{}
+	for i, key := range keys {
+		number, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			errs[i] = fmt.Errorf("invalid block number %v: %v", key, err)
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+
+	headers := make(map[uint64]*types.Header)
+	headerErrs := make(map[uint64]error)
+	for _, run := range consecutiveRuns(numbers, devp2p.MaxFetchItems) {
+		runHeaders, err := peer.FetchHeadersByNumber(ctx, run[0], len(run))
+		if err != nil {
+			for _, number := range run {
+				headerErrs[number] = err
+			}
+			continue
+		}
+
+		for _, header := range runHeaders {
+			headers[header.Number.Uint64()] = header
+		}
+	}
+
+	byHash := make(map[common.Hash]*types.Header)
+	hashes := []common.Hash{}
+	for _, header := range headers {
+		byHash[header.Hash()] = header
+		hashes = append(hashes, header.Hash())
+	}
+	bodies, bodyErrs := f.blockBodies(ctx, peer, hashes, byHash)
+
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+
+		number, _ := strconv.ParseUint(key, 10, 64)
+		header, ok := headers[number]
+		if !ok {
+			errs[i] = headerErrs[number]
+			if errs[i] == nil {
+				errs[i] = errNotReturned
+			}
+			continue
+		}
+
+		body, ok := bodies[header.Hash()]
+		if !ok {
+			errs[i] = bodyErrs[header.Hash()]
+			continue
+		}
+
+		if kind == KindBlockRLP {
+			values[i], errs[i] = blockRLPValue(header, body)
+		} else {
+			values[i], errs[i] = blockBodyValue(header, body)
+		}
+	}
+
+	return values, errs
+}
+
+// fetchUncles gets the uncles with the given "<block hash>:<index>" keys,
+// out of the bodies of their blocks.
+// Values are built as the ones of eth_getUncleByBlockHashAndIndex.
+func (f *devp2pFetcher) fetchUncles(ctx context.Context, peer *devp2p.Peer,
+	keys []string) ([]string, []error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	hashes := []common.Hash{}
+	for i, key := range keys {
+		blockHash, _, err := splitUncleKey(key)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		hashes = append(hashes, common.HexToHash(blockHash))
+	}
+
+	headers, headerErrs := f.storedHeaders(hashes)
+	bodies, bodyErrs := f.blockBodies(ctx, peer, hashes, headers)
+
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+
+		blockHashHex, index, _ := splitUncleKey(key)
+		blockHash := common.HexToHash(blockHashHex)
+		if err, ok := headerErrs[blockHash]; ok {
+			errs[i] = err
+			continue
+		}
+
+		body, ok := bodies[blockHash]
+		if !ok {
+			errs[i] = bodyErrs[blockHash]
+			continue
+		}
+
+		if index >= uint64(len(body.Uncles)) {
+			errs[i] = fmt.Errorf("block %v has no uncle %d", blockHashHex, index)
+			continue
+		}
+
+		value, err := json.Marshal(body.Uncles[index])
+		values[i], errs[i] = string(value), err
+	}
+
+	return values, errs
+}
+
+// fetchReceipts gets the receipts of the transactions with the given hashes,
+// along with the bodies of their blocks, to learn their position.
+// Values are built as the ones of eth_getTransactionReceipt.
+func (f *devp2pFetcher) fetchReceipts(ctx context.Context, peer *devp2p.Peer,
+	keys []string) ([]string, []error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	// the block of every transaction
+	txBlocks := make(map[string]common.Hash)
+	seen := make(map[common.Hash]bool)
+	hashes := []common.Hash{}
+	for i, key := range keys {
+		blockID, err := f.dbMap.SelectStr(txBlockSQLQuery, key)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if blockID == "" {
+			errs[i] = fmt.Errorf("block of transaction %v not stored", key)
+			continue
+		}
+
+		blockHash := common.HexToHash(blockID)
+		if !seen[blockHash] {
+			seen[blockHash] = true
+			hashes = append(hashes, blockHash)
+		}
+		txBlocks[key] = blockHash
+	}
+
+	headers, headerErrs := f.storedHeaders(hashes)
+	bodies, bodyErrs := f.blockBodies(ctx, peer, hashes, headers)
+
+	// receipts of the blocks we know the body of
+	receipts := make(map[common.Hash]types.Receipts)
+	receiptErrs := make(map[common.Hash]error)
+	bodyHashes := []common.Hash{}
+	for _, blockHash := range hashes {
+		if _, ok := bodies[blockHash]; ok {
+			bodyHashes = append(bodyHashes, blockHash)
+		}
+	}
+	for _, chunk := range hashChunks(bodyHashes, devp2p.MaxFetchItems) {
+		chunkReceipts, err := peer.FetchReceipts(ctx, chunk)
+		for j, blockHash := range chunk {
+			switch {
+			case err != nil:
+				receiptErrs[blockHash] = err
+			case j >= len(chunkReceipts):
+				receiptErrs[blockHash] = errNotReturned
+			case types.DeriveSha(chunkReceipts[j]) != headers[blockHash].ReceiptHash:
+				receiptErrs[blockHash] = fmt.Errorf("receipts of block %v don't match its root", blockHash.Hex())
+				metrics.IntegrityFailures.WithLabelValues(FetcherDevp2p, KindTxReceipt).Inc()
+			default:
+				receipts[blockHash] = chunkReceipts[j]
+			}
+		}
+	}
+
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+
+		blockHash := txBlocks[key]
+		if err, ok := headerErrs[blockHash]; ok {
+			errs[i] = err
+			continue
+		}
+		body, ok := bodies[blockHash]
+		if !ok {
+			errs[i] = bodyErrs[blockHash]
+			continue
+		}
+		blockReceipts, ok := receipts[blockHash]
+		if !ok {
+			errs[i] = receiptErrs[blockHash]
+			continue
+		}
+
+		values[i], errs[i] = ReceiptValue(f.chainConfig, headers[blockHash], body, blockReceipts, common.HexToHash(key))
+	}
+
+	return values, errs
+}
+
+// fetchNodeData gets the trie nodes with the given hashes.
+// Values are the JSON string of their hex RLP.
+func (f *devp2pFetcher) fetchNodeData(ctx context.Context, peer *devp2p.Peer,
+	keys []string) ([]string, []error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	hashes := make([]common.Hash, len(keys))
+	for i, key := range keys {
+		hashes[i] = common.HexToHash(key)
+	}
+
+	// peers may leave out any of them, so we match them by hash
+	nodes := make(map[common.Hash][]byte)
+	nodeErrs := make(map[common.Hash]error)
+	for _, chunk := range hashChunks(hashes, devp2p.MaxFetchItems) {
+		data, err := peer.FetchNodeData(ctx, chunk)
+		if err != nil {
+			for _, hash := range chunk {
+				nodeErrs[hash] = err
+			}
+			continue
+		}
+
+		for _, node := range data {
+			nodes[crypto.Keccak256Hash(node)] = node
+		}
+	}
+
+	for i, hash := range hashes {
+		node, ok := nodes[hash]
+		if !ok {
+			errs[i] = nodeErrs[hash]
+			if errs[i] == nil {
+				errs[i] = errNotReturned
+			}
+			continue
+		}
+
+		value, err := json.Marshal(hexutil.Bytes(node))
+		values[i], errs[i] = string(value), err
+	}
+
+	return values, errs
+}
+
+// blockBodies gets the bodies of the blocks with the given hashes,
+// checking them against their headers. Blocks without a header are
+// left out. Returns the bodies, and the errors of the ones we couldn't
+// get, by hash.
+func (f *devp2pFetcher) blockBodies(ctx context.Context, peer *devp2p.Peer,
+	hashes []common.Hash, headers map[common.Hash]*types.Header) (map[common.Hash]*types.Body, map[common.Hash]error) {
+	bodies := make(map[common.Hash]*types.Body)
+	errs := make(map[common.Hash]error)
+
+	// no need to ask twice for the same block
+	unique := []common.Hash{}
+	seen := make(map[common.Hash]bool)
+	for _, hash := range hashes {
+		if _, ok := headers[hash]; !ok {
+			// there is no header to check it against
+			continue
+		}
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+
+	for _, chunk := range hashChunks(unique, devp2p.MaxFetchItems) {
+		chunkBodies, err := peer.FetchBlockBodies(ctx, chunk)
+		for j, hash := range chunk {
+			switch {
+			case err != nil:
+				errs[hash] = err
+			case j >= len(chunkBodies):
+				errs[hash] = errNotReturned
+			default:
+				bodies[hash] = chunkBodies[j]
+			}
+		}
+	}
+
+	// a body is only good for the header it was asked for
+	// if it matches the roots of the latter
+	for hash, body := range bodies {
+		if err := checkBody(headers[hash], body); err != nil {
+			delete(bodies, hash)
+			errs[hash] = err
+			metrics.IntegrityFailures.WithLabelValues(FetcherDevp2p, KindBlockBody).Inc()
+		}
+	}
+
+	return bodies, errs
+}
+
+// storedHeaders loads the headers of the blocks with the given hashes
+// from the "ethdata" table. Returns the headers, and the errors of the
+// ones we couldn't load, by hash.
+func (f *devp2pFetcher) storedHeaders(hashes []common.Hash) (map[common.Hash]*types.Header, map[common.Hash]error) {
+	headers := make(map[common.Hash]*types.Header)
+	errs := make(map[common.Hash]error)
+
+	for _, hash := range hashes {
+		if _, ok := headers[hash]; ok {
+			continue
+		}
+		if _, ok := errs[hash]; ok {
+			continue
+		}
+
+		header, err := storedHeader(f.dbMap, hash)
+		if err != nil {
+			errs[hash] = err
+			continue
+		}
+
+		headers[hash] = header
+	}
+
+	return headers, errs
+}
+
+// storedHeader loads the header of the block with the given hash
+// from the "ethdata" table, failing when not stored (or pruned)
+func storedHeader(dbMap *gorp.DbMap, hash common.Hash) (*types.Header, error) {
+	value, err := dbMap.SelectStr(storedHeaderSQLQuery, hash.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, fmt.Errorf("header of block %v not stored (or pruned)", hash.Hex())
+	}
+
+	headerRLP, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stored header %v: %v", hash.Hex(), err)
+	}
+
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(headerRLP, header); err != nil {
+		return nil, fmt.Errorf("invalid stored header %v: %v", hash.Hex(), err)
+	}
+
+	return header, nil
+}
+
+// checkBody tells whether the transactions and uncles of a body
+// are the ones of the given header
+func checkBody(header *types.Header, body *types.Body) error {
+	if types.DeriveSha(types.Transactions(body.Transactions)) != header.TxHash {
+		return fmt.Errorf("transactions of block %v don't match its root", header.Hash().Hex())
+	}
+	if types.CalcUncleHash(body.Uncles) != header.UncleHash {
+		return fmt.Errorf("uncles of block %v don't match its hash", header.Hash().Hex())
+	}
+
+	return nil
+}
+
+// blockBodyValue builds the JSON of a block with its full transactions,
+// and the hashes of its uncles, as eth_getBlockByNumber does
+func blockBodyValue(header *types.Header, body *types.Body) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	block := make(map[string]interface{})
+	if err := json.Unmarshal(headerJSON, &block); err != nil {
+		return "", err
+	}
+
+	uncles := make([]common.Hash, len(body.Uncles))
+	for i, uncle := range body.Uncles {
+		uncles[i] = uncle.Hash()
+	}
+
+	block["transactions"] = body.Transactions
+	block["uncles"] = uncles
+
+	value, err := json.Marshal(block)
+	return string(value), err
+}
+
+// blockRLPValue builds the JSON string of the hex RLP of a block,
+// as debug_getBlockRlp does
+func blockRLPValue(header *types.Header, body *types.Body) (string, error) {
+	block := types.NewBlockWithHeader(header).WithBody(body.Transactions, body.Uncles)
+
+	blockRLP, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(hexutil.Bytes(blockRLP))
+	return string(value), err
+}
+
+// ReceiptValue builds the JSON of the receipt of a transaction,
+// as eth_getTransactionReceipt does, filling in the fields
+// that are not part of the consensus encoding. The receipts
+// are the ones of every transaction of the block, in order, and
+// the chain config gives the rules to recover the sender with.
+func ReceiptValue(chainConfig *params.ChainConfig, header *types.Header, body *types.Body,
+	receipts types.Receipts, txHash common.Hash) (string, error) {
+	if len(receipts) != len(body.Transactions) {
+		return "", fmt.Errorf("block %v has %d transactions but %d receipts",
+			header.Hash().Hex(), len(body.Transactions), len(receipts))
+	}
+
+	var prevGasUsed uint64
+	logIndex := uint(0)
+
+	for i, tx := range body.Transactions {
+		receipt := receipts[i]
+		if tx.Hash() != txHash {
+			prevGasUsed = receipt.CumulativeGasUsed
+			logIndex += uint(len(receipt.Logs))
+			continue
+		}
+
+		receipt.TxHash = txHash
+		receipt.GasUsed = receipt.CumulativeGasUsed - prevGasUsed
+
+		if tx.To() == nil {
+			signer := types.MakeSigner(chainConfig, header.Number)
+			from, err := types.Sender(signer, tx)
+			if err != nil {
+				return "", err
+			}
+			receipt.ContractAddress = crypto.CreateAddress(from, tx.Nonce())
+		}
+
+		for _, l := range receipt.Logs {
+			l.BlockNumber = header.Number.Uint64()
+			l.BlockHash = header.Hash()
+			l.TxHash = txHash
+			l.TxIndex = uint(i)
+			l.Index = logIndex
+			logIndex++
+		}
+
+		receiptJSON, err := json.Marshal(receipt)
+		if err != nil {
+			return "", err
+		}
+
+		// along with the fields of its block
+		value := make(map[string]interface{})
+		if err := json.Unmarshal(receiptJSON, &value); err != nil {
+			return "", err
+		}
+		value["blockNumber"] = (*hexutil.Big)(header.Number)
+		value["blockHash"] = header.Hash()
+		value["transactionIndex"] = hexutil.Uint(i)
+
+		receiptJSON, err = json.Marshal(value)
+		return string(receiptJSON), err
+	}
+
+	return "", fmt.Errorf("transaction %v not in block %v", txHash.Hex(), header.Hash().Hex())
+}
+
+// consecutiveRuns splits the numbers into sorted runs of consecutive
+// numbers, of the given size at most
+func consecutiveRuns(numbers []uint64, size int) [][]uint64 {
+	sorted := append([]uint64{}, numbers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	runs := [][]uint64{}
+	for _, number := range sorted {
+		last := len(runs) - 1
+		switch {
+		case last >= 0 && runs[last][len(runs[last])-1] == number:
+			// repeated
+		case last >= 0 && runs[last][len(runs[last])-1] == number-1 && len(runs[last]) < size:
+			runs[last] = append(runs[last], number)
+		default:
+			runs = append(runs, []uint64{number})
+		}
+	}
+
+	return runs
+}
+
+// hashChunks splits the hashes into chunks of the given size at most
+func hashChunks(hashes []common.Hash, size int) [][]common.Hash {
+	chunks := [][]common.Hash{}
+	for len(hashes) > 0 {
+		n := size
+		if n > len(hashes) {
+			n = len(hashes)
+		}
+		chunks = append(chunks, hashes[:n])
+		hashes = hashes[n:]
+	}
+
+	return chunks
+}
@@ -0,0 +1,588 @@
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// MAX_VERIFIED_BLOCKS caps the blocks whose receipts (and uncles) we keep
+// as checked, so the rest of them don't need the whole block again
+const MAX_VERIFIED_BLOCKS = 256
+
+// MAX_DISTRUSTED_ELEMENTS caps the elements whose bad upstreams we keep,
+// should some be given up on by other instances
+const MAX_DISTRUSTED_ELEMENTS = 4096
+
+// rpcFetcher gets the wanted elements from the ethereum clients JSON RPC,
+// grouped in batch requests. What an upstream answers is checked against
+// the hashes it must match before we store it (see verify.go). When it
+// doesn't, the element fails, and is asked to another upstream next time.
+type rpcFetcher struct {
+	pool  *rpcPool
+	dbMap *gorp.DbMap
+
+	// how long the tracer can take on a transaction,
+	// and how long we wait for the traces of a block
+	traceTimeout        time.Duration
+	traceRequestTimeout time.Duration
+
+	lock sync.Mutex
+	// the upstreams that gave us bad data, by wanted element
+	distrusted map[string]map[string]bool
+	// the hashes of the receipts of the blocks already checked,
+	// by block and transaction
+	verifiedReceipts map[common.Hash]map[common.Hash]common.Hash
+	// the hashes of the uncles of the blocks already checked, in order
+	verifiedUncles map[common.Hash][]common.Hash
+}
+
+// newRPCFetcher sets up the fetcher over the pool of upstreams
+func newRPCFetcher(pool *rpcPool, dbMap *gorp.DbMap, traceTimeout, traceRequestTimeout time.Duration) *rpcFetcher {
+	return &rpcFetcher{
+		pool:                pool,
+		dbMap:               dbMap,
+		traceTimeout:        traceTimeout,
+		traceRequestTimeout: traceRequestTimeout,
+		distrusted:          make(map[string]map[string]bool),
+		verifiedReceipts:    make(map[common.Hash]map[common.Hash]common.Hash),
+		verifiedUncles:      make(map[common.Hash][]common.Hash),
+	}
+}
+
+// Kinds implements Fetcher
+func (f *rpcFetcher) Kinds() []string {
+	return []string{KindBlockBody, KindTxReceipt, KindUncle, KindBlockRLP,
+		KindStateSlice, KindStateTrie, KindStorageTrie, KindTrace}
+}
+
+// Fetch gets the data of a batch of wanted elements from the ethereum
+// clients, returning the values and errors in the same order of the batch.
+// A batch of one is sent as a plain request.
+func (f *rpcFetcher) Fetch(ctx context.Context, batch []*db.WantFromDevp2p) ([]string, []error) {
+	values := make([]string, len(batch))
+	errs := make([]error, len(batch))
+
+	// elements we could build a query for, by position in the batch
+	queries := []*rpcQuery{}
+	positions := []int{}
+	for i, wantedItem := range batch {
+		query, err := f.wantedQuery(wantedItem.Kind, wantedItem.Key)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		queries = append(queries, query)
+		positions = append(positions, i)
+	}
+
+	avoid := f.distrustedBy(batch)
+
+	var u *upstream
+	switch len(queries) {
+	case 0:
+		// nothing to do here
+
+	case 1:
+		values[positions[0]], u, errs[positions[0]] = f.pool.rawQuery(ctx, queries[0], avoid)
+
+	default:
+		var batchValues []string
+		var batchErrs []error
+		var err error
+
+		batchValues, batchErrs, u, err = f.pool.rawBatchQuery(ctx, queries, avoid)
+		for i, pos := range positions {
+			if err != nil {
+				errs[pos] = err
+				continue
+			}
+			values[pos], errs[pos] = batchValues[i], batchErrs[i]
+		}
+	}
+
+	if u != nil {
+		f.verify(ctx, u, batch, values, errs)
+	}
+
+	return values, errs
+}
+
+// verify checks the values the upstream gave us, failing the ones
+// not matching their hashes with an IntegrityError
+func (f *rpcFetcher) verify(ctx context.Context, u *upstream, batch []*db.WantFromDevp2p,
+	values []string, errs []error) {
+	receipts := []int{}
+
+	for i, wantedItem := range batch {
+		if errs[i] != nil {
+			continue
+		}
+
+		if wantedItem.Kind == KindTxReceipt {
+			receipts = append(receipts, i)
+			continue
+		}
+
+		if err := verifyValue(wantedItem.Kind, wantedItem.Key, values[i]); err != nil {
+			f.reject(u, wantedItem, err, values, errs, i)
+			continue
+		}
+
+		switch err := f.verifyUncles(ctx, u, wantedItem.Kind, wantedItem.Key, values[i]).(type) {
+		case nil:
+		case *IntegrityError:
+			f.reject(u, wantedItem, err, values, errs, i)
+			continue
+		default:
+			errs[i] = err
+			continue
+		}
+
+		f.trust(wantedItem)
+	}
+
+	f.verifyReceipts(ctx, u, batch, receipts, values, errs)
+}
+
+// verifyReceipts checks the receipts at the given positions of the batch.
+// A receipt can only be checked along with the rest of its block, so we
+// ask the same upstream for the block and its missing receipts, and
+// rebuild the trie of the receipts to compare it against its root.
+func (f *rpcFetcher) verifyReceipts(ctx context.Context, u *upstream, batch []*db.WantFromDevp2p,
+	positions []int, values []string, errs []error) {
+	receipts := make(map[int]*types.Receipt)
+	byBlock := make(map[common.Hash][]int)
+
+	for _, i := range positions {
+		receipt := new(types.Receipt)
+		if err := json.Unmarshal([]byte(values[i]), receipt); err != nil {
+			f.reject(u, batch[i], fmt.Errorf("invalid tx receipt: %v", err), values, errs, i)
+			continue
+		}
+
+		txHash := common.HexToHash(batch[i].Key)
+		if receipt.TxHash != txHash {
+			f.reject(u, batch[i], fmt.Errorf("receipt of tx %v, expected %v",
+				receipt.TxHash.Hex(), txHash.Hex()), values, errs, i)
+			continue
+		}
+
+		// the block we stored the transaction in, not the one
+		// the receipt says, which we don't trust yet
+		blockHash, err := f.dbMap.SelectStr(txBlockSQLQuery, txHash.Hex())
+		if err != nil {
+			metrics.DBError("tx_block", err)
+			errs[i] = err
+			continue
+		}
+		if blockHash == "" {
+			errs[i] = fmt.Errorf("block of tx %v not stored", txHash.Hex())
+			continue
+		}
+
+		receiptBlock := rpcReceiptBlock{}
+		if err := json.Unmarshal([]byte(values[i]), &receiptBlock); err != nil {
+			f.reject(u, batch[i], fmt.Errorf("invalid tx receipt: %v", err), values, errs, i)
+			continue
+		}
+		if receiptBlock.BlockHash != common.HexToHash(blockHash) {
+			// the upstream may see another chain, let's ask later
+			errs[i] = fmt.Errorf("receipt of tx %v in block %v, we stored it in %v",
+				txHash.Hex(), receiptBlock.BlockHash.Hex(), blockHash)
+			continue
+		}
+
+		receipts[i] = receipt
+		byBlock[receiptBlock.BlockHash] = append(byBlock[receiptBlock.BlockHash], i)
+	}
+
+	for blockHash, blockPositions := range byBlock {
+		known := make(map[common.Hash]*types.Receipt)
+		for _, i := range blockPositions {
+			known[receipts[i].TxHash] = receipts[i]
+		}
+
+		verified, err := f.blockReceipts(ctx, u, blockHash, known)
+
+		for _, i := range blockPositions {
+			switch err.(type) {
+			case nil:
+			case *IntegrityError:
+				f.reject(u, batch[i], err, values, errs, i)
+				continue
+			default:
+				errs[i] = err
+				continue
+			}
+
+			receiptHash, err := consensusHash(receipts[i])
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if verified[receipts[i].TxHash] != receiptHash {
+				f.reject(u, batch[i], fmt.Errorf("receipt of tx %v doesn't match the root of its block",
+					receipts[i].TxHash.Hex()), values, errs, i)
+				continue
+			}
+
+			f.trust(batch[i])
+		}
+	}
+}
+
+// blockReceipts returns the hashes of the receipts of a block, by
+// transaction, once checked against the root of its receipts.
+// The block and the receipts not known yet are asked to the upstream.
+// Returns an IntegrityError when the upstream gives us bad data.
+func (f *rpcFetcher) blockReceipts(ctx context.Context, u *upstream, blockHash common.Hash,
+	known map[common.Hash]*types.Receipt) (map[common.Hash]common.Hash, error) {
+	f.lock.Lock()
+	verified, ok := f.verifiedReceipts[blockHash]
+	f.lock.Unlock()
+	if ok {
+		return verified, nil
+	}
+
+	integrityError := func(err error) error {
+		return &IntegrityError{Upstream: upstreamLabel(u.url), Reason: err.Error()}
+	}
+
+	// the order of the transactions, out of the block itself
+	value, err := rawQueryAt(ctx, u.url, newRPCQuery("eth_getBlockByHash", blockHash.Hex(), true))
+	if err != nil {
+		return nil, err
+	}
+	header, txs, err := verifyBlockBody(value)
+	if err != nil {
+		return nil, integrityError(err)
+	}
+	if header.Hash() != blockHash {
+		return nil, integrityError(fmt.Errorf("block %v, expected %v", header.Hash().Hex(), blockHash.Hex()))
+	}
+
+	missing := []*rpcQuery{}
+	for _, tx := range txs {
+		if _, ok := known[tx.Hash()]; !ok {
+			missing = append(missing, newRPCQuery("eth_getTransactionReceipt", tx.Hash().Hex()))
+		}
+	}
+	if len(missing) > 0 {
+		missingValues, missingErrs, err := rawBatchQueryAt(ctx, u.url, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := range missing {
+			if missingErrs[j] != nil {
+				return nil, missingErrs[j]
+			}
+
+			receipt := new(types.Receipt)
+			if err := json.Unmarshal([]byte(missingValues[j]), receipt); err != nil {
+				return nil, integrityError(fmt.Errorf("invalid tx receipt: %v", err))
+			}
+			known[receipt.TxHash] = receipt
+		}
+	}
+
+	receipts := make(types.Receipts, len(txs))
+	verified = make(map[common.Hash]common.Hash)
+	for j, tx := range txs {
+		receipt, ok := known[tx.Hash()]
+		if !ok {
+			return nil, integrityError(fmt.Errorf("receipt of tx %v not given", tx.Hash().Hex()))
+		}
+		receipts[j] = receipt
+
+		verified[tx.Hash()], err = consensusHash(receipt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := verifyReceiptsRoot(header, receipts); err != nil {
+		return nil, integrityError(err)
+	}
+
+	f.lock.Lock()
+	if len(f.verifiedReceipts) >= MAX_VERIFIED_BLOCKS {
+		f.verifiedReceipts = make(map[common.Hash]map[common.Hash]common.Hash)
+	}
+	f.verifiedReceipts[blockHash] = verified
+	f.lock.Unlock()
+
+	return verified, nil
+}
+
+// verifyUncles checks the uncles of a block body, which come as hashes
+// only, and the uncles themselves, against the uncle hash of their block
+// (see blockUncles()). The uncles are checked against the header of their
+// block we stored, unless it was pruned. The rest of the kinds have no
+// uncles to check. Returns an IntegrityError when the upstream gives us bad data.
+func (f *rpcFetcher) verifyUncles(ctx context.Context, u *upstream, kind, key, value string) error {
+	switch kind {
+	case KindBlockBody:
+		header := new(types.Header)
+		if err := json.Unmarshal([]byte(value), header); err != nil {
+			return fmt.Errorf("invalid block header: %v", err)
+		}
+		body := rpcBlockUncles{}
+		if err := json.Unmarshal([]byte(value), &body); err != nil {
+			return fmt.Errorf("invalid block body: %v", err)
+		}
+		if len(body.Uncles) == 0 {
+			// checked against the empty uncle hash already
+			return nil
+		}
+
+		verified, err := f.blockUncles(ctx, u, header.Hash(), header.UncleHash)
+		if err != nil {
+			return err
+		}
+		if !equalHashes(body.Uncles, verified) {
+			return &IntegrityError{Upstream: upstreamLabel(u.url),
+				Reason: fmt.Sprintf("uncles of block %v don't match its hash", header.Hash().Hex())}
+		}
+
+	case KindUncle:
+		blockHashHex, index, err := splitUncleKey(key)
+		if err != nil {
+			return err
+		}
+		blockHash := common.HexToHash(blockHashHex)
+
+		uncle := new(types.Header)
+		if err := json.Unmarshal([]byte(value), uncle); err != nil {
+			return fmt.Errorf("invalid uncle header: %v", err)
+		}
+
+		// the uncle hash we stored the block with, when we still have it,
+		// otherwise the one of the header the upstream gives us for its hash
+		uncleHash := common.Hash{}
+		if header, err := storedHeader(f.dbMap, blockHash); err == nil {
+			uncleHash = header.UncleHash
+		}
+
+		verified, err := f.blockUncles(ctx, u, blockHash, uncleHash)
+		if err != nil {
+			return err
+		}
+		if index >= uint64(len(verified)) || verified[index] != uncle.Hash() {
+			return &IntegrityError{Upstream: upstreamLabel(u.url),
+				Reason: fmt.Sprintf("uncle %v is not the uncle %d of block %v",
+					uncle.Hash().Hex(), index, blockHash.Hex())}
+		}
+	}
+
+	return nil
+}
+
+// blockUncles returns the hashes of the uncles of a block, in order, once
+// checked against its uncle hash (the one of its header when zero).
+// The block, and all of its uncle headers, are asked to the upstream.
+// Returns an IntegrityError when the upstream gives us bad data.
+func (f *rpcFetcher) blockUncles(ctx context.Context, u *upstream, blockHash,
+	uncleHash common.Hash) ([]common.Hash, error) {
+	f.lock.Lock()
+	verified, ok := f.verifiedUncles[blockHash]
+	f.lock.Unlock()
+	if ok {
+		return verified, nil
+	}
+
+	integrityError := func(err error) error {
+		return &IntegrityError{Upstream: upstreamLabel(u.url), Reason: err.Error()}
+	}
+
+	// the hashes of the uncles, out of the block itself
+	value, err := rawQueryAt(ctx, u.url, newRPCQuery("eth_getBlockByHash", blockHash.Hex(), false))
+	if err != nil {
+		return nil, err
+	}
+	header, err := verifyHeader(value)
+	if err != nil {
+		return nil, integrityError(err)
+	}
+	if header.Hash() != blockHash {
+		return nil, integrityError(fmt.Errorf("block %v, expected %v", header.Hash().Hex(), blockHash.Hex()))
+	}
+	if uncleHash == (common.Hash{}) {
+		uncleHash = header.UncleHash
+	}
+
+	block := rpcBlockUncles{}
+	if err := json.Unmarshal([]byte(value), &block); err != nil {
+		return nil, integrityError(fmt.Errorf("invalid block: %v", err))
+	}
+
+	uncles := []*types.Header{}
+	if len(block.Uncles) > 0 {
+		queries := []*rpcQuery{}
+		for j := range block.Uncles {
+			queries = append(queries, newRPCQuery("eth_getUncleByBlockHashAndIndex",
+				blockHash.Hex(), fmt.Sprintf("0x%x", j)))
+		}
+
+		values, errs, err := rawBatchQueryAt(ctx, u.url, queries)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, expected := range block.Uncles {
+			if errs[j] != nil {
+				return nil, errs[j]
+			}
+
+			uncle, err := verifyHeader(values[j])
+			if err != nil {
+				return nil, integrityError(err)
+			}
+			if uncle.Hash() != expected {
+				return nil, integrityError(fmt.Errorf("uncle %d of block %v is %v, expected %v",
+					j, blockHash.Hex(), uncle.Hash().Hex(), expected.Hex()))
+			}
+			uncles = append(uncles, uncle)
+		}
+	}
+
+	if types.CalcUncleHash(uncles) != uncleHash {
+		return nil, integrityError(fmt.Errorf("uncles of block %v don't match its hash", blockHash.Hex()))
+	}
+
+	f.lock.Lock()
+	if len(f.verifiedUncles) >= MAX_VERIFIED_BLOCKS {
+		f.verifiedUncles = make(map[common.Hash][]common.Hash)
+	}
+	f.verifiedUncles[blockHash] = block.Uncles
+	f.lock.Unlock()
+
+	return block.Uncles, nil
+}
+
+// rpcBlockUncles is the part of a block response with the hashes of its
+// uncles, whether it comes with its full transactions or not
+type rpcBlockUncles struct {
+	Uncles []common.Hash `json:"uncles"`
+}
+
+// equalHashes tells whether two lists have the same hashes, in order
+func equalHashes(a, b []common.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reject fails the element at the given position of the batch,
+// counting it against the upstream, which we won't ask for it again
+// (unless there is no one else to ask)
+func (f *rpcFetcher) reject(u *upstream, wantedItem *db.WantFromDevp2p, reason error,
+	values []string, errs []error, i int) {
+	err, ok := reason.(*IntegrityError)
+	if !ok {
+		err = &IntegrityError{Upstream: upstreamLabel(u.url), Reason: reason.Error()}
+	}
+
+	log.Printf("Rejecting (%v) (%v): %v", wantedItem.Kind, wantedItem.Key, err)
+	metrics.IntegrityFailures.WithLabelValues(upstreamLabel(u.url), wantedItem.Kind).Inc()
+
+	values[i] = ""
+	errs[i] = err
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	id := wantedItem.Kind + ":" + wantedItem.Key
+	if f.distrusted[id] == nil {
+		if len(f.distrusted) >= MAX_DISTRUSTED_ELEMENTS {
+			f.distrusted = make(map[string]map[string]bool)
+		}
+		f.distrusted[id] = make(map[string]bool)
+	}
+	f.distrusted[id][u.url] = true
+}
+
+// trust forgets about the upstreams that gave us bad data for the element,
+// now that we got the good one
+func (f *rpcFetcher) trust(wantedItem *db.WantFromDevp2p) {
+	f.Forget(wantedItem.Kind, wantedItem.Key)
+}
+
+// Forget implements Fetcher, forgetting about the upstreams
+// that gave us bad data for the element
+func (f *rpcFetcher) Forget(kind, key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.distrusted, kind+":"+key)
+}
+
+// distrustedBy returns the upstreams that gave us bad data
+// for any of the elements of the batch
+func (f *rpcFetcher) distrustedBy(batch []*db.WantFromDevp2p) map[string]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	avoid := make(map[string]bool)
+	for _, wantedItem := range batch {
+		for upstreamURL := range f.distrusted[wantedItem.Kind+":"+wantedItem.Key] {
+			avoid[upstreamURL] = true
+		}
+	}
+
+	return avoid
+}
+
+// consensusHash is the hash of the consensus encoding of a receipt,
+// the one we store it with (see processTxReceipt())
+func consensusHash(receipt *types.Receipt) (common.Hash, error) {
+	receiptRLP, err := rlp.EncodeToBytes(receipt)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	return crypto.Keccak256Hash(receiptRLP), nil
+}
+
+// wantedQuery switches by kind to build the query for the ethereum client
+func (f *rpcFetcher) wantedQuery(kind, key string) (*rpcQuery, error) {
+	switch kind {
+	case KindBlockBody:
+		return blockByNumberQuery(key)
+	case KindTxReceipt:
+		return transactionReceiptQuery(key)
+	case KindUncle:
+		return uncleByBlockHashAndIndexQuery(key)
+	case KindBlockRLP:
+		return blockRlpQuery(key)
+	case KindStateSlice:
+		return sliceKeysQuery(key)
+	case KindStateTrie, KindStorageTrie:
+		return levelDbKeyQuery(key)
+	case KindTrace:
+		return traceBlockQuery(key, f.traceTimeout, f.traceRequestTimeout)
+	default:
+		return nil, &UnknownKindError{Kind: kind}
+	}
+}
@@ -0,0 +1,156 @@
+package eth
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// MAX_HEAD_GAP is how many missed heads we fill after a disconnection,
+// older ones are left for a backfill
+const MAX_HEAD_GAP = 256
+
+// WS_MIN_BACKOFF and WS_MAX_BACKOFF bound the wait between reconnections
+const (
+	WS_MIN_BACKOFF = time.Duration(1 * time.Second)
+	WS_MAX_BACKOFF = time.Duration(30 * time.Second)
+)
+
+// HeadLoop follows the chain head. Given a WebSocket endpoint, it
+// subscribes to its new heads, reconnecting when the connection drops
+// and filling the heads missed meanwhile. Without one, or when the
+// endpoint is HTTP only, it falls back to polling with LastBlockLoop.
+// Returns when the context is done.
+func (e *EthManager) HeadLoop(ctx context.Context) {
+	if e.wsURL == "" {
+		e.LastBlockLoop(ctx)
+		return
+	}
+
+	log.Printf("Starting HeadLoop on %v", e.wsURL)
+	defer log.Printf("Stopped HeadLoop")
+
+	last, err := e.lastStoredHead()
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error on SQL query for last block: %v", err)
+		metrics.DBError("last_block", err)
+	}
+
+	backoff := WS_MIN_BACKOFF
+	for {
+		err := e.followHeads(ctx, &last, &backoff)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == rpc.ErrNotificationsUnsupported {
+			log.Printf("%v does not support subscriptions, polling instead", e.wsURL)
+			e.LastBlockLoop(ctx)
+			return
+		}
+
+		log.Printf("Head subscription lost, reconnecting in %v: %v", backoff, err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+
+		backoff *= 2
+		if backoff > WS_MAX_BACKOFF {
+			backoff = WS_MAX_BACKOFF
+		}
+	}
+}
+
+// followHeads subscribes to the new heads of the WebSocket endpoint,
+// and stores every one of them until the subscription fails.
+// The last stored head is kept in last, so we can find the gaps.
+func (e *EthManager) followHeads(ctx context.Context, last **chainHead, backoff *time.Duration) error {
+	dialCtx, cancel := context.WithTimeout(ctx, RPC_TIMEOUT)
+	defer cancel()
+
+	client, err := rpc.DialContext(dialCtx, e.wsURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	heads := make(chan *chainHead, 16)
+	sub, err := client.EthSubscribe(dialCtx, heads, "newHeads")
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	log.Printf("Subscribed to new heads of %v", e.wsURL)
+	*backoff = WS_MIN_BACKOFF
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-sub.Err():
+			return err
+
+		case head := <-heads:
+			if *last != nil && (head.Hash == (*last).Hash ||
+				e.behindHead(head, int64((*last).Number))) {
+				continue
+			}
+
+			e.fillHeadGap(ctx, *last, head)
+			e.storeHead(ctx, head)
+			*last = head
+		}
+	}
+}
+
+// fillHeadGap stores the heads between the last one we stored and
+// the new one, asking for them with eth_getBlockByNumber.
+// Those come after a disconnection, or after a restart.
+func (e *EthManager) fillHeadGap(ctx context.Context, last, head *chainHead) {
+	if last == nil || head.Number <= last.Number+1 {
+		return
+	}
+
+	from := last.Number + 1
+	if head.Number-from > MAX_HEAD_GAP {
+		log.Printf("Missed heads %v to %v, run a backfill for them",
+			from, head.Number-MAX_HEAD_GAP-1)
+		from = head.Number - MAX_HEAD_GAP
+	}
+
+	log.Printf("Filling missed heads %v to %v", from, head.Number-1)
+
+	for number := from; number < head.Number; number++ {
+		missed, err := e.getHeadByNumber(ctx, uint64(number))
+		if err != nil {
+			log.Printf("Error requesting missed head %v: %v", number, err)
+			return
+		}
+
+		e.storeHead(ctx, missed)
+	}
+}
+
+// lastStoredHead returns the last head of the "lastblock" table,
+// nil if there is none
+func (e *EthManager) lastStoredHead() (*chainHead, error) {
+	var lastDbBlock *db.LastBlock
+	err := e.dbMap.SelectOne(&lastDbBlock, lastBlockSQLQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chainHead{
+		Number: hexutil.Uint64(lastDbBlock.NumberId),
+		Hash:   common.HexToHash(lastDbBlock.Hash),
+	}, nil
+}
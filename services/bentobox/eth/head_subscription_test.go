@@ -0,0 +1,289 @@
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+)
+
+// wsHeads is a stand-in for the WebSocket JSON RPC of a client,
+// serving eth_subscribe("newHeads"). Every subscription gets its
+// own channel, sent to subscribed, to push the heads through.
+type wsHeads struct {
+	URL        string
+	subscribed chan chan<- *chainHead
+
+	httpServer *httptest.Server
+
+	lock   sync.Mutex
+	server *rpc.Server
+}
+
+func newWSHeads(t *testing.T) *wsHeads {
+	ws := &wsHeads{subscribed: make(chan chan<- *chainHead, 4)}
+	ws.server = ws.newServer(t)
+	ws.httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.lock.Lock()
+		server := ws.server
+		ws.lock.Unlock()
+
+		server.WebsocketHandler([]string{"*"}).ServeHTTP(w, r)
+	}))
+	ws.URL = "ws" + strings.TrimPrefix(ws.httpServer.URL, "http")
+
+	t.Cleanup(func() {
+		ws.lock.Lock()
+		ws.server.Stop()
+		ws.lock.Unlock()
+		ws.httpServer.Close()
+	})
+
+	return ws
+}
+
+func (ws *wsHeads) newServer(t *testing.T) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &HeadsAPI{subscribed: ws.subscribed}); err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// drop closes the connections, as a client restarting would.
+// The ones coming afterwards are served as usual.
+func (ws *wsHeads) drop(t *testing.T) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	ws.server.Stop()
+	ws.server = ws.newServer(t)
+}
+
+// nextSubscription waits for the next subscription to new heads
+func (ws *wsHeads) nextSubscription(t *testing.T) chan<- *chainHead {
+	select {
+	case heads := <-ws.subscribed:
+		return heads
+	case <-time.After(10 * time.Second):
+		t.Fatal("no subscription to new heads")
+		return nil
+	}
+}
+
+// HeadsAPI is the eth namespace of wsHeads,
+// exported as the rpc package only serves those
+type HeadsAPI struct {
+	subscribed chan chan<- *chainHead
+}
+
+// NewHeads is eth_subscribe("newHeads")
+func (s *HeadsAPI) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	sub := notifier.CreateSubscription()
+	heads := make(chan *chainHead)
+
+	go func() {
+		// the subscription is only active once its id is answered
+		time.Sleep(100 * time.Millisecond)
+		s.subscribed <- heads
+
+		for {
+			select {
+			case head := <-heads:
+				notifier.Notify(sub.ID, head)
+			case <-sub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+// testHead is the head at the given height of the chain the tests follow
+func testHead(number uint64) *chainHead {
+	return &chainHead{
+		Number:     hexutil.Uint64(number),
+		Hash:       common.BigToHash(new(big.Int).SetUint64(number + 1000)),
+		ParentHash: common.BigToHash(new(big.Int).SetUint64(number + 999)),
+	}
+}
+
+// respondHeads answers eth_getBlockByNumber with the heads of the test chain,
+// "latest" being the given one
+func respondHeads(rpcServer *fakerpc.Server, latest uint64) {
+	rpcServer.Handle("eth_getBlockByNumber", func(params []json.RawMessage) (interface{}, *fakerpc.Error) {
+		var tag string
+		if json.Unmarshal(params[0], &tag) == nil && tag == "latest" {
+			return testHead(latest), nil
+		}
+
+		var number hexutil.Uint64
+		if err := json.Unmarshal(params[0], &number); err != nil {
+			return nil, &fakerpc.Error{Code: -32602, Message: err.Error()}
+		}
+
+		return testHead(uint64(number)), nil
+	})
+}
+
+// storedHeads returns the numbers of the heads stored so far, in order
+func storedHeads(fake *fakedb.DB) []int64 {
+	numbers := []int64{}
+	for _, statement := range fake.Executed("INSERT INTO lastblock") {
+		numbers = append(numbers, statement.Args[1].(int64))
+	}
+
+	return numbers
+}
+
+// waitStoredHeads waits until the given number of heads is stored
+func waitStoredHeads(t *testing.T, fake *fakedb.DB, count int) []int64 {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if numbers := storedHeads(fake); len(numbers) >= count {
+			return numbers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("got heads %v stored, expected %v of them", storedHeads(fake), count)
+	return nil
+}
+
+func newTestManager(rpcServer *fakerpc.Server, wsURL string, fake *fakedb.DB) *EthManager {
+	return NewManager(&Config{
+		EthJsonRPCs:   []string{rpcServer.URL},
+		EthWebSocket:  wsURL,
+		PollInterval:  1,
+		MaxQueries:    1,
+		MaxReorgDepth: 10,
+	}, fake.DbMap)
+}
+
+func TestHeadLoopReconnects(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	respondHeads(rpcServer, 8)
+	ws := newWSHeads(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestManager(rpcServer, ws.URL, fake).HeadLoop(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	heads := ws.nextSubscription(t)
+	heads <- testHead(5)
+	waitStoredHeads(t, fake, 1)
+
+	// heads 6 and 7 come while disconnected
+	ws.drop(t)
+	heads = ws.nextSubscription(t)
+	heads <- testHead(8)
+
+	numbers := waitStoredHeads(t, fake, 4)
+	if fmt.Sprint(numbers) != "[5 6 7 8]" {
+		t.Errorf("got heads %v stored, expected [5 6 7 8]", numbers)
+	}
+
+	// the missed ones are asked by number, the rest come with the subscription
+	asked := []string{}
+	for _, call := range rpcServer.Calls() {
+		if call.Method == "eth_getBlockByNumber" {
+			asked = append(asked, string(call.Params[0]))
+		}
+	}
+	if fmt.Sprint(asked) != `["0x6" "0x7"]` {
+		t.Errorf("asked for heads %v, expected 6 and 7", asked)
+	}
+}
+
+func TestFillHeadGap(t *testing.T) {
+	tests := []struct {
+		last, head uint64
+		filled     []int64
+	}{
+		{last: 10, head: 11, filled: []int64{}},
+		{last: 10, head: 9, filled: []int64{}},
+		{last: 10, head: 14, filled: []int64{11, 12, 13}},
+		// only the last MAX_HEAD_GAP ones, the rest are left to a backfill
+		{last: 10, head: 1000, filled: []int64{1000 - MAX_HEAD_GAP, 999}},
+	}
+
+	for _, test := range tests {
+		fake := fakedb.NewDB()
+		rpcServer := fakerpc.NewServer()
+		respondHeads(rpcServer, test.head)
+
+		e := newTestManager(rpcServer, "", fake)
+		e.fillHeadGap(context.Background(), testHead(test.last), testHead(test.head))
+
+		numbers := storedHeads(fake)
+		rpcServer.Close()
+		fake.Close()
+
+		if len(test.filled) == 0 {
+			if len(numbers) != 0 {
+				t.Errorf("%v to %v: filled %v, expected none", test.last, test.head, numbers)
+			}
+			continue
+		}
+
+		from, to := test.filled[0], test.filled[len(test.filled)-1]
+		if len(numbers) != int(to-from+1) || numbers[0] != from || numbers[len(numbers)-1] != to {
+			t.Errorf("%v to %v: filled %v, expected %v to %v", test.last, test.head, numbers, from, to)
+		}
+	}
+}
+
+func TestHeadLoopFallsBackToPolling(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	respondHeads(rpcServer, 42)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// an HTTP endpoint can't notify
+		newTestManager(rpcServer, rpcServer.URL, fake).HeadLoop(ctx)
+	}()
+
+	numbers := waitStoredHeads(t, fake, 1)
+	cancel()
+	<-done
+
+	if numbers[0] != 42 {
+		t.Errorf("got head %v stored, expected the polled one", numbers[0])
+	}
+}
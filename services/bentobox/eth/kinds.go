@@ -0,0 +1,82 @@
+package eth
+
+import (
+	"fmt"
+
+	"github.com/metamask/mustekala/services/lib/ipld"
+)
+
+// Kinds of elements we can want from the ethereum clients.
+// They are stored in the "kind" column of the "wantfromdevp2p" table,
+// and determine the query we send for the associated key.
+// Once processed, they are also the "kind" of the "ethdata" rows.
+const (
+	// block header + transactions, keyed by block number (base 10)
+	KindBlockBody = "block_body"
+	// transaction receipt, keyed by transaction hash
+	KindTxReceipt = "tx_receipt"
+	// uncle header, keyed by "<block hash>:<uncle index>"
+	KindUncle = "uncle"
+	// raw RLP of the whole block, keyed by block number (base 10)
+	KindBlockRLP = "block_rlp"
+	// keys of a slice of the state trie, and of its stem,
+	// keyed by "<state root>:<path>:<depth>"
+	KindStateSlice = "state_slice"
+	// state trie node, keyed by its hash
+	KindStateTrie = "state_trie"
+	// storage trie node of a contract, keyed by its hash
+	KindStorageTrie = "storage_trie"
+	// call trees of the transactions of a block, keyed by block
+	// number (base 10). Only found in the "traces" table once processed
+	KindTrace = "trace"
+
+	// below kinds are only found in the "ethdata" table,
+	// as a result of decomposing a block
+	KindBlockHeader = "block_header"
+	KindTransaction = "transaction"
+)
+
+// WantedKinds are the kinds the dispatcher knows how to query for,
+// as long as a fetcher can get them (see newFetchRoutes())
+var WantedKinds = []string{
+	KindBlockBody,
+	KindTxReceipt,
+	KindUncle,
+	KindBlockRLP,
+	KindStateSlice,
+	KindStateTrie,
+	KindStorageTrie,
+	KindTrace,
+}
+
+// kindToCodec maps the kinds of the "ethdata" elements
+// to the ethereum IPLD codec they are addressed with
+var kindToCodec = map[string]uint64{
+	KindBlockHeader: ipld.EthBlock,
+	KindUncle:       ipld.EthBlock,
+	KindTransaction: ipld.EthTx,
+	KindTxReceipt:   ipld.EthTxReceipt,
+	KindStateTrie:   ipld.EthStateTrie,
+	KindStorageTrie: ipld.EthStorageTrie,
+}
+
+// KindCodec returns the ethereum IPLD codec of an "ethdata" kind
+func KindCodec(kind string) (uint64, error) {
+	codec, ok := kindToCodec[kind]
+	if !ok {
+		return 0, &UnknownKindError{Kind: kind}
+	}
+
+	return codec, nil
+}
+
+// UnknownKindError is returned when a wanted element has a kind
+// we don't know how to retrieve or process
+type UnknownKindError struct {
+	Kind string
+}
+
+// Error implements the error interface
+func (e *UnknownKindError) Error() string {
+	return fmt.Sprintf("unknown wanted element kind: %v", e.Kind)
+}
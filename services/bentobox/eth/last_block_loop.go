@@ -1,12 +1,15 @@
 package eth
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"strconv"
 	"time"
 
 	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+	"github.com/metamask/mustekala/services/bentobox/notify"
 )
 
 // we put this here for aesthetic purposes
@@ -20,15 +23,15 @@ import (
 // * Gets from this new tmp1, the top ranked timestamps per number_id
 // * And finally returns the top block id.
 const lastBlockSQLQuery = `
-SELECT number_id, inserted_ts
+SELECT number_id, hash, inserted_ts
 FROM (
-	SELECT number_id, inserted_ts, rank()
+	SELECT number_id, hash, inserted_ts, rank()
 		OVER (
 			PARTITION BY tmp0.number_id
 			ORDER BY tmp0.inserted_ts DESC
 		) AS pos
 	FROM (
-			SELECT inserted_ts, number_id
+			SELECT inserted_ts, number_id, hash
 			FROM lastblock
 			ORDER BY inserted_ts DESC
 			LIMIT 100
@@ -41,16 +44,19 @@ LIMIT 1;
 
 // LastBlockLoop is a simple loop that polls the eth json rpc
 // for the latest block (height of the network), getting a
-// block number in return, which stores alongside the timestamp
-// of such received number.
-// Eventually this service will be horizontally scaled,
-// meaning that we must retrieve several "last block" values
-// from the shared db and determine whether we can count with
-// an actual number, or we should poll again.
-func (e *EthManager) LastBlockLoop() {
+// block number, hash and parent hash in return, which stores
+// alongside the timestamp of such received block.
+// Every new head is checked against our view of the canonical
+// chain, to find out whether there was a reorg.
+// Several instances may share the db, but only their leader
+// runs this loop (see the leader package), so they don't race
+// on the "last block" values.
+// Returns when the context is done.
+func (e *EthManager) LastBlockLoop(ctx context.Context) {
 	var err error
 
 	log.Printf("Starting LastBlockLoop")
+	defer log.Printf("Stopped LastBlockLoop")
 
 	for {
 		needToPoll := false
@@ -65,7 +71,10 @@ func (e *EthManager) LastBlockLoop() {
 				needToPoll = true
 			} else {
 				log.Printf("Error on SQL query for last block: %v", err)
-				time.Sleep(500 * time.Millisecond)
+				metrics.DBError("last_block", err)
+				if !sleep(ctx, 500*time.Millisecond) {
+					return
+				}
 				continue
 			}
 		} else {
@@ -83,60 +92,118 @@ func (e *EthManager) LastBlockLoop() {
 		// so, we poll of the flag was activated above
 		if needToPoll {
 			// do the actual query here
-			response, err := e.getNetworkHeight()
+			head, err := e.getLatestHead(ctx)
 			if err != nil {
 				log.Printf("There was an error requesting the last block, %v", err)
-				time.Sleep(500 * time.Millisecond)
+				if !sleep(ctx, 500*time.Millisecond) {
+					return
+				}
 				continue
 			}
 
-			// avoid below storage code, if is the same last block as in memory
-			if lastDbBlock != nil && response == lastDbBlock.NumberId {
-				time.Sleep(500 * time.Millisecond)
-				continue
+			// avoid below storage code, if is the same last block as in memory,
+			// or one behind it, of an upstream lagging or gone
+			if lastDbBlock != nil {
+				same := int64(head.Number) == lastDbBlock.NumberId && head.Hash.Hex() == lastDbBlock.Hash
+				if same || e.behindHead(head, lastDbBlock.NumberId) {
+					if !sleep(ctx, 500*time.Millisecond) {
+						return
+					}
+					continue
+				}
 			}
 
-			// store the response in the database
-			lastBlockTuple := db.LastBlock{
-				InsertedTS: time.Now().UnixNano(),
-				NumberId:   response,
-			}
+			e.storeHead(ctx, head)
 
-			log.Printf("Inserting new block found: %v", response)
+			// should be good to go now...
+		}
 
-			if err := e.dbMap.Insert(&lastBlockTuple); err != nil {
-				log.Printf("Error inserting last block tuple %v: %v", lastBlockTuple, err)
-			}
+		// Avoid the dreaded all-devouring loop
+		if !sleep(ctx, 500*time.Millisecond) {
+			return
+		}
+	}
+}
 
-			/////////////////////////////
-			//
-			// TODO
-			//
-			// Publish to the network that we have a chain head update!
-			//   (or figure out another agent listening to notifications
-			//   from these agents, and deciding to push this notif)
-			//
-			/////////////////////////////
-
-			// Add the block body (head + txs in the RPC)
-			// to the devp2p wanted list
-			wantedData := db.WantFromDevp2p{
-				InsertedTS:    time.Now().UnixNano(),
-				Kind:          "block_body",
-				Key:           strconv.FormatInt(response, 10),
-				LastRequestTS: 0,
-				SuccessTS:     0,
-			}
+// behindHead tells whether a head is lower than the last one we stored,
+// and on our own chain, so not a reorg. The head decided out of several
+// upstreams goes back whenever one of them lags or goes away, and we
+// don't want our head to follow. Those with a block other than the
+// one we know at their height are taken, see trackHead.
+func (e *EthManager) behindHead(head *chainHead, lastNumber int64) bool {
+	if int64(head.Number) >= lastNumber {
+		return false
+	}
 
-			if err := e.dbMap.Insert(&wantedData); err != nil {
-				log.Printf("Error inserting block body to devp2p wanted list %v: %v",
-					lastBlockTuple, err)
-			}
+	stored, err := e.canonicalBlock(int64(head.Number))
+	if err != nil {
+		log.Printf("Error on SQL query for canonical block %v: %v", head.Number, err)
+		metrics.DBError("canonical_block", err)
+		return false
+	}
 
-			// should be good to go now...
-		}
+	return stored == nil || stored.Hash == head.Hash.Hex()
+}
 
-		// Avoid the dreaded all-devouring loop
-		time.Sleep(500 * time.Millisecond)
+// storeHead stores a new chain head in the "lastblock" table,
+// checks whether the chain reorganized, and wants its block body
+func (e *EthManager) storeHead(ctx context.Context, head *chainHead) {
+	response := int64(head.Number)
+
+	// store the response in the database
+	lastBlockTuple := db.LastBlock{
+		InsertedTS: time.Now().UnixNano(),
+		NumberId:   response,
+		Hash:       head.Hash.Hex(),
+		ParentHash: head.ParentHash.Hex(),
+	}
+
+	log.Printf("Inserting new block found: %v", response)
+
+	if err := db.Upsert(e.dbMap, &lastBlockTuple); err != nil {
+		log.Printf("Error inserting last block tuple %v: %v", lastBlockTuple, err)
+		metrics.DBError("insert_last_block", err)
+	} else {
+		metrics.SetHead(response)
+	}
+
+	// did the chain reorganize?
+	if err := e.trackHead(ctx, head); err != nil {
+		log.Printf("Error tracking the canonical chain at %v: %v", response, err)
+	}
+
+	// let the agents listening know we have a chain head update
+	//   (see the notify package), so they can publish it to the network
+	err := notify.Publish(e.dbMap, notify.ChannelHeads, &notify.Head{
+		Number:     response,
+		Hash:       head.Hash.Hex(),
+		ParentHash: head.ParentHash.Hex(),
+	})
+	if err != nil {
+		log.Printf("Error notifying the head %v: %v", response, err)
+		metrics.DBError("notify_head", err)
+	}
+
+	// Add the block body (head + txs in the RPC)
+	// to the devp2p wanted list
+	wantedData := db.WantFromDevp2p{
+		InsertedTS:    time.Now().UnixNano(),
+		Kind:          KindBlockBody,
+		Key:           strconv.FormatInt(response, 10),
+		LastRequestTS: 0,
+		SuccessTS:     0,
+		Priority:      PriorityHead,
+	}
+
+	if err := db.Upsert(e.dbMap, &wantedData); err != nil {
+		log.Printf("Error inserting block body to devp2p wanted list %v: %v",
+			lastBlockTuple, err)
+		metrics.DBError("insert_wanted", err)
+	}
+	// and the slices of its state
+	if err := e.wantStateSlices(head.StateRoot, PriorityHeadChildren); err != nil {
+		log.Printf("Error inserting state slices of %v to devp2p wanted list: %v",
+			response, err)
+		metrics.DBError("insert_wanted", err)
 	}
 }
@@ -0,0 +1,166 @@
+package eth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+	"github.com/metamask/mustekala/services/bentobox/leader"
+)
+
+// errUnreachable is what a partitioned lock fails with
+var errUnreachable = errors.New("the lock is unreachable")
+
+// partitionedLock is a lock which can be cut off from the
+// instance using it, as on a network partition
+type partitionedLock struct {
+	leader.Lock
+	cut int32
+}
+
+func (l *partitionedLock) TryLock(ctx context.Context) (leader.Session, error) {
+	if atomic.LoadInt32(&l.cut) == 1 {
+		return nil, errUnreachable
+	}
+
+	session, err := l.Lock.TryLock(ctx)
+	if session == nil {
+		return nil, err
+	}
+	return &partitionedSession{Session: session, lock: l}, err
+}
+
+type partitionedSession struct {
+	leader.Session
+	lock *partitionedLock
+}
+
+func (s *partitionedSession) Held(ctx context.Context) (bool, error) {
+	if atomic.LoadInt32(&s.lock.cut) == 1 {
+		return false, errUnreachable
+	}
+	return s.Session.Held(ctx)
+}
+
+// electedManager is an EthManager running the loops of the leader
+// while its elector leads, its database of its own
+type electedManager struct {
+	elector *leader.Elector
+	lock    *partitionedLock
+	fake    *fakedb.DB
+}
+
+// waitLeader waits for a single manager to lead
+func waitLeader(t *testing.T, managers []*electedManager, timeout time.Duration) *electedManager {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		leading := []*electedManager{}
+		for _, m := range managers {
+			if m.elector.Leading() {
+				leading = append(leading, m)
+			}
+		}
+		if len(leading) == 1 {
+			return leading[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no single leader after %v", timeout)
+	return nil
+}
+
+func TestLeaderFailover(t *testing.T) {
+	lease := leader.MIN_LEASE
+	lock := leader.NewLocalLock()
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	respondHeads(rpcServer, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	managers := []*electedManager{}
+	for i := 0; i < 2; i++ {
+		fake := fakedb.NewDB()
+		defer fake.Close()
+		fake.Respond(followedChain())
+
+		e := NewManager(&Config{
+			EthJsonRPCs:   []string{rpcServer.URL},
+			PollInterval:  1,
+			PriorityAging: 1,
+			MaxQueries:    1,
+			MaxReorgDepth: 10,
+		}, fake.DbMap)
+		m := &electedManager{lock: &partitionedLock{Lock: lock}, fake: fake}
+		m.elector = leader.NewElector(m.lock, lease)
+		managers = append(managers, m)
+
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			m.elector.LeaderLoop(ctx, e.HeadLoop, e.PriorityAgingLoop)
+		}()
+	}
+	defer func() {
+		cancel()
+		running.Wait()
+	}()
+
+	// only the leader follows the head and ages the wanted elements
+	first := waitLeader(t, managers, lease)
+	waitStoredHeads(t, first.fake, 1)
+	waitExecuted(t, first.fake, ageWantedSQLQuery)
+
+	standby := managers[0]
+	if standby == first {
+		standby = managers[1]
+	}
+	if heads := storedHeads(standby.fake); len(heads) != 0 {
+		t.Errorf("the standby stored heads %v", heads)
+	}
+	if aged := standby.fake.Executed(ageWantedSQLQuery); len(aged) != 0 {
+		t.Errorf("the standby aged the wanted elements %d times", len(aged))
+	}
+
+	// the leader is cut off and the lock server gives up on its session:
+	// it steps down, and the standby takes over within the lease
+	atomic.StoreInt32(&first.lock.cut, 1)
+	lock.Expire()
+	expired := time.Now()
+	for first.elector.Leading() || !standby.elector.Leading() {
+		if time.Since(expired) > lease {
+			t.Fatalf("no failover after the lease of %v", lease)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitStoredHeads(t, standby.fake, 1)
+	if took := time.Since(expired); took > lease {
+		t.Errorf("the standby stored a head %v after the lock expired, longer than the lease of %v", took, lease)
+	}
+
+	// and the previous leader stopped its loops
+	aged := len(first.fake.Executed(ageWantedSQLQuery))
+	time.Sleep(2 * time.Second)
+	if now := len(first.fake.Executed(ageWantedSQLQuery)); now != aged {
+		t.Errorf("the previous leader aged the wanted elements %d more times", now-aged)
+	}
+}
+
+// waitExecuted waits until a statement of the given query is run
+func waitExecuted(t *testing.T, fake *fakedb.DB, query string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(fake.Executed(query)) > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no statement run of %v", query)
+}
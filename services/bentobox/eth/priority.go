@@ -0,0 +1,22 @@
+package eth
+
+// Priorities of the wanted elements, the higher the sooner they are
+// dispatched. Fresh heads must reach IPFS within seconds, even while
+// a large backfill is going on.
+const (
+	// block bodies of new chain heads (and of reorganized blocks)
+	PriorityHead = 100
+	// receipts and uncles of the heads
+	PriorityHeadChildren = 50
+	// historical blocks, and their receipts and uncles
+	PriorityBackfill = 0
+)
+
+// childPriority is the priority of the elements wanted
+// as a result of processing a block of the given priority
+func childPriority(priority int) int {
+	if priority >= PriorityHead {
+		return PriorityHeadChildren
+	}
+	return priority
+}
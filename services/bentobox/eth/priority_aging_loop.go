@@ -0,0 +1,48 @@
+package eth
+
+import (
+	"context"
+	"log"
+
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * Selects the pending elements below the heads ($1), locking them
+//   (skipping the ones the dispatchers are claiming right now,
+//   which miss this point)
+// * Gives them a point of priority, up to just below the heads,
+//   so they aren't starved but never get in the way of a fresh head
+const ageWantedSQLQuery = `
+UPDATE wantfromdevp2p
+SET priority = priority + 1
+WHERE (kind, key) IN (
+	SELECT kind, key
+	FROM wantfromdevp2p
+	WHERE
+		success_ts = 0
+		AND
+		dead_ts = 0
+		AND
+		priority < $1 - 1
+	FOR UPDATE SKIP LOCKED
+);
+`
+
+// PriorityAgingLoop gives a point of priority to every wanted element
+// below the heads, every "priority aging" period they wait. The dispatcher
+// claims them by their priority as it is, so it can walk its index.
+// Run by the leader only, so they age once whatever the instances.
+// Returns when the context is done.
+func (e *EthManager) PriorityAgingLoop(ctx context.Context) {
+	log.Printf("Starting PriorityAgingLoop")
+	defer log.Printf("Stopped PriorityAgingLoop")
+
+	for sleep(ctx, e.priorityAging) {
+		if _, err := e.dbMap.Exec(ageWantedSQLQuery, PriorityHead); err != nil {
+			log.Printf("Error aging the priority of the wanted elements: %v", err)
+			metrics.DBError("age_wanted", err)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package eth
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+	"github.com/metamask/mustekala/services/lib/ipld"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The number of a block we stored, by hash
+const blockNumberSQLQuery = `
+SELECT number_id
+FROM ethdata
+WHERE
+	kind = 'block_header'
+	AND
+	hash = $1;
+`
+
+// rpcBlock is the part of an eth_getBlockByNumber response
+// (with full transactions) that is not the header itself
+type rpcBlock struct {
+	Transactions []*types.Transaction `json:"transactions"`
+	Uncles       []common.Hash        `json:"uncles"`
+}
+
+// rpcReceiptBlock is the block of an eth_getTransactionReceipt response
+type rpcReceiptBlock struct {
+	BlockNumber *hexutil.Big `json:"blockNumber"`
+	BlockHash   common.Hash  `json:"blockHash"`
+}
+
+// processEthData switches by kind of element to store the
+// obtained content in the DB, for further processing.
+// (i.e. making it available to IPFS).
+// The elements wanted as a result inherit the priority of this one.
+func (e *EthManager) processEthData(kind, key, value string, priority int) error {
+	switch kind {
+	case KindBlockBody:
+		return e.processBlockBody(value, priority)
+	case KindBlockRLP:
+		return e.processBlockRLP(value, priority)
+	case KindUncle:
+		return e.processUncle(key, value)
+	case KindTxReceipt:
+		return e.processTxReceipt(key, value)
+	case KindStateSlice:
+		return e.processStateSlice(value, priority)
+	case KindStateTrie:
+		return e.processStateTrie(key, value, priority)
+	case KindStorageTrie:
+		return e.processStorageTrie(key, value, priority)
+	case KindTrace:
+		return e.processTrace(key, value)
+	default:
+		return &UnknownKindError{Kind: kind}
+	}
+}
+
+// processBlockBody decomposes the JSON of a block with its full transactions.
+// The uncles come as hashes only, so we add them to the wanted list.
+func (e *EthManager) processBlockBody(value string, priority int) error {
+	header := new(types.Header)
+	if err := json.Unmarshal([]byte(value), header); err != nil {
+		return fmt.Errorf("invalid block header: %v", err)
+	}
+
+	body := rpcBlock{}
+	if err := json.Unmarshal([]byte(value), &body); err != nil {
+		return fmt.Errorf("invalid block body: %v", err)
+	}
+
+	return e.storeBlock(header, body.Transactions, nil, len(body.Uncles), priority)
+}
+
+// processBlockRLP decomposes the raw RLP of a block,
+// which already includes the uncle headers.
+func (e *EthManager) processBlockRLP(value string, priority int) error {
+	block, err := parseBlockRLP(value)
+	if err != nil {
+		return err
+	}
+
+	return e.storeBlock(block.Header(), block.Transactions(), block.Uncles(), 0, priority)
+}
+
+// parseBlockRLP decodes the JSON string of the hex RLP of a block
+func parseBlockRLP(value string) (*types.Block, error) {
+	var rlpHex string
+	if err := json.Unmarshal([]byte(value), &rlpHex); err != nil {
+		return nil, fmt.Errorf("invalid block rlp: %v", err)
+	}
+
+	rlpBin, err := hex.DecodeString(strings.TrimPrefix(rlpHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid block rlp: %v", err)
+	}
+
+	block := new(types.Block)
+	if err := rlp.DecodeBytes(rlpBin, block); err != nil {
+		return nil, fmt.Errorf("invalid block rlp: %v", err)
+	}
+
+	return block, nil
+}
+
+// processUncle stores the obtained uncle header,
+// with the number of the block it came in
+func (e *EthManager) processUncle(key, value string) error {
+	uncle := new(types.Header)
+	if err := json.Unmarshal([]byte(value), uncle); err != nil {
+		return fmt.Errorf("invalid uncle header: %v", err)
+	}
+
+	uncleData, err := newEthData(KindUncle, uncle.Hash(), uncle)
+	if err != nil {
+		return err
+	}
+
+	blockHash, _, err := splitUncleKey(key)
+	if err != nil {
+		return err
+	}
+	uncleData.NumberId, err = e.dbMap.SelectNullInt(blockNumberSQLQuery, blockHash)
+	if err != nil {
+		metrics.DBError("block_number", err)
+		return err
+	}
+
+	return db.Upsert(e.dbMap, uncleData)
+}
+
+// processTxReceipt stores the obtained receipt, and its logs, and maps it
+// against its transaction. As receipts don't have a hash of their own,
+// we use the hash of their consensus encoding.
+func (e *EthManager) processTxReceipt(key, value string) error {
+	receipt := new(types.Receipt)
+	if err := json.Unmarshal([]byte(value), receipt); err != nil {
+		return fmt.Errorf("invalid tx receipt: %v", err)
+	}
+
+	receiptRLP, err := rlp.EncodeToBytes(receipt)
+	if err != nil {
+		return err
+	}
+	receiptHash := crypto.Keccak256Hash(receiptRLP)
+
+	receiptData, err := newEthData(KindTxReceipt, receiptHash, receipt)
+	if err != nil {
+		return err
+	}
+
+	rows := []interface{}{receiptData}
+
+	// the number of its block is not part of the receipt itself
+	block := rpcReceiptBlock{}
+	if err := json.Unmarshal([]byte(value), &block); err == nil && block.BlockNumber != nil {
+		receiptData.NumberId = sql.NullInt64{Int64: block.BlockNumber.ToInt().Int64(), Valid: true}
+
+		// neither is the position of its logs in the block
+		rows = append(rows, logRows(receipt, block)...)
+	}
+
+	rows = append(rows, &db.TxReceipts{
+		InsertedTS:   time.Now().UnixNano(),
+		TxId:         key,
+		TxReceiptsId: receiptHash.Hex(),
+	})
+
+	return e.upsertAll("store_receipt", rows...)
+}
+
+// logRows builds the logs tuples of a receipt, in the given block
+func logRows(receipt *types.Receipt, block rpcReceiptBlock) []interface{} {
+	now := time.Now().UnixNano()
+	rows := []interface{}{}
+
+	for _, l := range receipt.Logs {
+		logData := &db.Log{
+			BlockHash:  block.BlockHash.Hex(),
+			LogIndex:   int64(l.Index),
+			NumberId:   block.BlockNumber.ToInt().Int64(),
+			TxHash:     receipt.TxHash.Hex(),
+			TxIndex:    int64(l.TxIndex),
+			Address:    l.Address.Hex(),
+			Data:       hex.EncodeToString(l.Data),
+			InsertedTS: now,
+		}
+
+		topics := []*string{&logData.Topic0, &logData.Topic1, &logData.Topic2, &logData.Topic3}
+		for i, topic := range l.Topics {
+			if i < len(topics) {
+				*topics[i] = topic.Hex()
+			}
+		}
+
+		rows = append(rows, logData)
+	}
+
+	return rows
+}
+
+// storeBlock fans out a block into the ethdata table (header, transactions
+// and uncles, each one as a separate row), registers its transactions and
+// its logs bloom, and adds to the wanted list the receipts of every transaction.
+// When we only know how many uncles the block has, they are wanted as well,
+// as are the traces of the block when we keep them.
+// The priority of the wanted elements follows the one of the block.
+func (e *EthManager) storeBlock(header *types.Header, txs types.Transactions,
+	uncles []*types.Header, wantedUncles int, priority int) error {
+	now := time.Now().UnixNano()
+	blockHash := header.Hash()
+
+	rows := []interface{}{}
+
+	headerData, err := newEthData(KindBlockHeader, blockHash, header)
+	if err != nil {
+		return err
+	}
+	number := sql.NullInt64{Int64: header.Number.Int64(), Valid: true}
+	headerData.NumberId = number
+	rows = append(rows, headerData)
+
+	for i, tx := range txs {
+		txData, err := newEthData(KindTransaction, tx.Hash(), tx)
+		if err != nil {
+			return err
+		}
+		txData.NumberId = number
+
+		rows = append(rows,
+			txData,
+			&db.BlockTX{
+				InsertedTS: now,
+				BlockID:    blockHash.Hex(),
+				TxId:       tx.Hash().Hex(),
+				TxIndex:    int64(i),
+			},
+			&db.WantFromDevp2p{
+				InsertedTS: now,
+				Kind:       KindTxReceipt,
+				Key:        tx.Hash().Hex(),
+				Priority:   childPriority(priority),
+			})
+	}
+
+	rows = append(rows, &db.BlockNumberofTx{
+		InsertedTS:  now,
+		BlockID:     blockHash.Hex(),
+		NumberOfTxs: int64(len(txs)),
+	})
+
+	rows = append(rows, &db.Bloom{
+		BlockHash:  blockHash.Hex(),
+		NumberId:   header.Number.Int64(),
+		Bloom:      hex.EncodeToString(header.Bloom.Bytes()),
+		InsertedTS: now,
+	})
+
+	for _, uncle := range uncles {
+		uncleData, err := newEthData(KindUncle, uncle.Hash(), uncle)
+		if err != nil {
+			return err
+		}
+		uncleData.NumberId = number
+		rows = append(rows, uncleData)
+	}
+
+	for i := 0; i < wantedUncles; i++ {
+		rows = append(rows, &db.WantFromDevp2p{
+			InsertedTS: now,
+			Kind:       KindUncle,
+			Key:        fmt.Sprintf("%v:%d", blockHash.Hex(), i),
+			Priority:   childPriority(priority),
+		})
+	}
+
+	if e.traces {
+		rows = append(rows, &db.WantFromDevp2p{
+			InsertedTS: now,
+			Kind:       KindTrace,
+			Key:        header.Number.String(),
+			Priority:   childPriority(priority),
+		})
+	}
+
+	// all or nothing, we don't want half processed blocks
+	return e.upsertAll("store_block", rows...)
+}
+
+// upsertAll upserts the rows in a single transaction,
+// counting the errors of the given query name
+func (e *EthManager) upsertAll(query string, rows ...interface{}) error {
+	dbTx, err := e.dbMap.Begin()
+	if err != nil {
+		metrics.DBError(query, err)
+		return err
+	}
+
+	if err := db.Upsert(dbTx, rows...); err != nil {
+		metrics.DBError(query, err)
+		dbTx.Rollback()
+		return err
+	}
+
+	err = dbTx.Commit()
+	metrics.DBError(query, err)
+	return err
+}
+
+// newEthData builds an ethdata tuple with the RLP encoding of the element,
+// and the CID it will have once added into IPFS
+func newEthData(kind string, hash common.Hash, element interface{}) (*db.EthData, error) {
+	codec, err := KindCodec(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := rlp.EncodeToBytes(element)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode %v %v: %v", kind, hash.Hex(), err)
+	}
+
+	return &db.EthData{
+		InsertedTS: time.Now().UnixNano(),
+		Kind:       kind,
+		Hash:       hash.Hex(),
+		CID:        ipld.Sum(codec, value).String(),
+		Value:      hex.EncodeToString(value),
+	}, nil
+}
@@ -1,6 +1,10 @@
 package eth
 
-import "sync"
+import (
+	"sync"
+
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
 
 // queryManager keeps track of the queries
 // being made
@@ -8,20 +12,26 @@ type queryManager struct {
 	queue queryQueue
 }
 
+// queryKey identifies a wanted element
+type queryKey struct {
+	kind string
+	key  string
+}
+
 // queryQueue is the queue element of
 // the queryManager
 type queryQueue struct {
 	sync.RWMutex
-	items map[string]struct{}
-	count int
+	items  map[queryKey]struct{}
+	byKind map[string]int
 }
 
 // newQueryManager initializes the queryManager
 func newQueryManager() *queryManager {
 	q := &queryManager{
 		queue: queryQueue{
-			items: make(map[string]struct{}),
-			count: 0,
+			items:  make(map[queryKey]struct{}),
+			byKind: make(map[string]int),
 		},
 	}
 
@@ -29,32 +39,70 @@ func newQueryManager() *queryManager {
 }
 
 // addQuery keeps track in a map of the queries
-// being made
-func (q *queryManager) addQuery(id string) {
+// being made. Returns false if the element was
+// already being queried.
+func (q *queryManager) addQuery(kind, key string) bool {
 	q.queue.Lock()
 	defer q.queue.Unlock()
 
-	if _, ok := q.queue.items[id]; !ok {
-		q.queue.items[id] = struct{}{}
-		q.queue.count += 1
+	id := queryKey{kind: kind, key: key}
+	if _, ok := q.queue.items[id]; ok {
+		return false
 	}
+
+	q.queue.items[id] = struct{}{}
+	q.queue.byKind[kind] += 1
+	metrics.InFlight.WithLabelValues(kind).Inc()
+
+	return true
 }
 
 // removeQuery takes the registered query out
 // of the map
-func (q *queryManager) removeQuery(id string) {
+func (q *queryManager) removeQuery(kind, key string) {
 	q.queue.Lock()
 	defer q.queue.Unlock()
 
+	id := queryKey{kind: kind, key: key}
+	if _, ok := q.queue.items[id]; !ok {
+		return
+	}
+
 	delete(q.queue.items, id)
-	q.queue.count -= 1
+	q.queue.byKind[kind] -= 1
+	metrics.InFlight.WithLabelValues(kind).Dec()
 }
 
 // getQueueCount returns the number of queries
 // being made
 func (q *queryManager) getQueueCount() int {
-	q.queue.Lock()
-	defer q.queue.Unlock()
+	q.queue.RLock()
+	defer q.queue.RUnlock()
+
+	return len(q.queue.items)
+}
+
+// getKindCount returns the number of queries
+// being made for the given kind
+func (q *queryManager) getKindCount(kind string) int {
+	q.queue.RLock()
+	defer q.queue.RUnlock()
+
+	return q.queue.byKind[kind]
+}
+
+// getKindKeys returns the keys of the queries
+// being made for the given kind
+func (q *queryManager) getKindKeys(kind string) []string {
+	q.queue.RLock()
+	defer q.queue.RUnlock()
+
+	keys := make([]string, 0, q.queue.byKind[kind])
+	for id := range q.queue.items {
+		if id.kind == kind {
+			keys = append(keys, id.key)
+		}
+	}
 
-	return q.queue.count
+	return keys
 }
@@ -0,0 +1,275 @@
+package eth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+const canonicalBlockSQLQuery = `
+SELECT number_id, hash, parent_hash, inserted_ts
+FROM canonicalblocks
+WHERE number_id = $1;
+`
+
+// the canonical blocks above a new head, left over
+// when the chain reorganized into a shorter one, the highest first
+const dropCanonicalAboveSQLQuery = `
+WITH dropped AS (
+	DELETE FROM canonicalblocks
+	WHERE number_id > $1
+	RETURNING number_id, hash, parent_hash, inserted_ts
+)
+SELECT number_id, hash, parent_hash, inserted_ts
+FROM dropped
+ORDER BY number_id DESC;
+`
+
+// below queries mark as orphaned the data of a block
+// no longer in the canonical chain
+
+const orphanBlockHeaderSQLQuery = `
+UPDATE ethdata
+SET orphaned = true
+WHERE
+	kind = $2
+	AND
+	hash = $1;
+`
+
+const orphanBlockTxsSQLQuery = `
+UPDATE ethdata
+SET orphaned = true
+WHERE
+	kind = $2
+	AND
+	hash IN (SELECT tx_id FROM blocktx WHERE block_id = $1);
+`
+
+const orphanBlockTxReceiptsSQLQuery = `
+UPDATE ethdata
+SET orphaned = true
+WHERE
+	kind = $2
+	AND
+	hash IN (
+		SELECT tx_receipts_id
+		FROM txreceipts
+		WHERE tx_id IN (SELECT tx_id FROM blocktx WHERE block_id = $1)
+	);
+`
+
+const orphanBlockTXSQLQuery = `
+UPDATE blocktx
+SET orphaned = true
+WHERE block_id = $1;
+`
+
+// the receipts of the orphaned transactions depend on the block
+// they were included in, so we need to ask for them again
+const rewantBlockTxReceiptsSQLQuery = `
+UPDATE wantfromdevp2p
+SET
+	success_ts = 0, last_request_ts = 0,
+	attempts = 0, last_error = '', next_attempt_ts = 0, dead_ts = 0
+WHERE
+	kind = $2
+	AND
+	key IN (SELECT tx_id FROM blocktx WHERE block_id = $1);
+`
+
+// rewantSQLQuery adds an element to the wanted list,
+// asking for it again if we already had it
+const rewantSQLQuery = `
+INSERT INTO wantfromdevp2p (inserted_ts, kind, key, last_request_ts, success_ts, priority)
+VALUES ($1, $2, $3, 0, 0, $4)
+ON CONFLICT (kind, key) DO UPDATE
+SET
+	success_ts = 0, last_request_ts = 0,
+	attempts = 0, last_error = '', next_attempt_ts = 0, dead_ts = 0,
+	priority = GREATEST(wantfromdevp2p.priority, EXCLUDED.priority);
+`
+
+// trackHead compares a new head against our view of the canonical chain.
+// It walks back from the head, through the parent hashes, until it finds
+// a block we already know as canonical (or a height we never saw).
+// Every known block replaced in the way is orphaned, its data flagged,
+// the new canonical blocks wanted again, and the event recorded.
+func (e *EthManager) trackHead(ctx context.Context, head *chainHead) error {
+	canonical := []*chainHead{head}
+	orphaned := []*db.CanonicalBlock{}
+
+	current := head
+	for {
+		stored, err := e.canonicalBlock(int64(current.Number))
+		if err != nil {
+			return err
+		}
+		if stored != nil && stored.Hash == current.Hash.Hex() {
+			// we already knew this one, nothing changed from here
+			canonical = canonical[:len(canonical)-1]
+			break
+		}
+		if stored != nil {
+			orphaned = append(orphaned, stored)
+		}
+
+		if current.Number == 0 {
+			break
+		}
+
+		parent, err := e.canonicalBlock(int64(current.Number) - 1)
+		if err != nil {
+			return err
+		}
+		if parent == nil || parent.Hash == current.ParentHash.Hex() {
+			// unknown height, or linked to our chain
+			break
+		}
+
+		if len(canonical) >= e.maxReorgDepth {
+			log.Printf("Reorg deeper than %v blocks at %v, giving up on walking back",
+				e.maxReorgDepth, head.Number)
+			break
+		}
+
+		parentHead, err := e.getHeadByHash(ctx, current.ParentHash)
+		if err != nil {
+			return fmt.Errorf("can't get parent %v: %v", current.ParentHash.Hex(), err)
+		}
+		canonical = append(canonical, parentHead)
+		current = parentHead
+	}
+
+	if len(canonical) == 0 {
+		// a head of our own chain, maybe behind the last one
+		return nil
+	}
+
+	dbTx, err := e.dbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := e.storeCanonical(dbTx, head, canonical, orphaned); err != nil {
+		metrics.DBError("store_canonical", err)
+		dbTx.Rollback()
+		return err
+	}
+
+	err = dbTx.Commit()
+	metrics.DBError("store_canonical", err)
+	return err
+}
+
+// storeCanonical updates our view of the canonical chain,
+// and takes care of the orphaned blocks. When the new head
+// replaces a block we knew at its height, the blocks we knew
+// above it are no longer canonical either, so they go with the orphaned.
+func (e *EthManager) storeCanonical(dbTx *gorp.Transaction, head *chainHead,
+	canonical []*chainHead, orphaned []*db.CanonicalBlock) error {
+	now := time.Now().UnixNano()
+
+	if len(orphaned) > 0 && orphaned[0].NumberId == int64(head.Number) {
+		var above []*db.CanonicalBlock
+		if _, err := dbTx.Select(&above, dropCanonicalAboveSQLQuery, int64(head.Number)); err != nil {
+			return err
+		}
+		orphaned = append(above, orphaned...)
+	}
+
+	for _, block := range canonical {
+		err := db.Upsert(dbTx, &db.CanonicalBlock{
+			NumberId:   int64(block.Number),
+			Hash:       block.Hash.Hex(),
+			ParentHash: block.ParentHash.Hex(),
+			InsertedTS: now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(orphaned) == 0 {
+		return nil
+	}
+
+	orphanedHashes := []string{}
+	for _, block := range orphaned {
+		for _, q := range []struct {
+			query string
+			kind  string
+		}{
+			{orphanBlockHeaderSQLQuery, KindBlockHeader},
+			{orphanBlockTxsSQLQuery, KindTransaction},
+			{orphanBlockTxReceiptsSQLQuery, KindTxReceipt},
+			{rewantBlockTxReceiptsSQLQuery, KindTxReceipt},
+		} {
+			if _, err := dbTx.Exec(q.query, block.Hash, q.kind); err != nil {
+				return err
+			}
+		}
+		if _, err := dbTx.Exec(orphanBlockTXSQLQuery, block.Hash); err != nil {
+			return err
+		}
+
+		orphanedHashes = append(orphanedHashes, block.Hash)
+	}
+
+	// the new canonical blocks have to be retrieved
+	canonicalHashes := []string{}
+	for _, block := range canonical {
+		_, err := dbTx.Exec(rewantSQLQuery,
+			now, KindBlockBody, strconv.FormatUint(uint64(block.Number), 10), PriorityHead)
+		if err != nil {
+			return err
+		}
+
+		// so are their traces, stored against the orphaned ones
+		if e.traces {
+			_, err := dbTx.Exec(rewantSQLQuery,
+				now, KindTrace, strconv.FormatUint(uint64(block.Number), 10), PriorityHead)
+			if err != nil {
+				return err
+			}
+		}
+
+		canonicalHashes = append(canonicalHashes, block.Hash.Hex())
+	}
+
+	ancestor := canonical[len(canonical)-1]
+	log.Printf("Reorg found at %v, %v blocks orphaned since %v",
+		head.Number, len(orphaned), ancestor.Number-1)
+
+	return dbTx.Insert(&db.ReorgEvent{
+		InsertedTS:       now,
+		NumberId:         int64(head.Number),
+		AncestorNumberId: int64(ancestor.Number) - 1,
+		Depth:            int64(len(orphaned)),
+		OrphanedHashes:   strings.Join(orphanedHashes, ","),
+		CanonicalHashes:  strings.Join(canonicalHashes, ","),
+	})
+}
+
+// canonicalBlock returns the block we know as canonical at the given height,
+// nil if we don't know any
+func (e *EthManager) canonicalBlock(number int64) (*db.CanonicalBlock, error) {
+	var block *db.CanonicalBlock
+	if err := e.dbMap.SelectOne(&block, canonicalBlockSQLQuery, number); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return block, nil
+}
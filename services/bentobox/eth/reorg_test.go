@@ -0,0 +1,167 @@
+package eth
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+)
+
+// storedCanonical answers the queries of trackHead as if we knew
+// the given heads as canonical, the ones above the number asked for
+// being dropped
+func storedCanonical(heads ...*chainHead) fakedb.RowsFunc {
+	columns := []string{"number_id", "hash", "parent_hash", "inserted_ts"}
+	row := func(head *chainHead) []driver.Value {
+		return []driver.Value{int64(head.Number), head.Hash.Hex(), head.ParentHash.Hex(), int64(1)}
+	}
+
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		rows := [][]driver.Value{}
+		switch query {
+		case canonicalBlockSQLQuery:
+			for _, head := range heads {
+				if int64(head.Number) == args[0].(int64) {
+					rows = append(rows, row(head))
+				}
+			}
+		case dropCanonicalAboveSQLQuery:
+			for i := len(heads) - 1; i >= 0; i-- {
+				if int64(heads[i].Number) > args[0].(int64) {
+					rows = append(rows, row(heads[i]))
+				}
+			}
+		}
+		return columns, rows
+	}
+}
+
+// orphanedHeaders returns the hashes of the headers orphaned
+func orphanedHeaders(fake *fakedb.DB) []string {
+	hashes := []string{}
+	for _, statement := range fake.Executed(orphanBlockHeaderSQLQuery) {
+		hashes = append(hashes, statement.Args[0].(string))
+	}
+
+	return hashes
+}
+
+// forkHead is a head of a fork of the test chain,
+// branching off it after the given number
+func forkHead(number, after uint64) *chainHead {
+	head := &chainHead{
+		Number:     hexutil.Uint64(number),
+		Hash:       common.BigToHash(new(big.Int).SetUint64(number + 2000)),
+		ParentHash: common.BigToHash(new(big.Int).SetUint64(number + 1999)),
+	}
+	if number == after+1 {
+		head.ParentHash = testHead(after).Hash
+	}
+
+	return head
+}
+
+// rewantedBodies returns the numbers of the block bodies wanted again
+func rewantedBodies(fake *fakedb.DB) []string {
+	numbers := []string{}
+	for _, statement := range fake.Executed(rewantSQLQuery) {
+		if statement.Args[1] == KindBlockBody {
+			numbers = append(numbers, statement.Args[2].(string))
+		}
+	}
+
+	return numbers
+}
+
+func TestTrackHeadBehind(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	fake.Respond(storedCanonical(testHead(6), testHead(7), testHead(8), testHead(9)))
+
+	// back to 7, which we already knew, as a lagging client would give
+	e := &EthManager{dbMap: fake.DbMap, maxReorgDepth: 64}
+	if err := e.trackHead(context.Background(), testHead(7)); err != nil {
+		t.Fatal(err)
+	}
+
+	if dropped := fake.Executed(dropCanonicalAboveSQLQuery); len(dropped) != 0 {
+		t.Errorf("dropped the canonical blocks above 7")
+	}
+	if orphaned := orphanedHeaders(fake); len(orphaned) != 0 {
+		t.Errorf("orphaned %v, expected none", orphaned)
+	}
+	if events := fake.Executed("reorgevents"); len(events) != 0 {
+		t.Errorf("got %d reorg events, expected none", len(events))
+	}
+}
+
+func TestTrackHeadShorterChain(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	fake.Respond(storedCanonical(testHead(6), testHead(7), testHead(8), testHead(9)))
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	rpcServer.Handle("eth_getBlockByHash", func(params []json.RawMessage) (interface{}, *fakerpc.Error) {
+		var hash common.Hash
+		if err := json.Unmarshal(params[0], &hash); err != nil || hash != forkHead(7, 6).Hash {
+			return nil, nil
+		}
+		return forkHead(7, 6), nil
+	})
+
+	// a fork of 6 takes over at 8, a block shorter than our chain
+	e := &EthManager{dbMap: fake.DbMap, maxReorgDepth: 64, pool: newRPCPool([]string{rpcServer.URL}, "", 0)}
+	if err := e.trackHead(context.Background(), forkHead(8, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	orphaned := orphanedHeaders(fake)
+	expected := []string{testHead(9).Hash.Hex(), testHead(8).Hash.Hex(), testHead(7).Hash.Hex()}
+	if fmt.Sprint(orphaned) != fmt.Sprint(expected) {
+		t.Errorf("orphaned %v, expected %v", orphaned, expected)
+	}
+	if len(fake.Executed(dropCanonicalAboveSQLQuery)) != 1 {
+		t.Errorf("expected the canonical blocks above 8 dropped")
+	}
+
+	// the blocks of the fork, not the ones above it
+	if rewanted := rewantedBodies(fake); fmt.Sprint(rewanted) != "[8 7]" {
+		t.Errorf("wanted the bodies of %v again, expected 8 and 7", rewanted)
+	}
+
+	events := fake.Executed("reorgevents")
+	if len(events) != 1 {
+		t.Fatalf("got %d reorg events, expected 1", len(events))
+	}
+	args := events[0].Args
+	if args[1] != int64(8) || args[2] != int64(6) || args[3] != int64(3) {
+		t.Errorf("reorg at %v since %v of depth %v, expected at 8 since 6 of depth 3",
+			args[1], args[2], args[3])
+	}
+}
+
+func TestTrackHeadLongerChain(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	fake.Respond(storedCanonical(testHead(6), testHead(7)))
+
+	e := &EthManager{dbMap: fake.DbMap, maxReorgDepth: 64}
+	if err := e.trackHead(context.Background(), testHead(8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if orphaned := orphanedHeaders(fake); len(orphaned) != 0 {
+		t.Errorf("orphaned %v, expected none", orphaned)
+	}
+	if events := fake.Executed("reorgevents"); len(events) != 0 {
+		t.Errorf("got %d reorg events, expected none", len(events))
+	}
+}
@@ -1,114 +1,250 @@
 package eth
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"time"
 
+	"github.com/lib/pq"
+
 	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
 )
 
 // we put this here for aesthetic purposes
 // EXPLAIN:
-//
+// * Selects the elements of a kind not yet retrieved nor given up on,
+//   whose time for a next attempt has come, locking them
+//   (skipping the ones other dispatchers have already locked).
+//   The keys we still have in flight ($7) are left out, as the backoff
+//   of their attempt may be over before they finish (i.e. the traces)
+// * Takes the ones with the highest priority ($6 at least), walking the
+//   pending_wfd_idx (kind, priority DESC, next_attempt_ts) index in order.
+//   The waiting elements gain priority in PriorityAgingLoop
+// * Counts the attempt, and marks them with the time of this request
+// * Schedules the next attempt with an exponential backoff
+//   ($3 * 2^attempts, up to $4), in case this one fails (or we crash)
 const wantedElementsSQLQuery = `
 UPDATE wantfromdevp2p
-SET last_request_ts = $1
-WHERE inserted_ts IN (
-	SELECT inserted_ts
+SET
+	last_request_ts = $1,
+	attempts = attempts + 1,
+	next_attempt_ts = $1 + LEAST($3 * power(2, attempts), $4)::bigint
+WHERE (kind, key) IN (
+	SELECT kind, key
 	FROM wantfromdevp2p
 	WHERE
-		$1-last_request_ts>=$2
+		kind = $2
+		AND
+		success_ts = 0
+		AND
+		dead_ts = 0
+		AND
+		priority >= $6
+		AND
+		next_attempt_ts <= $1
 		AND
-		success_ts=0
-	LIMIT $3
+		NOT (key = ANY($7))
+	ORDER BY priority DESC, next_attempt_ts
+	LIMIT $5
 	FOR UPDATE SKIP LOCKED
 )
-RETURNING kind, key;
+RETURNING kind, key, attempts, priority;
+`
+
+// releaseWantedSQLQuery undoes the claim of an element,
+// so it can be requested again right away
+const releaseWantedSQLQuery = `
+UPDATE wantfromdevp2p
+SET
+	last_request_ts = 0,
+	next_attempt_ts = 0,
+	attempts = GREATEST(attempts - 1, 0)
+WHERE
+	kind = $1
+	AND
+	key = $2
+	AND
+	success_ts = 0;
+`
+
+// failedWantedSQLQuery records the error of an attempt,
+// giving up on the element (dead letter) after $4 attempts.
+// The next attempt was already scheduled when claiming it.
+const failedWantedSQLQuery = `
+UPDATE wantfromdevp2p
+SET
+	last_error = $3,
+	dead_ts = CASE WHEN attempts >= $4 THEN $5 ELSE 0 END
+WHERE
+	kind = $1
+	AND
+	key = $2
+	AND
+	success_ts = 0
+RETURNING dead_ts;
 `
 
 const updateSuccessTSSQLQuery = `
 UPDATE wantfromdevp2p
-SET success_ts = $3
+SET success_ts = $3, last_error = ''
 WHERE
 	kind = $1
 	AND
 	key = $2;
 `
 
+// MAX_ERROR_LENGTH caps the errors we store in the "last_error" column
+const MAX_ERROR_LENGTH = 1024
+
 // RpcDispatcherLoop obtains ethereum data from the clients
 // by reading the "wantfromdevp2p" table and dispatching
-// queries. Succesful results are stored into the "ethdata"
-// table, for further processing
-func (e *EthManager) RpcDispatcherLoop() {
-	var err error
-
+// queries in batches, to the fetcher each kind is routed to
+// (JSON RPC batches, or devp2p requests). Succesful results are
+// stored into the "ethdata" table, for further processing.
+// Returns when the context is done, leaving the in-flight
+// dispatches to EthManager.Shutdown()
+func (e *EthManager) RpcDispatcherLoop(ctx context.Context) {
 	log.Printf("Starting RpcDispatcherLoop")
+	defer log.Printf("Stopped RpcDispatcherLoop")
 
 	for {
-		wantedElementsCount := e.maxQueries - e.qm.getQueueCount()
+		// the heads and their children take the room first,
+		// whatever kind they are, then the rest
+		for _, minPriority := range []int{PriorityHeadChildren, PriorityBackfill} {
+			if e.Paused() {
+				break
+			}
 
-		if wantedElementsCount < 0 {
-			// wait until this clears
-			time.Sleep(500 * time.Millisecond)
-			continue
+			for _, kind := range WantedKinds {
+				e.dispatchKind(kind, minPriority)
+			}
 		}
 
-		// query for wanted elements in the table
-		// criteria:
-		// - last_request was made after "redo time" seconds
-		// - haven't had success
-		var wantedElements []*db.WantFromDevp2p
-
-		_, err = e.dbMap.Select(&wantedElements,
-			wantedElementsSQLQuery,
-			time.Now().UnixNano(),
-			e.redoQueryTime*1000*1000*1000,
-			wantedElementsCount)
-
-		if err != nil {
-			if err != sql.ErrNoRows {
-				log.Printf("Error on SQL query for last block: %v", err)
-			}
+		// avoid the dreaded all-devouring loop
+		if !sleep(ctx, 500*time.Millisecond) {
+			return
+		}
+	}
+}
+
+// dispatchKind claims as many wanted elements of the kind
+// (with the given priority at least) as we have
+// room for, and dispatches them in batches
+func (e *EthManager) dispatchKind(kind string, minPriority int) {
+	fetcher, ok := e.fetchers[kind]
+	if !ok {
+		// nobody to ask for these, they wait
+		return
+	}
+
+	wantedElementsCount := e.maxQueries*e.batchSize - e.qm.getQueueCount()
+
+	// a kind may have its own limit, so it doesn't starve the rest
+	if limit, ok := e.kindLimits[kind]; ok && limit > 0 {
+		if kindRoom := limit - e.qm.getKindCount(kind); kindRoom < wantedElementsCount {
+			wantedElementsCount = kindRoom
+		}
+	}
+
+	if wantedElementsCount <= 0 {
+		// wait until this clears
+		return
+	}
+
+	// query for wanted elements in the table
+	// criteria:
+	// - the backoff of the last attempt is over
+	// - haven't had success, nor we gave up on them
+	// - the highest priorities first
+	var wantedElements []*db.WantFromDevp2p
 
-			time.Sleep(500 * time.Millisecond)
-			continue
+	_, err := e.dbMap.Select(&wantedElements,
+		wantedElementsSQLQuery,
+		time.Now().UnixNano(),
+		kind,
+		int64(e.retryBackoff),
+		int64(e.maxRetryBackoff),
+		wantedElementsCount,
+		minPriority,
+		pq.Array(e.qm.getKindKeys(kind)))
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error on SQL query for wanted elements (%v): %v", kind, err)
+			metrics.DBError("claim_wanted", err)
 		}
+		return
+	}
 
-		// dispatch in parallel
-		for _, _wantedItem := range wantedElements {
-			// we need to clone this value when doing async voodoo
-			wantedItem := _wantedItem
+	// keep track of them. The ones in flight were left out of the claim,
+	// but we make sure we don't dispatch any of them twice anyway
+	claimed := wantedElements[:0]
+	for _, wantedItem := range wantedElements {
+		if e.qm.addQuery(wantedItem.Kind, wantedItem.Key) {
+			claimed = append(claimed, wantedItem)
+		}
+	}
 
-			go e.dispatcher(wantedItem.Kind, wantedItem.Key)
+	// dispatch in parallel, one batch per request
+	for len(claimed) > 0 {
+		size := e.batchSize
+		if size > len(claimed) {
+			size = len(claimed)
 		}
 
-		// avoid the dreaded all-devouring loop
-		time.Sleep(500 * time.Millisecond)
+		batch := claimed[:size]
+		claimed = claimed[size:]
+
+		e.inFlight.Add(1)
+		go e.dispatcher(fetcher, batch)
+	}
+}
+
+// dispatcher encapsulates the fetch of a batch of wanted
+// elements and the subsequent process of each obtained value
+func (e *EthManager) dispatcher(fetcher Fetcher, batch []*db.WantFromDevp2p) {
+	defer e.inFlight.Done()
+
+	values, errs := fetcher.Fetch(e.workCtx, batch)
+
+	for i, wantedItem := range batch {
+		e.settle(wantedItem, values[i], errs[i])
 	}
 }
 
-// dispatcher encapsulates the rpc call and the subsequent
-// process of the obtained value
-func (e *EthManager) dispatcher(kind, key string) {
-	// add it to our query manager
-	qmKey := "kind" + "_" + "key"
-	e.qm.addQuery(qmKey)
+// settle processes the outcome of the fetch of a wanted element.
+// Failed elements get their error recorded, and are dispatched
+// again once their backoff is over.
+func (e *EthManager) settle(wantedItem *db.WantFromDevp2p, value string, err error) {
+	kind, key := wantedItem.Kind, wantedItem.Key
+
+	// whatever happens, it is not in flight anymore
+	defer e.qm.removeQuery(kind, key)
 
-	value, err := e.rpcCall(kind, key)
 	if err != nil {
-		log.Printf("Error on RPC Call (%v) (%v)", kind, key)
+		log.Printf("Error fetching (%v) (%v): %v", kind, key, err)
+
+		if e.workCtx.Err() != nil {
+			// we are shutting down, let another instance take it
+			e.releaseWanted(kind, key)
+			return
+		}
+
+		metrics.Dispatched.WithLabelValues(kind, "failure").Inc()
+		e.failedWanted(wantedItem, err)
 		return
 	}
 
-	if err = e.processEthData(kind, key, value); err != nil {
-		log.Printf("Error on Eth Data processing (%v) (%v)", kind, key)
+	if err = e.processEthData(kind, key, value, wantedItem.Priority); err != nil {
+		log.Printf("Error on Eth Data processing (%v) (%v): %v", kind, key, err)
+		metrics.Dispatched.WithLabelValues(kind, "failure").Inc()
+		e.failedWanted(wantedItem, err)
 		return
 	}
 
-	// we good?
-	// remove the kind/key from the manager
-	e.qm.removeQuery(qmKey)
+	metrics.Dispatched.WithLabelValues(kind, "success").Inc()
 
 	// write the sucess timestamp into the DB
 	_, err = e.dbMap.Exec(
@@ -118,25 +254,48 @@ func (e *EthManager) dispatcher(kind, key string) {
 		time.Now().UnixNano())
 	if err != nil {
 		log.Printf("Erorr updating success_ts in (%v) (%v)", kind, key)
+		metrics.DBError("update_success_ts", err)
 	}
 }
 
-// rpcCall switches by kind to get the data from the ethereum client
-func (e *EthManager) rpcCall(kind, key string) (string, error) {
-	// DEBUG
-	log.Printf("DEBUG: Invoking the calls for %v %v", kind, key)
-	// DEBUG
-
-	return "", nil
+// releaseWanted gives back a claimed element to the wanted list
+func (e *EthManager) releaseWanted(kind, key string) {
+	if _, err := e.dbMap.Exec(releaseWantedSQLQuery, kind, key); err != nil {
+		log.Printf("Error releasing wanted element (%v) (%v): %v", kind, key, err)
+		metrics.DBError("release_wanted", err)
+	}
 }
 
-// processEthDAta switches by kind of element to store the
-// obtained content in the DB, for further processing.
-// (i.e. making it available to IPFS)
-func (e *EthManager) processEthData(kind, key, value string) error {
-	// DEBUG
-	log.Printf("DEBUG: Processing the result for %v %v", kind, key)
-	// DEBUG
+// failedWanted records the error of a wanted element,
+// moving it to the dead letters if it ran out of attempts
+func (e *EthManager) failedWanted(wantedItem *db.WantFromDevp2p, failure error) {
+	lastError := failure.Error()
+	if len(lastError) > MAX_ERROR_LENGTH {
+		lastError = lastError[:MAX_ERROR_LENGTH]
+	}
 
-	return nil
+	deadTS, err := e.dbMap.SelectNullInt(
+		failedWantedSQLQuery,
+		wantedItem.Kind,
+		wantedItem.Key,
+		lastError,
+		e.maxAttempts,
+		time.Now().UnixNano())
+	if err == sql.ErrNoRows {
+		// someone else got it in the meantime
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording the failure of (%v) (%v): %v",
+			wantedItem.Kind, wantedItem.Key, err)
+		metrics.DBError("failed_wanted", err)
+		return
+	}
+
+	if deadTS.Valid && deadTS.Int64 > 0 {
+		metrics.Dispatched.WithLabelValues(wantedItem.Kind, "dead").Inc()
+		log.Printf("Giving up on (%v) (%v) after %v attempts: %v",
+			wantedItem.Kind, wantedItem.Key, wantedItem.Attempts, lastError)
+		e.Forget(wantedItem.Kind, wantedItem.Key)
+	}
 }
@@ -0,0 +1,41 @@
+package eth
+
+import (
+	"testing"
+
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+)
+
+func TestClaimLeavesInFlightOut(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+
+	e := NewManager(&Config{
+		EthJsonRPCs: []string{rpcServer.URL},
+		MaxQueries:  4,
+		BatchSize:   1,
+	}, fake.DbMap)
+
+	e.dispatchKind(KindTrace, PriorityBackfill)
+
+	// the traces of block 7 take longer than their backoff
+	e.qm.addQuery(KindTrace, "7")
+	e.qm.addQuery(KindBlockBody, "8")
+	e.dispatchKind(KindTrace, PriorityBackfill)
+
+	claims := fake.Executed(wantedElementsSQLQuery)
+	if len(claims) != 2 {
+		t.Fatalf("got %d claims, expected 2", len(claims))
+	}
+	for i, expected := range []string{`{}`, `{"7"}`} {
+		if inFlight := claims[i].Args[6]; inFlight != expected {
+			t.Errorf("claim %v left out %v, expected %v", i, inFlight, expected)
+		}
+		if priority := claims[i].Args[5]; priority != int64(PriorityBackfill) {
+			t.Errorf("claim %v from priority %v, expected %v", i, priority, PriorityBackfill)
+		}
+	}
+}
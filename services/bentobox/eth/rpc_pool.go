@@ -0,0 +1,439 @@
+package eth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Policies to decide the chain head out of the upstreams answers
+const (
+	// the highest block a quorum of upstreams reached, and agree on
+	HeadPolicyQuorum = "quorum"
+	// the head with the median number among the upstreams
+	HeadPolicyMedian = "median"
+)
+
+const (
+	// consecutive failures before we stop sending queries to an upstream
+	upstreamMaxFailures = 3
+	// how long an upstream is left aside, multiplied by its failures
+	upstreamDownTime = 10 * time.Second
+	// latency we assume for upstreams we didn't measure yet
+	upstreamDefaultLatency = 100 * time.Millisecond
+)
+
+// upstream is an ethereum client JSON RPC endpoint, and its health
+type upstream struct {
+	url string
+
+	lock      sync.Mutex
+	latency   time.Duration // moving average of the successful queries
+	failures  int           // consecutive failures
+	downUntil time.Time     // when we can try it again
+}
+
+// rpcPool spreads the queries among several upstreams, favoring
+// the faster ones and failing over the unhealthy ones.
+type rpcPool struct {
+	upstreams  []*upstream
+	headPolicy string
+	headQuorum int
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+// newRPCPool sets up the pool. A quorum of zero or less
+// means the majority of the upstreams.
+func newRPCPool(urls []string, headPolicy string, headQuorum int) *rpcPool {
+	p := &rpcPool{
+		headPolicy: headPolicy,
+		headQuorum: headQuorum,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, url := range urls {
+		p.upstreams = append(p.upstreams, &upstream{
+			url:     url,
+			latency: upstreamDefaultLatency,
+		})
+	}
+
+	if p.headQuorum <= 0 {
+		p.headQuorum = len(p.upstreams)/2 + 1
+	}
+
+	return p
+}
+
+// rawQuery sends the query to an upstream, failing over
+// the rest of them until one gives us an answer.
+// The upstreams to avoid are tried last, if at all.
+// Returns the upstream that answered.
+func (p *rpcPool) rawQuery(ctx context.Context, query *rpcQuery, avoid map[string]bool) (string, *upstream, error) {
+	var err error
+
+	tried := p.avoided(avoid)
+	for len(tried) < len(p.upstreams) {
+		u := p.pick(tried)
+		tried[u] = true
+
+		var value string
+		value, err = p.queryAt(ctx, u, query)
+		if err == nil {
+			return value, u, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return "", nil, err
+}
+
+// rawBatchQuery sends the queries in a single batch request to an upstream,
+// failing over the rest of them until one answers the batch.
+// The upstreams to avoid are tried last, if at all.
+// Single queries may still fail, see their errors.
+// Returns the upstream that answered.
+func (p *rpcPool) rawBatchQuery(ctx context.Context, queries []*rpcQuery,
+	avoid map[string]bool) ([]string, []error, *upstream, error) {
+	var err error
+
+	tried := p.avoided(avoid)
+	for len(tried) < len(p.upstreams) {
+		u := p.pick(tried)
+		tried[u] = true
+
+		start := time.Now()
+		values, errs, batchErr := rawBatchQueryAt(ctx, u.url, queries)
+		if batchErr == nil {
+			u.success(time.Since(start))
+			return values, errs, u, nil
+		}
+		err = batchErr
+
+		if ctx.Err() != nil {
+			break
+		}
+		u.failure()
+	}
+
+	return nil, nil, nil, err
+}
+
+// avoided returns the upstreams with the given URLs, to be taken as
+// already tried. If that leaves none to try, we avoid none of them.
+func (p *rpcPool) avoided(avoid map[string]bool) map[*upstream]bool {
+	tried := make(map[*upstream]bool)
+	for _, u := range p.upstreams {
+		if avoid[u.url] {
+			tried[u] = true
+		}
+	}
+
+	if len(tried) == len(p.upstreams) {
+		return make(map[*upstream]bool)
+	}
+
+	return tried
+}
+
+// latestHead asks every healthy upstream for its latest block,
+// and decides the chain head according to the configured policy,
+// so a single lagging (or lying) upstream can't fool us.
+func (p *rpcPool) latestHead(ctx context.Context) (*chainHead, error) {
+	candidates := p.healthy()
+
+	heads := make([]*chainHead, len(candidates))
+	var wg sync.WaitGroup
+	for i, u := range candidates {
+		wg.Add(1)
+		go func(i int, u *upstream) {
+			defer wg.Done()
+
+			value, err := p.queryAt(ctx, u, newRPCQuery("eth_getBlockByNumber", "latest", false))
+			if err != nil {
+				log.Printf("Error requesting the last block to %v: %v", u.url, err)
+				return
+			}
+
+			head, err := parseChainHead(value)
+			if err != nil {
+				log.Printf("Error requesting the last block to %v: %v", u.url, err)
+				return
+			}
+			heads[i] = head
+		}(i, u)
+	}
+	wg.Wait()
+
+	answers := []*chainHead{}
+	for _, head := range heads {
+		if head != nil {
+			answers = append(answers, head)
+		}
+	}
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("no upstream answered with its last block")
+	}
+
+	switch p.headPolicy {
+	case HeadPolicyMedian:
+		return medianHead(answers), nil
+	default:
+		// upstreams ahead of the rest still count at the height the rest are
+		height, err := quorumHeight(answers, p.headQuorum)
+		if err != nil {
+			return nil, err
+		}
+		return quorumHead(p.headsAt(ctx, candidates, heads, height), p.headQuorum)
+	}
+}
+
+// quorumHeight returns the highest number at least "quorum" upstreams
+// have reached, whatever the blocks they have there
+func quorumHeight(answers []*chainHead, quorum int) (hexutil.Uint64, error) {
+	if len(answers) < quorum {
+		return 0, fmt.Errorf("only %v upstreams answered with their last block, "+
+			"short of a quorum of %v", len(answers), quorum)
+	}
+
+	numbers := make([]hexutil.Uint64, len(answers))
+	for i, head := range answers {
+		numbers[i] = head.Number
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] > numbers[j]
+	})
+
+	return numbers[quorum-1], nil
+}
+
+// quorumHead returns the head at least "quorum" upstreams agree on,
+// out of their blocks at the same height. The most voted one wins,
+// should a low quorum let several of them reach it.
+func quorumHead(answers []*chainHead, quorum int) (*chainHead, error) {
+	votes := make(map[common.Hash]int)
+	var best *chainHead
+
+	for _, head := range answers {
+		votes[head.Hash]++
+	}
+	for _, head := range answers {
+		if votes[head.Hash] < quorum {
+			continue
+		}
+		if best == nil || votes[head.Hash] > votes[best.Hash] {
+			best = head
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("upstreams don't reach a quorum of %v on the last block", quorum)
+	}
+
+	return best, nil
+}
+
+// headsAt returns the blocks at the given height of the upstreams that
+// reached it, out of their latest heads. The ones past it are asked for
+// their block at that height.
+func (p *rpcPool) headsAt(ctx context.Context, upstreams []*upstream, heads []*chainHead,
+	number hexutil.Uint64) []*chainHead {
+	atHeight := make([]*chainHead, len(upstreams))
+
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		if heads[i] == nil || heads[i].Number < number {
+			continue
+		}
+		if heads[i].Number == number {
+			atHeight[i] = heads[i]
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, u *upstream) {
+			defer wg.Done()
+
+			value, err := p.queryAt(ctx, u, newRPCQuery("eth_getBlockByNumber", number.String(), false))
+			if err != nil {
+				log.Printf("Error requesting block %v to %v: %v", uint64(number), u.url, err)
+				return
+			}
+
+			head, err := parseChainHead(value)
+			if err != nil {
+				log.Printf("Error requesting block %v to %v: %v", uint64(number), u.url, err)
+				return
+			}
+			if head.Number != number {
+				log.Printf("Asked %v for block %v, got %v", u.url, uint64(number), uint64(head.Number))
+				return
+			}
+			atHeight[i] = head
+		}(i, u)
+	}
+	wg.Wait()
+
+	answers := []*chainHead{}
+	for _, head := range atHeight {
+		if head != nil {
+			answers = append(answers, head)
+		}
+	}
+
+	return answers
+}
+
+// medianHead returns the head with the median number.
+// With an even number of answers we stay on the lower side.
+func medianHead(answers []*chainHead) *chainHead {
+	sort.Slice(answers, func(i, j int) bool {
+		return answers[i].Number < answers[j].Number
+	})
+
+	return answers[(len(answers)-1)/2]
+}
+
+// queryAt sends the query to the given upstream, keeping its health up to date.
+// Errors given by a working client (i.e. unknown element) don't count as failures.
+func (p *rpcPool) queryAt(ctx context.Context, u *upstream, query *rpcQuery) (string, error) {
+	start := time.Now()
+	value, err := rawQueryAt(ctx, u.url, query)
+
+	switch err.(type) {
+	case nil, *ethRPCError:
+		u.success(time.Since(start))
+	default:
+		if err == errResultNotFound {
+			u.success(time.Since(start))
+		} else if ctx.Err() == nil {
+			u.failure()
+		}
+	}
+
+	return value, err
+}
+
+// healthy returns the upstreams we can send queries to.
+// If all of them are down, we return them all, better than nothing.
+func (p *rpcPool) healthy() []*upstream {
+	now := time.Now()
+
+	healthy := []*upstream{}
+	for _, u := range p.upstreams {
+		if u.isHealthy(now) {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return p.upstreams
+	}
+
+	return healthy
+}
+
+// pick chooses one of the upstreams not yet tried, at random,
+// weighting them by the inverse of their latency.
+// Healthy upstreams are picked before the unhealthy ones.
+func (p *rpcPool) pick(tried map[*upstream]bool) *upstream {
+	now := time.Now()
+
+	candidates := []*upstream{}
+	for _, u := range p.upstreams {
+		if !tried[u] && u.isHealthy(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range p.upstreams {
+			if !tried[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, u := range candidates {
+		weights[i] = 1 / u.getLatency().Seconds()
+		total += weights[i]
+	}
+
+	p.randLock.Lock()
+	r := p.rand.Float64() * total
+	p.randLock.Unlock()
+
+	for i, u := range candidates {
+		r -= weights[i]
+		if r <= 0 {
+			return u
+		}
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// isHealthy tells whether we can send queries to this upstream
+func (u *upstream) isHealthy(now time.Time) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return now.After(u.downUntil)
+}
+
+// getLatency returns the moving average of the upstream latency
+func (u *upstream) getLatency() time.Duration {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.latency < time.Millisecond {
+		return time.Millisecond
+	}
+	return u.latency
+}
+
+// success records a query answered by the upstream
+func (u *upstream) success(latency time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.failures >= upstreamMaxFailures {
+		log.Printf("Upstream %v is back", u.url)
+	}
+
+	u.failures = 0
+	u.downUntil = time.Time{}
+	u.latency = (7*u.latency + 3*latency) / 10
+}
+
+// failure records a query the upstream couldn't answer,
+// leaving it aside after too many of them in a row
+func (u *upstream) failure() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.failures++
+	if u.failures >= upstreamMaxFailures {
+		downTime := time.Duration(u.failures-upstreamMaxFailures+1) * upstreamDownTime
+		if downTime > 10*upstreamDownTime {
+			downTime = 10 * upstreamDownTime
+		}
+		u.downUntil = time.Now().Add(downTime)
+
+		log.Printf("Upstream %v is down after %v failures, retrying in %v",
+			u.url, u.failures, downTime)
+	}
+}
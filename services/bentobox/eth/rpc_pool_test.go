@@ -0,0 +1,154 @@
+package eth
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+)
+
+func TestQuorumHeight(t *testing.T) {
+	heads := []*chainHead{testHead(9), testHead(11), testHead(10), testHead(10)}
+
+	for quorum, expected := range map[int]uint64{1: 11, 2: 10, 3: 10, 4: 9} {
+		height, err := quorumHeight(heads, quorum)
+		if err != nil || uint64(height) != expected {
+			t.Errorf("quorum %v: got %v (%v), expected %v", quorum, height, err, expected)
+		}
+	}
+
+	if _, err := quorumHeight(heads, 5); err == nil {
+		t.Errorf("quorum of 5 reached with 4 answers")
+	}
+}
+
+// latestHeadOf asks upstreams whose latest blocks are the given ones
+// for the chain head, under the quorum policy
+func latestHeadOf(t *testing.T, latest []*chainHead, quorum int) (*chainHead, error) {
+	urls := []string{}
+	for _, head := range latest {
+		rpcServer := fakerpc.NewServer()
+		t.Cleanup(rpcServer.Close)
+
+		respondHeads(rpcServer, uint64(head.Number))
+		if head.Hash != testHead(uint64(head.Number)).Hash {
+			// on a fork of its own
+			rpcServer.Respond("eth_getBlockByNumber", head)
+		}
+		urls = append(urls, rpcServer.URL)
+	}
+
+	return newRPCPool(urls, HeadPolicyQuorum, quorum).latestHead(context.Background())
+}
+
+func TestLatestHeadLaggingUpstream(t *testing.T) {
+	// one upstream behind, another one ahead
+	head, err := latestHeadOf(t, []*chainHead{testHead(9), testHead(10), testHead(11)}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *head != *testHead(10) {
+		t.Errorf("got head %v %v, expected 10", head.Number, head.Hash.Hex())
+	}
+}
+
+func TestLatestHeadFork(t *testing.T) {
+	forked := testHead(10)
+	forked.Hash = common.HexToHash("0xf0")
+
+	if head, err := latestHeadOf(t, []*chainHead{testHead(10), forked}, 2); err == nil {
+		t.Errorf("got head %v %v, expected no quorum", head.Number, head.Hash.Hex())
+	}
+
+	// the rest outvote it
+	head, err := latestHeadOf(t, []*chainHead{testHead(10), forked, testHead(11)}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *head != *testHead(10) {
+		t.Errorf("got head %v %v, expected 10", head.Number, head.Hash.Hex())
+	}
+}
+
+// followedChain answers the queries of LastBlockLoop as the database would,
+// the last head being the last one stored, and the test chain up to it canonical
+func followedChain() fakedb.RowsFunc {
+	var last []driver.Value
+
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, "INSERT INTO lastblock"):
+			last = []driver.Value{args[1], args[2], int64(0)}
+		case query == lastBlockSQLQuery && last != nil:
+			return []string{"number_id", "hash", "inserted_ts"}, [][]driver.Value{last}
+		case query == canonicalBlockSQLQuery && last != nil && args[0].(int64) <= last[0].(int64):
+			head := testHead(uint64(args[0].(int64)))
+			return []string{"number_id", "hash", "parent_hash", "inserted_ts"},
+				[][]driver.Value{{args[0], head.Hash.Hex(), head.ParentHash.Hex(), int64(0)}}
+		}
+		return nil, nil
+	}
+}
+
+func TestHeadUpstreamGone(t *testing.T) {
+	for _, policy := range []string{HeadPolicyQuorum, HeadPolicyMedian} {
+		fake := fakedb.NewDB()
+		fake.Respond(followedChain())
+
+		urls := []string{}
+		upstreams := []*fakerpc.Server{}
+		for _, latest := range []uint64{10, 10, 9} {
+			rpcServer := fakerpc.NewServer()
+			respondHeads(rpcServer, latest)
+			urls = append(urls, rpcServer.URL)
+			upstreams = append(upstreams, rpcServer)
+		}
+
+		e := NewManager(&Config{
+			EthJsonRPCs:   urls,
+			HeadPolicy:    policy,
+			HeadQuorum:    2,
+			PollInterval:  1,
+			MaxQueries:    1,
+			MaxReorgDepth: 10,
+		}, fake.DbMap)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			e.LastBlockLoop(ctx)
+		}()
+
+		waitStoredHeads(t, fake, 1)
+
+		// the rest decide on 9 now
+		upstreams[0].Close()
+		head, err := e.pool.latestHead(context.Background())
+		if err != nil || head.Number != 9 {
+			t.Errorf("%v: got head %v (%v) with an upstream gone, expected 9", policy, head, err)
+		}
+		time.Sleep(1500 * time.Millisecond)
+
+		cancel()
+		<-done
+		for _, rpcServer := range upstreams[1:] {
+			rpcServer.Close()
+		}
+		fake.Close()
+
+		if numbers := storedHeads(fake); fmt.Sprint(numbers) != "[10]" {
+			t.Errorf("%v: got heads %v stored, expected [10]", policy, numbers)
+		}
+		if orphaned := orphanedHeaders(fake); len(orphaned) != 0 {
+			t.Errorf("%v: orphaned %v, expected none", policy, orphaned)
+		}
+	}
+}
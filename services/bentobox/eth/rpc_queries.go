@@ -1,42 +1,314 @@
 package eth
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
 )
 
-// getNetworkHeight will send an eth_blockNumber request and
-// parse its results
-func (e *EthManager) getNetworkHeight() (response int64, err error) {
-	body := `{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":42}`
-	target := ethBlockNumber{}
-	if err = requestAndParseJSON(e.ethJsonRPC, body, &target); err != nil {
-		log.Printf("Query Error: %v", err)
-		return -1, err
+// errResultNotFound is returned when the node answers with a null result,
+// meaning it does not have (yet) the requested element
+var errResultNotFound = errors.New("json rpc result not found")
+
+// errMissingResponse is returned when the node didn't answer
+// one of the requests of a batch
+var errMissingResponse = errors.New("json rpc batch response missing")
+
+// getLatestHead will send an eth_getBlockByNumber request for the latest
+// block, without transactions, to every upstream, and decide the chain head
+// out of their answers
+func (e *EthManager) getLatestHead(ctx context.Context) (*chainHead, error) {
+	return e.pool.latestHead(ctx)
+}
+
+// NetworkHead returns the number and hash of the chain head,
+// as the ethereum clients see it now
+func (e *EthManager) NetworkHead(ctx context.Context) (int64, string, error) {
+	head, err := e.getLatestHead(ctx)
+	if err != nil {
+		return 0, "", err
 	}
 
-	response, err = strconv.ParseInt(target.Result[2:], 16, 0)
+	return int64(head.Number), head.Hash.Hex(), nil
+}
+
+// getHeadByHash will send an eth_getBlockByHash request, without
+// transactions, and parse the fields we need to follow the chain
+func (e *EthManager) getHeadByHash(ctx context.Context, hash common.Hash) (*chainHead, error) {
+	value, err := e.rawQuery(ctx, "eth_getBlockByHash", hash.Hex(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseChainHead(value)
+}
+
+// getHeadByNumber will send an eth_getBlockByNumber request, without
+// transactions, and parse the fields we need to follow the chain
+func (e *EthManager) getHeadByNumber(ctx context.Context, number uint64) (*chainHead, error) {
+	value, err := e.rawQuery(ctx, "eth_getBlockByNumber", fmt.Sprintf("0x%x", number), false)
 	if err != nil {
-		log.Printf("Parse Error: %v", err)
-		return -1, err
+		return nil, err
 	}
 
-	// won't log non error responses as this is a very frequent query
-	return
+	return parseChainHead(value)
+}
+
+// parseChainHead parses the result of a block query into a chainHead
+func parseChainHead(value string) (*chainHead, error) {
+	head := &chainHead{}
+	if err := json.Unmarshal([]byte(value), head); err != nil {
+		return nil, fmt.Errorf("invalid block: %v", err)
+	}
+
+	return head, nil
+}
+
+// blockByNumberQuery builds an eth_getBlockByNumber request, asking
+// for the full transaction objects.
+// The key is the block number in base 10.
+func blockByNumberQuery(key string) (*rpcQuery, error) {
+	number, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block number %v: %v", key, err)
+	}
+
+	return newRPCQuery("eth_getBlockByNumber", fmt.Sprintf("0x%x", number), true), nil
+}
+
+// transactionReceiptQuery builds an eth_getTransactionReceipt request.
+// The key is the transaction hash.
+func transactionReceiptQuery(key string) (*rpcQuery, error) {
+	return newRPCQuery("eth_getTransactionReceipt", key), nil
+}
+
+// uncleByBlockHashAndIndexQuery builds an eth_getUncleByBlockHashAndIndex
+// request. The key is the block hash and the uncle index, as in "<hash>:<index>".
+func uncleByBlockHashAndIndexQuery(key string) (*rpcQuery, error) {
+	blockHash, index, err := splitUncleKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRPCQuery("eth_getUncleByBlockHashAndIndex", blockHash, fmt.Sprintf("0x%x", index)), nil
+}
+
+// blockRlpQuery builds a debug_getBlockRlp request.
+// Only go-ethereum exposes this method, other clients will answer
+// with an error. The key is the block number in base 10.
+func blockRlpQuery(key string) (*rpcQuery, error) {
+	number, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block number %v: %v", key, err)
+	}
+
+	return newRPCQuery("debug_getBlockRlp", number), nil
+}
+
+// sliceKeysQuery builds a debug_getSliceKeys request, only found
+// in our patched geth (see misc/geth-20180817.diff).
+// The key is "<state root>:<path>:<depth>".
+func sliceKeysQuery(key string) (*rpcQuery, error) {
+	slice, err := splitStateSliceKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRPCQuery("debug_getSliceKeys", slice.Path, slice.Depth, slice.StateRoot.Hex()), nil
+}
+
+// levelDbKeyQuery builds a debug_getLevelDbKey request, only found in our
+// patched geth, to get a trie node out of its database.
+// The key is the hash of the node.
+func levelDbKeyQuery(key string) (*rpcQuery, error) {
+	return newRPCQuery("debug_getLevelDbKey", key), nil
+}
+
+// traceBlockQuery builds a debug_traceBlockByNumber request, with the
+// callTracer of go-ethereum, giving the tracer the timeout on every
+// transaction. The block as a whole can take way longer than the usual
+// queries, so we wait for it up to the request timeout.
+// The key is the block number in base 10.
+func traceBlockQuery(key string, timeout, requestTimeout time.Duration) (*rpcQuery, error) {
+	number, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block number %v: %v", key, err)
+	}
+
+	query := newRPCQuery("debug_traceBlockByNumber", fmt.Sprintf("0x%x", number), map[string]string{
+		"tracer":  "callTracer",
+		"timeout": timeout.String(),
+	})
+	query.timeout = requestTimeout
+
+	return query, nil
+}
+
+// rawQuery sends a JSON RPC request to one of the ethereum clients,
+// and returns the result as it came, without further parsing.
+func (e *EthManager) rawQuery(ctx context.Context, method string, params ...interface{}) (string, error) {
+	value, _, err := e.pool.rawQuery(ctx, newRPCQuery(method, params...), nil)
+	return value, err
 }
 
-// requestAndParseJSON is a helper to send RPC Queries
-func requestAndParseJSON(url, body string, target interface{}) error {
+// rawQueryAt sends a JSON RPC request to the given ethereum client
+// and returns the result as it came.
+func rawQueryAt(ctx context.Context, url string, query *rpcQuery) (string, error) {
+	body, err := json.Marshal(query.request(42))
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.RPCDuration.WithLabelValues(query.method, "false").
+			Observe(time.Since(start).Seconds())
+	}()
+
+	target := ethRawResult{}
+	if err = requestAndParseJSON(ctx, url, string(body), query.timeout, &target); err != nil {
+		return "", err
+	}
+
+	return target.value()
+}
+
+// rawBatchQueryAt sends a JSON RPC batch request to the given ethereum
+// client, and returns the results as they came, in the order of the queries.
+// Errors of single queries are returned apart from the error of the
+// whole batch, as some may succeed while others not.
+func rawBatchQueryAt(ctx context.Context, url string, queries []*rpcQuery) ([]string, []error, error) {
+	requests := make([]ethRequest, len(queries))
+	for i, query := range queries {
+		requests[i] = query.request(i)
+	}
+
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.RPCDuration.WithLabelValues(batchMethod(queries), "true").
+			Observe(time.Since(start).Seconds())
+	}()
+
+	target := []ethRawResult{}
+	if err = requestAndParseJSON(ctx, url, string(body), batchTimeout(queries), &target); err != nil {
+		return nil, nil, err
+	}
+
+	// responses may come in any order, we map them back by id
+	values := make([]string, len(queries))
+	errs := make([]error, len(queries))
+	for i := range errs {
+		errs[i] = errMissingResponse
+	}
+	for _, result := range target {
+		if result.ID < 0 || result.ID >= len(queries) {
+			continue
+		}
+		values[result.ID], errs[result.ID] = result.value()
+	}
+
+	return values, errs, nil
+}
+
+// batchMethod is the method of the queries of a batch,
+// or "mixed" when they are not all the same
+func batchMethod(queries []*rpcQuery) string {
+	for _, query := range queries[1:] {
+		if query.method != queries[0].method {
+			return "mixed"
+		}
+	}
+
+	return queries[0].method
+}
+
+// batchTimeout is the longest timeout of the queries of a batch,
+// zero (the default) when none of them has one
+func batchTimeout(queries []*rpcQuery) time.Duration {
+	timeout := time.Duration(0)
+	for _, query := range queries {
+		if query.timeout > timeout {
+			timeout = query.timeout
+		}
+	}
+
+	return timeout
+}
+
+// rpcQuery is a JSON RPC method and its params
+type rpcQuery struct {
+	method string
+	params []interface{}
+
+	// how long we wait for the answer, RPC_TIMEOUT when zero
+	timeout time.Duration
+}
+
+// newRPCQuery builds the query of a method
+func newRPCQuery(method string, params ...interface{}) *rpcQuery {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	return &rpcQuery{
+		method: method,
+		params: params,
+	}
+}
+
+// request builds the JSON RPC request body of the query
+func (q *rpcQuery) request(id int) ethRequest {
+	return ethRequest{
+		JSONRPC: "2.0",
+		Method:  q.method,
+		Params:  q.params,
+		ID:      id,
+	}
+}
+
+// splitUncleKey parses the "<hash>:<index>" key of the uncle kind
+func splitUncleKey(key string) (string, uint64, error) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid uncle key %v", key)
+	}
+
+	index, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid uncle index in key %v: %v", key, err)
+	}
+
+	return parts[0], index, nil
+}
+
+// requestAndParseJSON is a helper to send RPC Queries.
+// The request is aborted after the timeout (RPC_TIMEOUT when zero),
+// or as soon as the context is done.
+func requestAndParseJSON(ctx context.Context, url, body string, timeout time.Duration, target interface{}) error {
+	if timeout == 0 {
+		timeout = RPC_TIMEOUT
+	}
 	client := &http.Client{
-		Timeout: RPC_TIMEOUT,
+		Timeout: timeout,
 	}
 	request, err := http.NewRequest("POST", url, strings.NewReader(body))
 	if err != nil {
 		return err
 	}
+	request = request.WithContext(ctx)
 	defer request.Body.Close()
 	request.Header.Add("Content-Type", "application/json")
 
@@ -45,6 +317,7 @@ func requestAndParseJSON(url, body string, target interface{}) error {
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 
 	return json.NewDecoder(response.Body).Decode(target)
 }
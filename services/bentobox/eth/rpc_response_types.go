@@ -1,10 +1,83 @@
 package eth
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//
+// The fields of a block we need to follow the chain, as received
+// from eth_getBlockByNumber and eth_getBlockByHash
+//
+////////////////////////////////////////////////////////////////////////////////
+type chainHead struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+	StateRoot  common.Hash    `json:"stateRoot"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//
+// The keys of a state slice, as received from debug_getSliceKeys.
+// Keys are hex without the 0x prefix, the ones of the slice grouped by depth.
+//
+////////////////////////////////////////////////////////////////////////////////
+type sliceKeys struct {
+	SliceID string     `json:"slice-id"`
+	Stem    []string   `json:"stem"`
+	State   [][]string `json:"state"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//
+// Generic envelope of the responses.
+// We keep the result raw, as we store it as it comes.
+//
+////////////////////////////////////////////////////////////////////////////////
+type ethRawResult struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *ethRPCError    `json:"error"`
+}
+
+// value returns the result, or why we didn't get one
+func (r *ethRawResult) value() (string, error) {
+	if r.Error != nil {
+		return "", r.Error
+	}
+
+	if len(r.Result) == 0 || bytes.Equal(r.Result, []byte("null")) {
+		return "", errResultNotFound
+	}
+
+	return string(r.Result), nil
+}
+
+// ethRPCError is the error object of a JSON RPC response
+type ethRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface
+func (e *ethRPCError) Error() string {
+	return fmt.Sprintf("json rpc error %v: %v", e.Code, e.Message)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 //
-// Type needed to receive eth_blockNumber
+// Request body of a JSON RPC call
 //
 ////////////////////////////////////////////////////////////////////////////////
-type ethBlockNumber struct {
-	Result string `json:"result"`
+type ethRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      int           `json:"id"`
 }
@@ -0,0 +1,326 @@
+package eth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+)
+
+// StateSlice is a part of the state trie we take from every chain head:
+// the nodes below Path (hex nibbles from the root, as in "0a"),
+// Depth levels down, along with the stem from the root to them
+type StateSlice struct {
+	Path  string
+	Depth int
+}
+
+// ParseStateSlices parses a list of "path:depth" slices,
+// separated by commas
+func ParseStateSlices(value string) ([]StateSlice, error) {
+	slices := []StateSlice{}
+
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		slice, err := parseStateSlice(pair)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, *slice)
+	}
+
+	return slices, nil
+}
+
+// parseStateSlice parses a "path:depth" slice
+func parseStateSlice(value string) (*StateSlice, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid state slice %v, expected path:depth", value)
+	}
+
+	path := strings.ToLower(parts[0])
+	if path == "" || strings.Trim(path, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("invalid state slice path %v, expected hex nibbles", parts[0])
+	}
+
+	depth, err := strconv.Atoi(parts[1])
+	if err != nil || depth < 0 {
+		return nil, fmt.Errorf("invalid state slice depth %v", parts[1])
+	}
+
+	return &StateSlice{Path: path, Depth: depth}, nil
+}
+
+// stateSliceKey is the slice of the state trie with the given root
+type stateSliceKey struct {
+	StateSlice
+	StateRoot common.Hash
+}
+
+// String returns the "<state root>:<path>:<depth>" key of the slice
+func (k *stateSliceKey) String() string {
+	return fmt.Sprintf("%v:%v:%d", k.StateRoot.Hex(), k.Path, k.Depth)
+}
+
+// splitStateSliceKey parses the "<state root>:<path>:<depth>" key
+// of the state_slice kind
+func splitStateSliceKey(key string) (*stateSliceKey, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid state slice key %v", key)
+	}
+
+	slice, err := parseStateSlice(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &stateSliceKey{StateSlice: *slice, StateRoot: common.HexToHash(parts[0])}, nil
+}
+
+// wantStateSlices adds to the wanted list the configured
+// slices of the given state root
+func (e *EthManager) wantStateSlices(stateRoot common.Hash, priority int) error {
+	if len(e.stateSlices) == 0 || stateRoot == (common.Hash{}) {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+
+	rows := []interface{}{}
+	for _, slice := range e.stateSlices {
+		key := &stateSliceKey{StateSlice: slice, StateRoot: stateRoot}
+
+		rows = append(rows, &db.WantFromDevp2p{
+			InsertedTS: now,
+			Kind:       KindStateSlice,
+			Key:        key.String(),
+			Priority:   priority,
+		})
+	}
+
+	return db.Upsert(e.dbMap, rows...)
+}
+
+// processStateSlice adds to the wanted list the nodes
+// of the obtained slice keys, and of its stem
+func (e *EthManager) processStateSlice(value string, priority int) error {
+	slice := sliceKeys{}
+	if err := json.Unmarshal([]byte(value), &slice); err != nil {
+		return fmt.Errorf("invalid state slice: %v", err)
+	}
+
+	keys := append([]string{}, slice.Stem...)
+	for _, level := range slice.State {
+		keys = append(keys, level...)
+	}
+
+	now := time.Now().UnixNano()
+
+	rows := []interface{}{}
+	for _, key := range keys {
+		rows = append(rows, &db.WantFromDevp2p{
+			InsertedTS: now,
+			Kind:       KindStateTrie,
+			Key:        common.HexToHash(key).Hex(),
+			Priority:   childPriority(priority),
+		})
+	}
+
+	return e.upsertAll("want_state_slice", rows...)
+}
+
+// processStateTrie stores the obtained state trie node. When it is the
+// leaf of a contract account, the root of its storage trie is wanted.
+func (e *EthManager) processStateTrie(key, value string, priority int) error {
+	node, err := trieNodeValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	nodeData, err := newEthData(KindStateTrie, common.HexToHash(key), rlp.RawValue(node))
+	if err != nil {
+		return err
+	}
+
+	rows := []interface{}{nodeData}
+
+	leaf, err := trieLeafValue(node)
+	if err != nil {
+		return err
+	}
+	if leaf != nil {
+		account := stateAccount{}
+		if err := rlp.DecodeBytes(leaf, &account); err != nil {
+			return fmt.Errorf("invalid account in state trie node %v: %v", key, err)
+		}
+
+		if account.Root != types.EmptyRootHash {
+			rows = append(rows, &db.WantFromDevp2p{
+				InsertedTS: time.Now().UnixNano(),
+				Kind:       KindStorageTrie,
+				Key:        account.Root.Hex(),
+				Priority:   childPriority(priority),
+			})
+		}
+	}
+
+	return e.upsertAll("store_state_trie", rows...)
+}
+
+// processStorageTrie stores the obtained storage trie node,
+// and wants the nodes below it, so we get the whole storage
+func (e *EthManager) processStorageTrie(key, value string, priority int) error {
+	node, err := trieNodeValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	nodeData, err := newEthData(KindStorageTrie, common.HexToHash(key), rlp.RawValue(node))
+	if err != nil {
+		return err
+	}
+
+	children, err := trieNodeChildren(node)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+
+	rows := []interface{}{nodeData}
+	for _, child := range children {
+		rows = append(rows, &db.WantFromDevp2p{
+			InsertedTS: now,
+			Kind:       KindStorageTrie,
+			Key:        child.Hex(),
+			Priority:   childPriority(priority),
+		})
+	}
+
+	return e.upsertAll("store_storage_trie", rows...)
+}
+
+// stateAccount is the value of the leaves of the state trie
+type stateAccount struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// trieNodeValue decodes the hex of a trie node, as debug_getLevelDbKey
+// (without the 0x prefix) or the devp2p fetcher (with it) give it,
+// once we know it is the one we asked for
+func trieNodeValue(key, value string) ([]byte, error) {
+	var nodeHex string
+	if err := json.Unmarshal([]byte(value), &nodeHex); err != nil {
+		return nil, fmt.Errorf("invalid trie node: %v", err)
+	}
+
+	node, err := hex.DecodeString(strings.TrimPrefix(nodeHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trie node: %v", err)
+	}
+
+	if hash := crypto.Keccak256Hash(node); hash != common.HexToHash(key) {
+		return nil, fmt.Errorf("trie node %v has hash %v", key, hash.Hex())
+	}
+
+	return node, nil
+}
+
+// trieNodeChildren returns the hashes of the nodes a trie node points to.
+// Children smaller than a hash are embedded in their parent,
+// and have no children of their own.
+func trieNodeChildren(node []byte) ([]common.Hash, error) {
+	var items []rlp.RawValue
+	if err := rlp.DecodeBytes(node, &items); err != nil {
+		return nil, fmt.Errorf("invalid trie node: %v", err)
+	}
+
+	var refs []rlp.RawValue
+	switch len(items) {
+	case 17:
+		// branch: 16 children and a value
+		refs = items[:16]
+	case 2:
+		// extension: a path and a child; leaf: a path and a value
+		isLeaf, err := isLeafPath(items[0])
+		if err != nil {
+			return nil, err
+		}
+		if !isLeaf {
+			refs = items[1:]
+		}
+	default:
+		return nil, fmt.Errorf("invalid trie node with %d items", len(items))
+	}
+
+	children := []common.Hash{}
+	for _, ref := range refs {
+		kind, content, _, err := rlp.Split(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trie node: %v", err)
+		}
+		if kind == rlp.String && len(content) == common.HashLength {
+			children = append(children, common.BytesToHash(content))
+		}
+	}
+
+	return children, nil
+}
+
+// trieLeafValue returns the value of a leaf node,
+// or nil if the node is not a leaf
+func trieLeafValue(node []byte) ([]byte, error) {
+	var items []rlp.RawValue
+	if err := rlp.DecodeBytes(node, &items); err != nil {
+		return nil, fmt.Errorf("invalid trie node: %v", err)
+	}
+
+	if len(items) != 2 {
+		return nil, nil
+	}
+
+	isLeaf, err := isLeafPath(items[0])
+	if err != nil || !isLeaf {
+		return nil, err
+	}
+
+	var value []byte
+	if err := rlp.DecodeBytes(items[1], &value); err != nil {
+		return nil, fmt.Errorf("invalid trie leaf: %v", err)
+	}
+
+	return value, nil
+}
+
+// isLeafPath tells whether the compact encoded path of a
+// two items node belongs to a leaf (or to an extension)
+func isLeafPath(item rlp.RawValue) (bool, error) {
+	var path []byte
+	if err := rlp.DecodeBytes(item, &path); err != nil {
+		return false, fmt.Errorf("invalid trie node path: %v", err)
+	}
+	if len(path) == 0 {
+		return false, fmt.Errorf("empty trie node path")
+	}
+
+	// the first nibble is the flag: 0 and 1 for extensions, 2 and 3 for leaves
+	return path[0]>>4 >= 2, nil
+}
@@ -0,0 +1,224 @@
+package eth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The canonical block header with the given number
+const traceBlockSQLQuery = `
+SELECT hash
+FROM ethdata
+WHERE
+	kind = 'block_header'
+	AND
+	number_id = $1
+	AND
+	NOT orphaned
+ORDER BY inserted_ts DESC
+LIMIT 1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The transactions of a block, in order, with their value
+//   (the hex of their RLP) unless pruned
+const traceBlockTxsSQLQuery = `
+SELECT blocktx.tx_id AS tx_id, blocktx.tx_index AS tx_index, tx.value AS value, tx.pruned_ts AS pruned_ts
+FROM blocktx
+JOIN ethdata tx ON tx.kind = 'transaction' AND tx.hash = blocktx.tx_id
+WHERE blocktx.block_id = $1
+ORDER BY blocktx.tx_index;
+`
+
+// traceBlockTx is a transaction of the block we trace
+type traceBlockTx struct {
+	TxId     string `db:"tx_id"`
+	TxIndex  int64  `db:"tx_index"`
+	Value    string `db:"value"`
+	PrunedTS int64  `db:"pruned_ts"`
+}
+
+// txTraceResult is an element of the debug_traceBlockByNumber response,
+// the trace of a transaction of the block, in order, or why it failed
+type txTraceResult struct {
+	Result *callFrame `json:"result"`
+	Error  string     `json:"error"`
+}
+
+// callFrame is a call as the callTracer gives it, with the calls it made.
+// The value is missing in the calls that can't carry one (i.e. DELEGATECALL)
+type callFrame struct {
+	Type  string       `json:"type"`
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Value string       `json:"value"`
+	Error string       `json:"error"`
+	Calls []*callFrame `json:"calls"`
+}
+
+// processTrace stores the call trees of the transactions of a block,
+// flattened into the traces table. The traces are matched against the
+// canonical block we stored with that number, which must be there with
+// its transactions, so a trace of a block replaced since (or not stored
+// yet) fails and is retried later. Failed traces of single transactions
+// (i.e. the tracer timed out) fail the whole block as well.
+func (e *EthManager) processTrace(key, value string) error {
+	number, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid block number %v: %v", key, err)
+	}
+
+	results := []*txTraceResult{}
+	if err := json.Unmarshal([]byte(value), &results); err != nil {
+		return fmt.Errorf("invalid traces of block %v: %v", number, err)
+	}
+
+	blockHash, err := e.dbMap.SelectStr(traceBlockSQLQuery, number)
+	if err != nil {
+		metrics.DBError("trace_block", err)
+		return err
+	}
+	if blockHash == "" {
+		return fmt.Errorf("can't store the traces of block %v, not stored yet", number)
+	}
+
+	var txs []*traceBlockTx
+	if _, err := e.dbMap.Select(&txs, traceBlockTxsSQLQuery, blockHash); err != nil {
+		metrics.DBError("trace_block_txs", err)
+		return err
+	}
+	if len(txs) != len(results) {
+		return fmt.Errorf("got %d traces for the %d transactions of block %v %v",
+			len(results), len(txs), number, blockHash)
+	}
+
+	now := time.Now().UnixNano()
+	rows := []interface{}{}
+	for i, result := range results {
+		tx := txs[i]
+		if tx.TxIndex != int64(i) {
+			return fmt.Errorf("position of the transactions of block %v %v unknown, "+
+				"want the block again", number, blockHash)
+		}
+		if result.Error != "" {
+			return fmt.Errorf("tracing transaction %v failed: %v", tx.TxId, result.Error)
+		}
+		if result.Result == nil {
+			return fmt.Errorf("trace of transaction %v missing", tx.TxId)
+		}
+		if err := checkTopCall(tx, result.Result); err != nil {
+			return err
+		}
+
+		rows, err = flattenCalls(result.Result, []string{}, db.Trace{
+			BlockHash:  blockHash,
+			NumberId:   number,
+			TxHash:     tx.TxId,
+			TxIndex:    tx.TxIndex,
+			InsertedTS: now,
+		}, rows)
+		if err != nil {
+			return fmt.Errorf("invalid trace of transaction %v: %v", tx.TxId, err)
+		}
+	}
+
+	return e.upsertAll("store_traces", rows...)
+}
+
+// checkTopCall makes sure the top call of a trace is the transaction
+// we stored at its position, so we don't take the traces of another
+// block with the same number (i.e. the upstream is on another fork).
+// Transactions already pruned can't be checked.
+func checkTopCall(tx *traceBlockTx, call *callFrame) error {
+	if tx.PrunedTS > 0 {
+		return nil
+	}
+
+	txRLP, err := hex.DecodeString(tx.Value)
+	if err != nil {
+		return fmt.Errorf("invalid transaction %v: %v", tx.TxId, err)
+	}
+	stored := new(types.Transaction)
+	if err := rlp.DecodeBytes(txRLP, stored); err != nil {
+		return fmt.Errorf("invalid transaction %v: %v", tx.TxId, err)
+	}
+
+	value, err := callValue(call.Value)
+	if err != nil {
+		return fmt.Errorf("invalid trace of transaction %v: %v", tx.TxId, err)
+	}
+
+	matches := value.Cmp(stored.Value()) == 0
+	if stored.To() != nil {
+		matches = matches && common.HexToAddress(call.To) == *stored.To()
+	}
+	if !matches {
+		return fmt.Errorf("trace of transaction %v doesn't match it, "+
+			"the upstream may be on another fork", tx.TxId)
+	}
+
+	return nil
+}
+
+// flattenCalls appends the call, and the ones it made, depth first,
+// as traces tuples of the given transaction. The path is the position
+// of the call in the tree, empty for the top one.
+func flattenCalls(call *callFrame, path []string, tx db.Trace, rows []interface{}) ([]interface{}, error) {
+	value, err := callValue(call.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := tx
+	trace.TraceAddress = strings.Join(path, ",")
+	trace.Depth = int64(len(path))
+	trace.Type = call.Type
+	trace.FromAddress = common.HexToAddress(call.From).Hex()
+	if call.To != "" {
+		trace.ToAddress = common.HexToAddress(call.To).Hex()
+	}
+	trace.Value = value.String()
+	trace.Error = call.Error
+
+	rows = append(rows, &trace)
+
+	for i, child := range call.Calls {
+		childPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+		if rows, err = flattenCalls(child, childPath, tx, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+// callValue parses the wei a call carries, in hex,
+// being zero when it has none
+func callValue(value string) (*big.Int, error) {
+	digits := strings.TrimPrefix(value, "0x")
+	if digits == "" {
+		return new(big.Int), nil
+	}
+
+	wei, ok := new(big.Int).SetString(digits, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid call value %v", value)
+	}
+
+	return wei, nil
+}
@@ -0,0 +1,271 @@
+package eth
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+)
+
+// fixtureTxs are the transactions of the block of a debug_traceBlockByNumber
+// fixture, as we store them, made out of the top calls of their traces
+func fixtureTxs(t *testing.T, fixture string) []*traceBlockTx {
+	txs := []*traceBlockTx{}
+	for i, result := range fixtureResults(t, fixture) {
+		to, value := common.Address{}, new(big.Int)
+		if result.Result != nil {
+			to = common.HexToAddress(result.Result.To)
+			value, _ = callValue(result.Result.Value)
+		}
+
+		txRLP, err := rlp.EncodeToBytes(types.NewTransaction(uint64(i), to, value, 21000, big.NewInt(1), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txs = append(txs, &traceBlockTx{
+			TxId:    fmt.Sprintf("0x%064x", i+1),
+			TxIndex: int64(i),
+			Value:   hex.EncodeToString(txRLP),
+		})
+	}
+
+	return txs
+}
+
+// fixtureResults parses a debug_traceBlockByNumber fixture
+func fixtureResults(t *testing.T, fixture string) []*txTraceResult {
+	results := []*txTraceResult{}
+	if err := json.Unmarshal([]byte(fixture), &results); err != nil {
+		t.Fatal(err)
+	}
+
+	return results
+}
+
+// storedTraceBlock answers the queries of processTrace
+// as if the block of the fixture was stored
+func storedTraceBlock(txs []*traceBlockTx) fakedb.RowsFunc {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch query {
+		case traceBlockSQLQuery:
+			return []string{"hash"}, [][]driver.Value{{"0xb10c"}}
+		case traceBlockTxsSQLQuery:
+			rows := [][]driver.Value{}
+			for _, tx := range txs {
+				rows = append(rows, []driver.Value{tx.TxId, tx.TxIndex, tx.Value, tx.PrunedTS})
+			}
+			return []string{"tx_id", "tx_index", "value", "pruned_ts"}, rows
+		}
+		return nil, nil
+	}
+}
+
+// expectedTrace is a row of the traces table, as we check it
+type expectedTrace struct {
+	traceAddress string
+	depth        int64
+	kind         string
+	to           string
+	value        string
+	err          string
+}
+
+// the calls of the second transaction of the fixture, flattened
+var fixtureTraces = []expectedTrace{
+	{"", 0, "CALL", "0x3333333333333333333333333333333333333333", "10000000000000000", ""},
+	{"0", 1, "CALL", "0x4444444444444444444444444444444444444444", "10000000000000000", ""},
+	{"1", 1, "DELEGATECALL", "0x5555555555555555555555555555555555555555", "0", ""},
+	{"1,0", 2, "CALL", "0x6666666666666666666666666666666666666666", "1", "execution reverted"},
+}
+
+func TestFlattenCalls(t *testing.T) {
+	results := fixtureResults(t, fakerpc.TraceBlockFixture)
+
+	rows, err := flattenCalls(results[1].Result, []string{}, db.Trace{TxHash: "0x02", TxIndex: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(fixtureTraces) {
+		t.Fatalf("got %d traces, expected %d", len(rows), len(fixtureTraces))
+	}
+
+	for i, row := range rows {
+		trace := row.(*db.Trace)
+		got := expectedTrace{trace.TraceAddress, trace.Depth, trace.Type, trace.ToAddress, trace.Value, trace.Error}
+		if got != fixtureTraces[i] {
+			t.Errorf("got trace %+v, expected %+v", got, fixtureTraces[i])
+		}
+		if trace.TxHash != "0x02" || trace.TxIndex != 1 {
+			t.Errorf("trace %v of transaction %v %v, expected 0x02 1", i, trace.TxHash, trace.TxIndex)
+		}
+		if trace.FromAddress == "" {
+			t.Errorf("trace %v without its caller", i)
+		}
+	}
+}
+
+func TestCallValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", "0"},
+		{"0x", "0"},
+		{"0x0", "0"},
+		{"0x1", "1"},
+		{"0xde0b6b3a7640000", "1000000000000000000"},
+		{"0xzz", ""},
+	}
+
+	for _, test := range tests {
+		value, err := callValue(test.value)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil || value.String() != test.expected {
+			t.Errorf("%q: got %v (%v), expected %v", test.value, value, err, test.expected)
+		}
+	}
+}
+
+func TestCheckTopCall(t *testing.T) {
+	txs := fixtureTxs(t, fakerpc.TraceBlockFixture)
+	results := fixtureResults(t, fakerpc.TraceBlockFixture)
+
+	for i := range txs {
+		if err := checkTopCall(txs[i], results[i].Result); err != nil {
+			t.Errorf("transaction %v: unexpected error %v", i, err)
+		}
+	}
+
+	// the traces of another block with the same number
+	if err := checkTopCall(txs[0], results[1].Result); err == nil {
+		t.Errorf("trace of another transaction taken")
+	}
+
+	// pruned transactions can't be checked
+	pruned := *txs[0]
+	pruned.Value = ""
+	pruned.PrunedTS = 1
+	if err := checkTopCall(&pruned, results[1].Result); err != nil {
+		t.Errorf("pruned transaction: unexpected error %v", err)
+	}
+
+	invalid := *txs[0]
+	invalid.Value = "0xzz"
+	if err := checkTopCall(&invalid, results[0].Result); err == nil {
+		t.Errorf("invalid transaction taken")
+	}
+}
+
+// fetchTrace asks the fake JSON RPC for the traces of a block, through the rpcFetcher
+func fetchTrace(rpcServer *fakerpc.Server, dbMap *fakedb.DB, requestTimeout time.Duration) (string, error) {
+	pool := newRPCPool([]string{rpcServer.URL}, "", 0)
+	f := newRPCFetcher(pool, dbMap.DbMap, 5*time.Second, requestTimeout)
+
+	values, errs := f.Fetch(context.Background(), []*db.WantFromDevp2p{{Kind: KindTrace, Key: "7"}})
+	return values[0], errs[0]
+}
+
+func TestTraceBlock(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	fake.Respond(storedTraceBlock(fixtureTxs(t, fakerpc.TraceBlockFixture)))
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	rpcServer.RespondByBlock("debug_traceBlockByNumber", map[uint64]string{7: fakerpc.TraceBlockFixture})
+
+	value, err := fetchTrace(rpcServer, fake, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := rpcServer.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("got %d requests, expected 1", len(calls))
+	}
+	params := fmt.Sprintf("%s %s", calls[0].Params[0], calls[0].Params[1])
+	if params != `"0x7" {"timeout":"5s","tracer":"callTracer"}` {
+		t.Errorf("traced with %v", params)
+	}
+
+	e := &EthManager{dbMap: fake.DbMap}
+	if err := e.processTrace("7", value); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transfer, then the calls of the second transaction
+	expected := append([]expectedTrace{
+		{"", 0, "CALL", "0x2222222222222222222222222222222222222222", "1000000000000000000", ""},
+	}, fixtureTraces...)
+
+	stored := fake.Executed("INSERT INTO traces")
+	if len(stored) != len(expected) {
+		t.Fatalf("got %d traces stored, expected %d", len(stored), len(expected))
+	}
+	for i, statement := range stored {
+		args := statement.Args
+		got := expectedTrace{args[4].(string), args[5].(int64), args[6].(string),
+			args[8].(string), args[9].(string), args[10].(string)}
+		if got != expected[i] {
+			t.Errorf("stored trace %+v, expected %+v", got, expected[i])
+		}
+		if args[0] != "0xb10c" || args[1] != int64(7) {
+			t.Errorf("stored trace of block %v %v, expected 7 0xb10c", args[1], args[0])
+		}
+	}
+}
+
+func TestTraceTimeoutFailsBlock(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	fake.Respond(storedTraceBlock(fixtureTxs(t, fakerpc.TraceTimeoutFixture)))
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	rpcServer.RespondByBlock("debug_traceBlockByNumber", map[uint64]string{7: fakerpc.TraceTimeoutFixture})
+
+	value, err := fetchTrace(rpcServer, fake, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first transaction was traced, but we store none of the block
+	e := &EthManager{dbMap: fake.DbMap}
+	err = e.processTrace("7", value)
+	if err == nil || !strings.Contains(err.Error(), "execution timeout") {
+		t.Fatalf("got error %v, expected the one of the tracer", err)
+	}
+	if stored := fake.Executed("INSERT INTO traces"); len(stored) != 0 {
+		t.Errorf("got %d traces stored, expected none", len(stored))
+	}
+}
+
+func TestTraceRequestTimeout(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	rpcServer := fakerpc.NewServer()
+	defer rpcServer.Close()
+	rpcServer.RespondByBlock("debug_traceBlockByNumber", map[uint64]string{7: fakerpc.TraceBlockFixture})
+	rpcServer.Delay(time.Second)
+
+	if _, err := fetchTrace(rpcServer, fake, 100*time.Millisecond); err == nil {
+		t.Errorf("expected the request to time out")
+	}
+}
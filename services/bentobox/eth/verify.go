@@ -0,0 +1,141 @@
+package eth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// IntegrityError is returned for the elements whose data doesn't match
+// the hashes it must match, so they aren't stored, and are asked
+// to another upstream
+type IntegrityError struct {
+	Upstream string
+	Reason   string
+}
+
+// Error implements the error interface
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed on the answer of %v: %v", e.Upstream, e.Reason)
+}
+
+// verifyValue checks the value of a wanted element, as the JSON RPC
+// gives it, against the hashes it must match. Returns why it doesn't.
+// The receipts need the rest of their block, see rpcFetcher.verifyReceipts().
+func verifyValue(kind, key, value string) error {
+	switch kind {
+	case KindBlockBody:
+		header, _, err := verifyBlockBody(value)
+		if err != nil {
+			return err
+		}
+		return verifyBlockNumber(key, header)
+
+	case KindBlockRLP:
+		block, err := parseBlockRLP(value)
+		if err != nil {
+			return err
+		}
+		if err := checkBody(block.Header(), block.Body()); err != nil {
+			return err
+		}
+		return verifyBlockNumber(key, block.Header())
+
+	case KindUncle:
+		// the uncle hash of its block is checked by the rpcFetcher
+		_, err := verifyHeader(value)
+		return err
+
+	case KindStateTrie, KindStorageTrie:
+		_, err := trieNodeValue(key, value)
+		return err
+	}
+
+	// the rest have no hashes to check
+	return nil
+}
+
+// verifyHeader recomputes the hash of a block (or uncle) header,
+// out of its fields, and checks it is the one it comes with
+func verifyHeader(value string) (*types.Header, error) {
+	header := new(types.Header)
+	if err := json.Unmarshal([]byte(value), header); err != nil {
+		return nil, fmt.Errorf("invalid block header: %v", err)
+	}
+
+	claimed := chainHead{}
+	if err := json.Unmarshal([]byte(value), &claimed); err != nil {
+		return nil, fmt.Errorf("invalid block header: %v", err)
+	}
+
+	if hash := header.Hash(); hash != claimed.Hash {
+		return nil, fmt.Errorf("block %v has hash %v", claimed.Hash.Hex(), hash.Hex())
+	}
+
+	return header, nil
+}
+
+// verifyBlockBody checks the header of a block with its full transactions,
+// and rebuilds the trie of the latter to compare it against its root.
+// The uncles come as hashes only, so here we can only check whether there
+// should be any; the rpcFetcher checks them against the uncle hash of the
+// header, along with the uncle headers (see rpcFetcher.verifyUncles()).
+func verifyBlockBody(value string) (*types.Header, types.Transactions, error) {
+	header, err := verifyHeader(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := rpcBlock{}
+	if err := json.Unmarshal([]byte(value), &body); err != nil {
+		return nil, nil, fmt.Errorf("invalid block body: %v", err)
+	}
+
+	txs := types.Transactions(body.Transactions)
+	if types.DeriveSha(txs) != header.TxHash {
+		return nil, nil, fmt.Errorf("transactions of block %v don't match its root", header.Hash().Hex())
+	}
+	if (len(body.Uncles) == 0) != (header.UncleHash == types.EmptyUncleHash) {
+		return nil, nil, fmt.Errorf("uncles of block %v don't match its hash", header.Hash().Hex())
+	}
+
+	return header, txs, nil
+}
+
+// verifyBlockNumber checks the block is the one with the number we asked for
+func verifyBlockNumber(key string, header *types.Header) error {
+	number, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid block number %v: %v", key, err)
+	}
+
+	if header.Number == nil || !header.Number.IsUint64() || header.Number.Uint64() != number {
+		return fmt.Errorf("block %v has number %v, expected %v", header.Hash().Hex(), header.Number, number)
+	}
+
+	return nil
+}
+
+// verifyReceiptsRoot rebuilds the trie of the receipts of a block,
+// in the order of its transactions, to compare it against its root
+func verifyReceiptsRoot(header *types.Header, receipts types.Receipts) error {
+	if types.DeriveSha(receipts) != header.ReceiptHash {
+		return fmt.Errorf("receipts of block %v don't match its root", header.Hash().Hex())
+	}
+
+	return nil
+}
+
+// upstreamLabel is the host of an upstream URL, so we don't
+// leak its credentials (if any) into the metrics
+func upstreamLabel(upstreamURL string) string {
+	parsed, err := url.Parse(upstreamURL)
+	if err != nil || parsed.Host == "" {
+		return "unknown"
+	}
+
+	return parsed.Host
+}
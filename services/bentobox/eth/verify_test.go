@@ -0,0 +1,286 @@
+package eth
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/bentobox/fakerpc"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// testKey signs the transactions of the test blocks
+var testKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+
+// testTx is a transfer signed with testKey
+func testTx(t *testing.T, nonce uint64) *types.Transaction {
+	tx := types.NewTransaction(nonce, common.HexToAddress("0x2222"), big.NewInt(int64(nonce+1)), 21000, big.NewInt(1), nil)
+	signed, err := types.SignTx(tx, types.HomesteadSigner{}, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+// testHeader is a header of the given number, told apart by its extra data
+func testHeader(number int64, extra string) *types.Header {
+	return &types.Header{
+		Number:     big.NewInt(number),
+		Difficulty: big.NewInt(1),
+		Time:       big.NewInt(1),
+		GasLimit:   8000000,
+		Extra:      []byte(extra),
+	}
+}
+
+// testBlock is a block of two transfers and an uncle,
+// with everything matching its header
+type testBlock struct {
+	header   *types.Header
+	txs      types.Transactions
+	receipts types.Receipts
+	uncles   []*types.Header
+}
+
+func newTestBlock(t *testing.T) *testBlock {
+	b := &testBlock{uncles: []*types.Header{testHeader(6, "uncle")}}
+
+	for i := 0; i < 2; i++ {
+		tx := testTx(t, uint64(i))
+		receipt := types.NewReceipt(nil, false, uint64(21000*(i+1)))
+		receipt.TxHash = tx.Hash()
+		receipt.GasUsed = 21000
+		receipt.Logs = []*types.Log{}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+		b.txs = append(b.txs, tx)
+		b.receipts = append(b.receipts, receipt)
+	}
+
+	b.header = testHeader(7, "block")
+	b.header.GasUsed = 42000
+	b.header.TxHash = types.DeriveSha(b.txs)
+	b.header.ReceiptHash = types.DeriveSha(b.receipts)
+	b.header.UncleHash = types.CalcUncleHash(b.uncles)
+
+	return b
+}
+
+// jsonFields marshals a value into the fields of a JSON object
+func jsonFields(t *testing.T, value interface{}) map[string]interface{} {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	return fields
+}
+
+// marshalFields is the JSON of the given fields
+func marshalFields(t *testing.T, fields map[string]interface{}) string {
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(encoded)
+}
+
+// blockJSON is the block as eth_getBlockByNumber gives it,
+// with its full transactions and the hashes of its uncles
+func blockJSON(t *testing.T, header *types.Header, txs types.Transactions, uncles []*types.Header) string {
+	fields := jsonFields(t, header)
+	fields["transactions"] = txs
+
+	hashes := []common.Hash{}
+	for _, uncle := range uncles {
+		hashes = append(hashes, uncle.Hash())
+	}
+	fields["uncles"] = hashes
+
+	return marshalFields(t, fields)
+}
+
+// receiptsJSON are the receipts as eth_getTransactionReceipt gives them, by transaction
+func receiptsJSON(t *testing.T, header *types.Header, receipts types.Receipts) map[common.Hash]string {
+	values := make(map[common.Hash]string)
+	for _, receipt := range receipts {
+		fields := jsonFields(t, receipt)
+		fields["blockHash"] = header.Hash()
+		fields["blockNumber"] = (*hexutil.Big)(header.Number)
+		values[receipt.TxHash] = marshalFields(t, fields)
+	}
+
+	return values
+}
+
+// serveBlock answers the methods the rpcFetcher asks for a block, its
+// uncles and receipts with, with the given values whatever is asked
+func serveBlock(rpcServer *fakerpc.Server, block string, uncles []*types.Header, receipts map[common.Hash]string) {
+	rpcServer.Respond("eth_getBlockByNumber", block)
+	rpcServer.Respond("eth_getBlockByHash", block)
+	rpcServer.Handle("eth_getUncleByBlockHashAndIndex", func(params []json.RawMessage) (interface{}, *fakerpc.Error) {
+		var index hexutil.Uint64
+		if err := json.Unmarshal(params[1], &index); err != nil || int(index) >= len(uncles) {
+			return nil, nil
+		}
+		return uncles[index], nil
+	})
+	rpcServer.Handle("eth_getTransactionReceipt", func(params []json.RawMessage) (interface{}, *fakerpc.Error) {
+		var txHash common.Hash
+		if err := json.Unmarshal(params[0], &txHash); err != nil || receipts[txHash] == "" {
+			return nil, nil
+		}
+		return json.RawMessage(receipts[txHash]), nil
+	})
+}
+
+func TestVerifyRejects(t *testing.T) {
+	block := newTestBlock(t)
+	good := blockJSON(t, block.header, block.txs, block.uncles)
+	goodReceipts := receiptsJSON(t, block.header, block.receipts)
+
+	tamperedHeader := jsonFields(t, block.header)
+	tamperedHeader["gasUsed"] = "0x1"
+	tamperedHeader["transactions"] = block.txs
+	tamperedHeader["uncles"] = []common.Hash{block.uncles[0].Hash()}
+
+	tamperedReceipt := *block.receipts[0]
+	tamperedReceipt.CumulativeGasUsed = 1
+	badReceipts := receiptsJSON(t, block.header, types.Receipts{&tamperedReceipt, block.receipts[1]})
+
+	otherUncle := testHeader(6, "another uncle")
+
+	tests := []struct {
+		name     string
+		kind     string
+		key      string
+		block    string
+		uncles   []*types.Header
+		receipts map[common.Hash]string
+	}{
+		{
+			name:     "header hash",
+			kind:     KindBlockBody,
+			key:      "7",
+			block:    marshalFields(t, tamperedHeader),
+			uncles:   block.uncles,
+			receipts: goodReceipts,
+		},
+		{
+			name:     "transactions root",
+			kind:     KindBlockBody,
+			key:      "7",
+			block:    blockJSON(t, block.header, types.Transactions{block.txs[0], testTx(t, 9)}, block.uncles),
+			uncles:   block.uncles,
+			receipts: goodReceipts,
+		},
+		{
+			name:     "receipts root",
+			kind:     KindTxReceipt,
+			key:      block.txs[0].Hash().Hex(),
+			block:    good,
+			uncles:   block.uncles,
+			receipts: badReceipts,
+		},
+		{
+			name:     "uncle hash",
+			kind:     KindBlockBody,
+			key:      "7",
+			block:    blockJSON(t, block.header, block.txs, []*types.Header{otherUncle}),
+			uncles:   []*types.Header{otherUncle},
+			receipts: goodReceipts,
+		},
+	}
+
+	for _, test := range tests {
+		fake := fakedb.NewDB()
+		fake.Respond(func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+			if query == txBlockSQLQuery {
+				return []string{"block_id"}, [][]driver.Value{{block.header.Hash().Hex()}}
+			}
+			return nil, nil
+		})
+		bad := fakerpc.NewServer()
+		serveBlock(bad, test.block, test.uncles, test.receipts)
+		honest := fakerpc.NewServer()
+		serveBlock(honest, good, block.uncles, goodReceipts)
+
+		e := NewManager(&Config{EthJsonRPCs: []string{bad.URL, honest.URL}, MaxQueries: 1}, fake.DbMap)
+		f := e.fetchers[test.kind].(*rpcFetcher)
+		wanted := []*db.WantFromDevp2p{{Kind: test.kind, Key: test.key}}
+		failures := metrics.IntegrityFailures.WithLabelValues(upstreamLabel(bad.URL), test.kind)
+
+		// the honest one is down, so the bad one is asked first
+		f.pool.upstreams[1].downUntil = time.Now().Add(time.Hour)
+
+		_, errs := f.Fetch(context.Background(), wanted)
+		if _, ok := errs[0].(*IntegrityError); !ok {
+			t.Errorf("%v: got error %v, expected an IntegrityError", test.name, errs[0])
+		}
+		if count := testutil.ToFloat64(failures); count != 1 {
+			t.Errorf("%v: counted %v integrity failures, expected 1", test.name, count)
+		}
+
+		// then back, and the only one asked
+		f.pool.upstreams[1].downUntil = time.Time{}
+		badCalls := len(bad.Calls())
+
+		values, errs := f.Fetch(context.Background(), wanted)
+		if errs[0] != nil || values[0] == "" {
+			t.Errorf("%v: got error %v on the retry, expected the value", test.name, errs[0])
+		}
+		if len(bad.Calls()) != badCalls {
+			t.Errorf("%v: asked the bad upstream again", test.name)
+		}
+		if len(f.distrusted) != 0 {
+			t.Errorf("%v: still distrusting %v once verified", test.name, f.distrusted)
+		}
+
+		bad.Close()
+		honest.Close()
+		fake.Close()
+	}
+}
+
+func TestForgetDeadElement(t *testing.T) {
+	for _, deadTS := range []int64{0, 1} {
+		fake := fakedb.NewDB()
+		fake.Respond(func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+			if query == failedWantedSQLQuery {
+				return []string{"dead_ts"}, [][]driver.Value{{deadTS}}
+			}
+			return nil, nil
+		})
+
+		e := NewManager(&Config{EthJsonRPCs: []string{"http://127.0.0.1:1"}, MaxQueries: 1}, fake.DbMap)
+		f := e.fetchers[KindBlockBody].(*rpcFetcher)
+		f.distrusted[KindBlockBody+":7"] = map[string]bool{"http://127.0.0.1:1": true}
+
+		e.failedWanted(&db.WantFromDevp2p{Kind: KindBlockBody, Key: "7"}, errors.New("rejected"))
+		fake.Close()
+
+		// only the dead ones are forgotten, the rest are still to be retried
+		if forgotten := len(f.distrusted) == 0; forgotten != (deadTS > 0) {
+			t.Errorf("dead_ts %v: distrusting %v", deadTS, f.distrusted)
+		}
+	}
+}
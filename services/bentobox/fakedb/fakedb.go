@@ -0,0 +1,183 @@
+// Package fakedb is a fake database/sql driver, recording the statements
+// it gets and answering the queries out of a handler, to test bentobox
+// without a Postgres behind. Our tables are mapped as db.InitDb does,
+// but nothing is stored: whatever is executed succeeds, and queries
+// return no rows unless the handler gives some.
+package fakedb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+)
+
+// RowsFunc answers a query with its arguments,
+// giving the columns and the rows of the result
+type RowsFunc func(query string, args []driver.Value) ([]string, [][]driver.Value)
+
+// Statement is a statement the database got, and its arguments
+type Statement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// DB is a fake database, reachable through its DbMap until closed
+type DB struct {
+	DbMap *gorp.DbMap
+
+	name string
+
+	lock       sync.Mutex
+	statements []Statement
+	rowsFunc   RowsFunc
+}
+
+// dbs are the open fake databases, by data source name
+var (
+	dbs     sync.Map
+	dbCount int64
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// NewDB opens an empty fake database
+func NewDB() *DB {
+	d := &DB{
+		name: fmt.Sprintf("fakedb-%d", atomic.AddInt64(&dbCount, 1)),
+	}
+	dbs.Store(d.name, d)
+
+	// only fails when the driver is not registered
+	sqlDB, _ := sql.Open("fakedb", d.name)
+	d.DbMap = &gorp.DbMap{Db: sqlDB, Dialect: gorp.PostgresDialect{}}
+	db.AddTables(d.DbMap)
+
+	return d
+}
+
+// Close closes the database
+func (d *DB) Close() {
+	d.DbMap.Db.Close()
+	dbs.Delete(d.name)
+}
+
+// Respond sets the handler answering the queries
+func (d *DB) Respond(rowsFunc RowsFunc) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.rowsFunc = rowsFunc
+}
+
+// Statements returns the statements the database got so far, in order
+func (d *DB) Statements() []Statement {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]Statement{}, d.statements...)
+}
+
+// Executed returns the statements run so far whose query contains
+// the given SQL, as a whole query or the "INSERT INTO table" of it
+func (d *DB) Executed(sql string) []Statement {
+	statements := []Statement{}
+	for _, statement := range d.Statements() {
+		if strings.Contains(statement.Query, sql) {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+// run records a statement, answering it when it is a query
+func (d *DB) run(query string, args []driver.Value) ([]string, [][]driver.Value) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.statements = append(d.statements, Statement{Query: query, Args: args})
+	if d.rowsFunc == nil {
+		return nil, nil
+	}
+
+	return d.rowsFunc(query, args)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	d, ok := dbs.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown fakedb %v", name)
+	}
+
+	return &fakeConn{db: d.(*DB)}, nil
+}
+
+type fakeConn struct {
+	db *DB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *DB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.run(s.query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns, rows := s.db.run(s.query, args)
+	if columns == nil {
+		// whatever the query selects, there is nothing
+		columns = []string{"value"}
+	}
+
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+
+	return nil
+}
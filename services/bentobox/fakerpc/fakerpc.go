@@ -0,0 +1,216 @@
+// Package fakerpc is a fake ethereum JSON RPC, answering the methods
+// out of canned results, to run bentobox (or test it) without a client
+// behind. It serves single and batch requests, as the clients do.
+package fakerpc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// HandlerFunc answers a method with its params, giving
+// either the result or the error of the response
+type HandlerFunc func(params []json.RawMessage) (interface{}, *Error)
+
+// Error is the error of a JSON RPC response
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Call is a request the server got
+type Call struct {
+	Method string
+	Params []json.RawMessage
+}
+
+// request is a JSON RPC request
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// response is a JSON RPC response
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Server is the fake JSON RPC, listening on its URL
+// until closed. Unknown methods get an error.
+type Server struct {
+	URL string
+
+	server *httptest.Server
+
+	lock     sync.Mutex
+	handlers map[string]HandlerFunc
+	calls    []Call
+	delay    time.Duration
+}
+
+// NewServer starts a fake JSON RPC with no methods on a local port
+func NewServer() *Server {
+	s := &Server{
+		handlers: make(map[string]HandlerFunc),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+
+	return s
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Handle sets the handler of a method
+func (s *Server) Handle(method string, handler HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[method] = handler
+}
+
+// Respond answers a method with the given result, whatever its params.
+// A string result is taken as the raw JSON of it.
+func (s *Server) Respond(method string, result interface{}) {
+	if raw, ok := result.(string); ok {
+		result = json.RawMessage(raw)
+	}
+
+	s.Handle(method, func([]json.RawMessage) (interface{}, *Error) {
+		return result, nil
+	})
+}
+
+// RespondByBlock answers a method taking a block number (in hex) as its
+// first param, as eth_getBlockByNumber or debug_traceBlockByNumber do,
+// with the raw JSON results by number. Other blocks get a null result.
+func (s *Server) RespondByBlock(method string, results map[uint64]string) {
+	s.Handle(method, func(params []json.RawMessage) (interface{}, *Error) {
+		if len(params) == 0 {
+			return nil, &Error{Code: -32602, Message: "missing block number"}
+		}
+
+		var number hexutil.Uint64
+		if err := json.Unmarshal(params[0], &number); err != nil {
+			return nil, &Error{Code: -32602, Message: err.Error()}
+		}
+
+		result, ok := results[uint64(number)]
+		if !ok {
+			return nil, nil
+		}
+
+		return json.RawMessage(result), nil
+	})
+}
+
+// Fail answers a method with the given error, whatever its params
+func (s *Server) Fail(method string, code int, message string) {
+	s.Handle(method, func([]json.RawMessage) (interface{}, *Error) {
+		return nil, &Error{Code: code, Message: message}
+	})
+}
+
+// Delay holds every response for the given time,
+// as a slow client (i.e. tracing a block) would
+func (s *Server) Delay(delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.delay = delay
+}
+
+// Calls returns the requests the server got so far, in order
+func (s *Server) Calls() []Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Call{}, s.calls...)
+}
+
+// handle answers a request, or a batch of them
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	delay := s.delay
+	s.lock.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	var result interface{}
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		batch := []request{}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		responses := []*response{}
+		for _, req := range batch {
+			responses = append(responses, s.answer(req))
+		}
+		result = responses
+	} else {
+		req := request{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = s.answer(req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// answer runs a request with the handler of its method
+func (s *Server) answer(req request) *response {
+	s.lock.Lock()
+	s.calls = append(s.calls, Call{Method: req.Method, Params: req.Params})
+	handler, ok := s.handlers[req.Method]
+	s.lock.Unlock()
+
+	if !ok {
+		return &response{JSONRPC: "2.0", ID: req.ID, Error: &Error{
+			Code:    -32601,
+			Message: "the method " + req.Method + " does not exist/is not available",
+		}}
+	}
+
+	result, rpcErr := handler(req.Params)
+	if rpcErr != nil {
+		return &response{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+	}
+
+	// a null result must still be there
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+
+	return &response{JSONRPC: "2.0", ID: req.ID, Result: result}
+}
@@ -0,0 +1,85 @@
+package fakerpc
+
+// TraceBlockFixture is what go-ethereum answers to debug_traceBlockByNumber,
+// with the callTracer, for a block of two transactions: a plain transfer,
+// and a call to a contract that moves ETH in its internal calls, one of
+// them reverted, and delegates another one
+const TraceBlockFixture = `[
+	{
+		"result": {
+			"type": "CALL",
+			"from": "0x1111111111111111111111111111111111111111",
+			"to": "0x2222222222222222222222222222222222222222",
+			"value": "0xde0b6b3a7640000",
+			"gas": "0x0",
+			"gasUsed": "0x0",
+			"input": "0x",
+			"output": "0x"
+		}
+	},
+	{
+		"result": {
+			"type": "CALL",
+			"from": "0x1111111111111111111111111111111111111111",
+			"to": "0x3333333333333333333333333333333333333333",
+			"value": "0x2386f26fc10000",
+			"gas": "0x5208",
+			"gasUsed": "0x4e20",
+			"input": "0xa9059cbb",
+			"output": "0x",
+			"calls": [
+				{
+					"type": "CALL",
+					"from": "0x3333333333333333333333333333333333333333",
+					"to": "0x4444444444444444444444444444444444444444",
+					"value": "0x2386f26fc10000",
+					"gas": "0x1388",
+					"gasUsed": "0x0",
+					"input": "0x",
+					"output": "0x"
+				},
+				{
+					"type": "DELEGATECALL",
+					"from": "0x3333333333333333333333333333333333333333",
+					"to": "0x5555555555555555555555555555555555555555",
+					"gas": "0x1388",
+					"gasUsed": "0x3e8",
+					"input": "0x12345678",
+					"output": "0x",
+					"calls": [
+						{
+							"type": "CALL",
+							"from": "0x3333333333333333333333333333333333333333",
+							"to": "0x6666666666666666666666666666666666666666",
+							"value": "0x1",
+							"gas": "0x3e8",
+							"gasUsed": "0x3e8",
+							"input": "0x",
+							"error": "execution reverted"
+						}
+					]
+				}
+			]
+		}
+	}
+]`
+
+// TraceTimeoutFixture is what go-ethereum answers to debug_traceBlockByNumber
+// when the tracer runs out of time on a transaction of the block
+const TraceTimeoutFixture = `[
+	{
+		"result": {
+			"type": "CALL",
+			"from": "0x1111111111111111111111111111111111111111",
+			"to": "0x2222222222222222222222222222222222222222",
+			"value": "0x0",
+			"gas": "0x0",
+			"gasUsed": "0x0",
+			"input": "0x",
+			"output": "0x"
+		}
+	},
+	{
+		"error": "execution timeout"
+	}
+]`
@@ -1,22 +1,95 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/metamask/mustekala/services/bentobox/eth"
+)
 
 const (
-	ETH_RPC_MAX_QUERIES     = 10
-	ETH_RPC_REDO_QUERY_TIME = 5
+	ETH_RPC_MAX_QUERIES       = 10
+	ETH_RPC_BATCH_SIZE        = 20
+	ETH_RPC_RETRY_BACKOFF     = 5
+	ETH_RPC_MAX_RETRY_BACKOFF = 3600
+	ETH_RPC_MAX_ATTEMPTS      = 12
+	IPFS_MAX_QUERIES          = 10
+	IPFS_REDO_QUERY_TIME      = 30
+	IPFS_MAX_RETRIES          = 3
+	IPFS_AUDIT_BATCH_SIZE     = 50
+	IPFS_AUDIT_PERIOD         = 86400
+	SHUTDOWN_TIMEOUT          = 10
+	MAX_REORG_DEPTH           = 64
+	PRIORITY_AGING            = 60
+	PRUNE_AFTER               = 86400
+	PRUNE_BATCH_SIZE          = 100
+	PRUNE_INTERVAL            = 60
+	LEADER_LEASE              = 15
+	TRACE_TIMEOUT             = 5
+	TRACE_REQUEST_TIMEOUT     = 120
 )
 
 // Config has all the options you defined at the command line.
 type Config struct {
-	DbUser              string
-	DbPassword          string
-	DbName              string
-	EthHost             string
-	IpfsHost            string
-	PollInterval        int
-	EthRPCMaxQueries    int
-	EthRPCRedoQueryTime int
+	DbUser                string
+	DbPassword            string
+	DbName                string
+	EthHost               string
+	EthHosts              []string
+	Chain                 string
+	ChainConfig           *params.ChainConfig
+	EthWSHost             string
+	HeadPolicy            string
+	HeadQuorum            int
+	IpfsHost              string
+	MetricsAddr           string
+	AdminAddr             string
+	AdminToken            string
+	EventsAddr            string
+	PollInterval          int
+	EthRPCMaxQueries      int
+	EthRPCBatchSize       int
+	EthRPCKindLimits      string
+	EthRPCKindLimitsMap   map[string]int
+	EthRPCRetryBackoff    int
+	EthRPCMaxRetryBackoff int
+	EthRPCMaxAttempts     int
+	PriorityAging         int
+	IpfsMaxQueries        int
+	IpfsRedoQueryTime     int
+	IpfsMaxRetries        int
+	IpfsAudit             bool
+	IpfsAuditBatchSize    int
+	IpfsAuditPeriod       int
+	ShutdownTimeout       int
+	MaxReorgDepth         int
+	FetchRoutes           string
+	FetchRoutesMap        map[string]string
+	BootnodesPath         string
+	NodeDatabasePath      string
+	DevP2PLibDebug        bool
+	StateSlices           string
+	StateSlicesList       []eth.StateSlice
+	Traces                bool
+	TraceTimeout          int
+	TraceRequestTimeout   int
+	Prune                 bool
+	PruneDryRun           bool
+	PruneAfter            int
+	PruneKeepBlocks       int64
+	PruneKeepKinds        []string
+	PruneBatchSize        int
+	PruneInterval         int
+	LeaderLease           int
+
+	// Command is the subcommand given after the options, if any
+	Command []string
 }
 
 // ParseFlags gets those command line options
@@ -28,14 +101,157 @@ func ParseFlags() *Config {
 	flag.StringVar(&cfg.DbPassword, "dbpassword", "mysecretpassword", "database password")
 	flag.StringVar(&cfg.DbName, "dbname", "bentobox", "database name")
 
-	flag.StringVar(&cfg.EthHost, "eth-host", "http://127.0.0.1:8545", "URL of the ethereum node RPC")
+	flag.StringVar(&cfg.EthHost, "eth-host", "http://127.0.0.1:8545", "URL of the ethereum node RPC, comma separated for several ones")
+	flag.StringVar(&cfg.Chain, "chain", "mainnet", "chain the eth hosts follow: mainnet, ropsten or rinkeby")
+	flag.StringVar(&cfg.EthWSHost, "eth-ws-host", "", "URL of the ethereum node WebSocket RPC, to subscribe to new heads instead of polling")
+	flag.StringVar(&cfg.HeadPolicy, "head-policy", eth.HeadPolicyQuorum, "how to decide the chain head out of several eth hosts: quorum or median")
+	flag.IntVar(&cfg.HeadQuorum, "head-quorum", 0, "eth hosts that must agree on the chain head, 0 for the majority")
 	flag.StringVar(&cfg.IpfsHost, "ipfs-host", "http://127.0.0.1:5001", "URL of the IPFS HTTP API")
+	flag.BoolVar(&cfg.IpfsAudit, "ipfs-audit", false, "check the elements added into IPFS are still there, and pinned")
+	flag.IntVar(&cfg.IpfsAuditBatchSize, "ipfs-audit-batch-size", IPFS_AUDIT_BATCH_SIZE, "elements audited at a time")
+	flag.IntVar(&cfg.IpfsAuditPeriod, "ipfs-audit-period", IPFS_AUDIT_PERIOD, "seconds before an element is audited again")
+
+	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "address to serve the prometheus /metrics on, as in :9100 (disabled when empty)")
+
+	flag.StringVar(&cfg.AdminAddr, "admin-addr", "", "address to serve the admin API on, as in 127.0.0.1:9101 (disabled when empty)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("BENTOBOX_ADMIN_TOKEN"), "token of the admin API, defaults to $BENTOBOX_ADMIN_TOKEN")
+
+	flag.StringVar(&cfg.EventsAddr, "events-addr", "", "address to stream the chain head notifications on, as in :9102 (disabled when empty)")
 
 	flag.IntVar(&cfg.PollInterval, "last-block-polling-interval", 1, "Iteration interval for last block querying")
+	flag.IntVar(&cfg.EthRPCBatchSize, "eth-rpc-batch-size", ETH_RPC_BATCH_SIZE, "queries grouped in a single JSON RPC batch request")
+	flag.StringVar(&cfg.EthRPCKindLimits, "eth-rpc-kind-limits", "", "queries of a kind we can have in flight, as in block_body=50,tx_receipt=150")
+	flag.IntVar(&cfg.EthRPCMaxAttempts, "eth-rpc-max-attempts", ETH_RPC_MAX_ATTEMPTS, "attempts on a wanted element before giving up on it")
+	flag.IntVar(&cfg.PriorityAging, "priority-aging", PRIORITY_AGING, "seconds a wanted element waits to gain a point of priority")
+	flag.IntVar(&cfg.LeaderLease, "leader-lease", LEADER_LEASE, "seconds before a leader gone is replaced by another instance")
+
+	flag.StringVar(&cfg.FetchRoutes, "fetch-routes", "", "fetcher (rpc or devp2p) of a kind, as in tx_receipt=devp2p,block_body=rpc")
+	flag.StringVar(&cfg.BootnodesPath, "devp2p-bootnodes", "", "Location of devp2p bootnodes file, to fetch from the devp2p network")
+	flag.StringVar(&cfg.NodeDatabasePath, "devp2p-nodes-database", "", "Location of the devp2p node database")
+	flag.BoolVar(&cfg.DevP2PLibDebug, "devp2p-lib-debug", false, "set this variable if you really like logs (p2p lib logs)")
+
+	flag.StringVar(&cfg.StateSlices, "state-slices", "", "slices of the state trie to take from every head, as in 0:3,1a:4 (path:depth)")
+
+	flag.BoolVar(&cfg.Traces, "traces", false, "want the call traces of every block, with debug_traceBlockByNumber")
+	flag.IntVar(&cfg.TraceTimeout, "trace-timeout", TRACE_TIMEOUT, "seconds the tracer can take on a transaction")
+	flag.IntVar(&cfg.TraceRequestTimeout, "trace-request-timeout", TRACE_REQUEST_TIMEOUT, "seconds we wait for the traces of a block")
+
+	var pruneKeepKinds string
+	flag.BoolVar(&cfg.Prune, "prune", false, "prune the values of ethdata already in IPFS, as the prune-* options say")
+	flag.BoolVar(&cfg.PruneDryRun, "prune-dry-run", false, "only report what the pruner would prune")
+	flag.IntVar(&cfg.PruneAfter, "prune-after", PRUNE_AFTER, "seconds a value stays once added into IPFS")
+	flag.Int64Var(&cfg.PruneKeepBlocks, "prune-keep-blocks", 0, "blocks, from the head down, kept whole")
+	flag.StringVar(&pruneKeepKinds, "prune-keep-kinds", eth.KindBlockHeader, "kinds kept whole, comma separated")
+	flag.IntVar(&cfg.PruneBatchSize, "prune-batch-size", PRUNE_BATCH_SIZE, "rows pruned at a time")
+
+	flag.Parse()
+
+	for _, host := range strings.Split(cfg.EthHost, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.EthHosts = append(cfg.EthHosts, host)
+		}
+	}
+	if len(cfg.EthHosts) == 0 {
+		log.Fatalf("at least one eth host must be given")
+	}
+
+	chainConfig, err := eth.ChainConfigByName(cfg.Chain)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.ChainConfig = chainConfig
+
+	cfg.EthRPCKindLimitsMap = make(map[string]int)
+	for kind, value := range parseKindPairs(cfg.EthRPCKindLimits, "limit") {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			log.Fatalf("invalid kind limit %v=%v, expected kind=limit", kind, value)
+		}
+		cfg.EthRPCKindLimitsMap[kind] = limit
+	}
+
+	cfg.FetchRoutesMap = parseKindPairs(cfg.FetchRoutes, "fetcher")
+	for kind, fetcher := range cfg.FetchRoutesMap {
+		if fetcher != eth.FetcherRPC && fetcher != eth.FetcherDevp2p {
+			log.Fatalf("unknown fetcher %v for kind %v", fetcher, kind)
+		}
+		if fetcher == eth.FetcherDevp2p && cfg.BootnodesPath == "" {
+			log.Fatalf("fetching %v from devp2p needs the bootnodes file", kind)
+		}
+	}
+
+	stateSlices, err := eth.ParseStateSlices(cfg.StateSlices)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.StateSlicesList = stateSlices
+
+	if cfg.NodeDatabasePath == "" {
+		homeDir := os.Getenv("HOME")
+		cfg.NodeDatabasePath = filepath.Join(homeDir, ".mustekala", "devp2p", "nodes")
+	}
+
+	for _, kind := range strings.Split(pruneKeepKinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			cfg.PruneKeepKinds = append(cfg.PruneKeepKinds, kind)
+		}
+	}
+
+	if cfg.PruneAfter < 0 || cfg.PruneKeepBlocks < 0 {
+		log.Fatalf("the prune options can't be negative")
+	}
+
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" {
+		log.Fatalf("the admin API needs a token")
+	}
+
+	if cfg.LeaderLease < 3 {
+		log.Fatalf("leader lease must be at least 3 seconds")
+	}
+
+	if cfg.TraceTimeout < 1 || cfg.TraceRequestTimeout < 1 {
+		log.Fatalf("trace timeouts must be at least 1 second")
+	}
+
+	if cfg.PriorityAging < 1 {
+		log.Fatalf("priority aging must be at least 1 second")
+	}
+
+	if cfg.HeadPolicy != eth.HeadPolicyQuorum && cfg.HeadPolicy != eth.HeadPolicyMedian {
+		log.Fatalf("unknown head policy %v", cfg.HeadPolicy)
+	}
 
 	// We won't get the values blow from the CLI options
 	cfg.EthRPCMaxQueries = ETH_RPC_MAX_QUERIES
-	cfg.EthRPCRedoQueryTime = ETH_RPC_REDO_QUERY_TIME
+	cfg.EthRPCRetryBackoff = ETH_RPC_RETRY_BACKOFF
+	cfg.EthRPCMaxRetryBackoff = ETH_RPC_MAX_RETRY_BACKOFF
+	cfg.IpfsMaxQueries = IPFS_MAX_QUERIES
+	cfg.IpfsRedoQueryTime = IPFS_REDO_QUERY_TIME
+	cfg.IpfsMaxRetries = IPFS_MAX_RETRIES
+	cfg.ShutdownTimeout = SHUTDOWN_TIMEOUT
+	cfg.MaxReorgDepth = MAX_REORG_DEPTH
+	cfg.PruneInterval = PRUNE_INTERVAL
+
+	cfg.Command = flag.Args()
 
 	return cfg
 }
+
+// parseKindPairs parses a list of "kind=value" pairs, separated by commas
+func parseKindPairs(pairs, what string) map[string]string {
+	values := make(map[string]string)
+
+	for _, pair := range strings.Split(pairs, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		kindValue := strings.SplitN(pair, "=", 2)
+		if len(kindValue) != 2 {
+			log.Fatalf("invalid kind %v %v, expected kind=%v", what, pair, what)
+		}
+		values[kindValue[0]] = kindValue[1]
+	}
+
+	return values
+}
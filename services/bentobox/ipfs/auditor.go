@@ -0,0 +1,316 @@
+package ipfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// IPFS_AUDIT_PAUSE is the time between two batches of the auditor,
+// and IPFS_AUDIT_IDLE_PAUSE the one it waits when there is nothing to audit
+const (
+	IPFS_AUDIT_PAUSE      = time.Duration(1 * time.Second)
+	IPFS_AUDIT_IDLE_PAUSE = time.Duration(30 * time.Second)
+)
+
+// Results of the audit of an element
+const (
+	// it is in IPFS, and pinned
+	auditAvailable = "available"
+	// it is in IPFS, and we pinned it
+	auditRepinned = "repinned"
+	// it is not in IPFS, the loader will add it again
+	auditMissing = "missing"
+	// it is not in IPFS, and it was pruned. We want it again
+	// from the ethereum clients, so the loader can add it then
+	auditRewanted = "rewanted"
+	// it is not in IPFS, it was pruned, and we don't know how to want it
+	auditLost = "lost"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// Same strategy as the not added elements query of the loader.
+// * Selects the elements added into IPFS, not audited in the last
+//   "period", the least recently audited first, locking them
+//   (skipping the ones other auditors have already locked)
+// * Marks them with the time of this audit
+// * Returns what we need to audit them, or to want them again
+const auditedElementsSQLQuery = `
+UPDATE ethdata
+SET ipfs_audit_ts = $1
+WHERE (kind, hash) IN (
+	SELECT kind, hash
+	FROM ethdata
+	WHERE
+		ipfs_success_ts > 0
+		AND
+		$1-ipfs_audit_ts>=$2
+		AND
+		cid <> ''
+	ORDER BY ipfs_audit_ts
+	LIMIT $3
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING kind, hash, cid, orphaned, number_id, pruned_ts;
+`
+
+// resetIPFSSuccessTSSQLQuery hands a missing element back to the loader
+const resetIPFSSuccessTSSQLQuery = `
+UPDATE ethdata
+SET ipfs_success_ts = 0, last_ipfs_add_ts = 0
+WHERE
+	kind = $1
+	AND
+	hash = $2;
+`
+
+// rewantSQLQuery wants an element, asking again for it
+// if it was already wanted, whatever its state
+const rewantSQLQuery = `
+INSERT INTO wantfromdevp2p (inserted_ts, kind, key, last_request_ts, success_ts, priority)
+VALUES ($1, $2, $3, 0, 0, $4)
+ON CONFLICT (kind, key) DO UPDATE
+SET
+	success_ts = 0, last_request_ts = 0,
+	attempts = 0, last_error = '', next_attempt_ts = 0, dead_ts = 0;
+`
+
+// rewantUnclesSQLQuery asks again for the uncles of a block,
+// whose keys are "<block hash>:<index>"
+const rewantUnclesSQLQuery = `
+UPDATE wantfromdevp2p
+SET
+	success_ts = 0, last_request_ts = 0,
+	attempts = 0, last_error = '', next_attempt_ts = 0, dead_ts = 0
+WHERE
+	kind = $1
+	AND
+	key LIKE $2;
+`
+
+const canonicalHeaderSQLQuery = `
+SELECT hash
+FROM ethdata
+WHERE
+	kind = $1
+	AND
+	number_id = $2
+	AND
+	NOT orphaned
+LIMIT 1;
+`
+
+const receiptTxSQLQuery = `
+SELECT tx_id
+FROM txreceipts
+WHERE tx_receipts_id = $1
+LIMIT 1;
+`
+
+// Auditor checks that the elements we added into IPFS
+// are still there, and pinned, so they aren't garbage collected
+type Auditor struct {
+	ipfsHost  string
+	batchSize int
+	period    time.Duration
+	dbMap     *gorp.DbMap
+}
+
+// NewAuditor sets up the auditor of the elements in IPFS. It audits
+// batchSize elements at a time, and every element at most once a period.
+func NewAuditor(ipfsHost string, batchSize int, period time.Duration, dbMap *gorp.DbMap) *Auditor {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &Auditor{
+		ipfsHost:  ipfsHost,
+		batchSize: batchSize,
+		period:    period,
+		dbMap:     dbMap,
+	}
+}
+
+// AuditorLoop sweeps the "ethdata" table, asking the IPFS HTTP API
+// for the elements already added. The ones not pinned get pinned,
+// and the missing ones are handed back to the loader.
+// Returns when the context is done.
+func (a *Auditor) AuditorLoop(ctx context.Context) {
+	log.Printf("Starting AuditorLoop")
+	defer log.Printf("Stopped AuditorLoop")
+
+	for {
+		var elements []*db.EthData
+
+		_, err := a.dbMap.Select(&elements,
+			auditedElementsSQLQuery,
+			time.Now().UnixNano(),
+			a.period.Nanoseconds(),
+			a.batchSize)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error on SQL query for elements to audit: %v", err)
+			metrics.DBError("claim_audited", err)
+		}
+
+		var audited, available int
+		for _, element := range elements {
+			result, err := a.audit(ctx, element)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Error auditing (%v) (%v): %v", element.Kind, element.Hash, err)
+				continue
+			}
+
+			metrics.IPFSAudited.WithLabelValues(element.Kind, result).Inc()
+
+			audited++
+			if result == auditAvailable || result == auditRepinned {
+				available++
+			}
+		}
+
+		if audited > 0 {
+			metrics.IPFSAvailability.Set(float64(available) / float64(audited))
+		}
+		if available < audited {
+			log.Printf("AuditorLoop: %v out of %v elements missing from IPFS", audited-available, audited)
+		}
+
+		pause := IPFS_AUDIT_PAUSE
+		if len(elements) < a.batchSize {
+			pause = IPFS_AUDIT_IDLE_PAUSE
+		}
+		if !sleep(ctx, pause) {
+			return
+		}
+	}
+}
+
+// audit checks a single element against the IPFS HTTP API,
+// and does what its result requires
+func (a *Auditor) audit(ctx context.Context, element *db.EthData) (string, error) {
+	err := blockStat(ctx, a.ipfsHost, element.CID)
+	if err == nil {
+		return a.auditPin(ctx, element)
+	}
+	if _, ok := err.(*apiError); !ok {
+		// we couldn't tell, let's see next time
+		return "", err
+	}
+
+	// the loader will add it again, once it has a value
+	_, err = a.dbMap.Exec(resetIPFSSuccessTSSQLQuery, element.Kind, element.Hash)
+	if err != nil {
+		metrics.DBError("reset_ipfs_success_ts", err)
+		return "", err
+	}
+
+	if element.PrunedTS == 0 {
+		return auditMissing, nil
+	}
+
+	rewanted, err := a.rewant(element)
+	if err != nil {
+		return "", err
+	}
+	if !rewanted {
+		log.Printf("AuditorLoop: (%v) (%v) is missing from IPFS, and it was pruned", element.Kind, element.Hash)
+		return auditLost, nil
+	}
+
+	return auditRewanted, nil
+}
+
+// auditPin pins the element, unless it already is
+func (a *Auditor) auditPin(ctx context.Context, element *db.EthData) (string, error) {
+	err := pinLs(ctx, a.ipfsHost, element.CID)
+	if err == nil {
+		return auditAvailable, nil
+	}
+	if _, ok := err.(*apiError); !ok {
+		return "", err
+	}
+
+	if err := pinAdd(ctx, a.ipfsHost, element.CID); err != nil {
+		return "", err
+	}
+
+	return auditRepinned, nil
+}
+
+// rewant asks the ethereum clients again for a pruned element, wanting
+// the element it came from. Returns false when we don't know which one.
+func (a *Auditor) rewant(element *db.EthData) (bool, error) {
+	switch element.Kind {
+	case eth.KindBlockHeader, eth.KindTransaction:
+		// the block body stores its header and transactions
+		if element.Orphaned || !element.NumberId.Valid {
+			return false, nil
+		}
+		return a.want(eth.KindBlockBody, strconv.FormatInt(element.NumberId.Int64, 10))
+
+	case eth.KindUncle:
+		// the uncles are wanted by the hash of their block
+		if element.Orphaned || !element.NumberId.Valid {
+			return false, nil
+		}
+
+		blockHash, err := a.dbMap.SelectStr(canonicalHeaderSQLQuery, eth.KindBlockHeader, element.NumberId.Int64)
+		if err != nil {
+			metrics.DBError("canonical_header", err)
+			return false, err
+		}
+		if blockHash == "" {
+			return false, nil
+		}
+
+		result, err := a.dbMap.Exec(rewantUnclesSQLQuery, eth.KindUncle, fmt.Sprintf("%v:%%", blockHash))
+		if err != nil {
+			metrics.DBError("rewant_uncles", err)
+			return false, err
+		}
+		rows, err := result.RowsAffected()
+		return rows > 0, err
+
+	case eth.KindTxReceipt:
+		// the receipts are wanted by the hash of their transaction
+		txHash, err := a.dbMap.SelectStr(receiptTxSQLQuery, element.Hash)
+		if err != nil {
+			metrics.DBError("receipt_tx", err)
+			return false, err
+		}
+		if txHash == "" {
+			return false, nil
+		}
+		return a.want(eth.KindTxReceipt, txHash)
+
+	case eth.KindStateTrie, eth.KindStorageTrie:
+		// the trie nodes are wanted by their hash
+		return a.want(element.Kind, element.Hash)
+	}
+
+	return false, nil
+}
+
+// want adds an element to the wanted list, or asks again for it
+func (a *Auditor) want(kind, key string) (bool, error) {
+	_, err := a.dbMap.Exec(rewantSQLQuery, time.Now().UnixNano(), kind, key, eth.PriorityBackfill)
+	if err != nil {
+		metrics.DBError("rewant", err)
+		return false, err
+	}
+
+	return true, nil
+}
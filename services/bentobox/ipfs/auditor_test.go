@@ -0,0 +1,216 @@
+package ipfs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"testing"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+)
+
+// auditedIPFS sets the stand-in to answer as IPFS would for a block
+// it has, or not, pinned or not
+func auditedIPFS(ipfs *fakeIPFS, stored, pinned bool) {
+	ipfs.handle("block/stat", func(w http.ResponseWriter, r *http.Request) {
+		if !stored {
+			writeAPIError(w, http.StatusInternalServerError, "blockservice: key not found")
+			return
+		}
+		writeResult(w, blockStatResponse{Key: r.URL.Query().Get("arg"), Size: 8})
+	})
+	ipfs.handle("pin/ls", func(w http.ResponseWriter, r *http.Request) {
+		keys := map[string]interface{}{}
+		if pinned {
+			keys[r.URL.Query().Get("arg")] = map[string]string{"Type": "direct"}
+		}
+		writeResult(w, map[string]interface{}{"Keys": keys})
+	})
+	ipfs.handle("pin/add", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, map[string]interface{}{"Pins": []string{r.URL.Query().Get("arg")}})
+	})
+}
+
+// selectsFirst answers the given queries with a single value,
+// as the tables the auditor looks at would
+func selectsFirst(values map[string]string) fakedb.RowsFunc {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		value, ok := values[query]
+		if !ok {
+			return nil, nil
+		}
+
+		return []string{"value"}, [][]driver.Value{{value}}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	number := sql.NullInt64{Int64: 7, Valid: true}
+
+	tests := []struct {
+		name    string
+		element *db.EthData
+		stored  bool
+		pinned  bool
+		values  map[string]string
+
+		result   string
+		repinned bool
+		// the query wanting it again, and its kind and key
+		rewant    string
+		rewantKey [2]string
+	}{
+		{
+			name:    "available",
+			element: &db.EthData{Kind: eth.KindBlockHeader, Hash: "0xb1", NumberId: number},
+			stored:  true,
+			pinned:  true,
+			result:  auditAvailable,
+		},
+		{
+			name:     "repinned",
+			element:  &db.EthData{Kind: eth.KindBlockHeader, Hash: "0xb1", NumberId: number},
+			stored:   true,
+			result:   auditRepinned,
+			repinned: true,
+		},
+		{
+			name:    "missing",
+			element: &db.EthData{Kind: eth.KindBlockHeader, Hash: "0xb1", NumberId: number},
+			result:  auditMissing,
+		},
+		{
+			name:      "pruned header",
+			element:   &db.EthData{Kind: eth.KindBlockHeader, Hash: "0xb1", NumberId: number, PrunedTS: 1},
+			result:    auditRewanted,
+			rewant:    rewantSQLQuery,
+			rewantKey: [2]string{eth.KindBlockBody, "7"},
+		},
+		{
+			name:      "pruned uncle",
+			element:   &db.EthData{Kind: eth.KindUncle, Hash: "0xu1", NumberId: number, PrunedTS: 1},
+			values:    map[string]string{canonicalHeaderSQLQuery: "0xb1"},
+			result:    auditRewanted,
+			rewant:    rewantUnclesSQLQuery,
+			rewantKey: [2]string{eth.KindUncle, "0xb1:%"},
+		},
+		{
+			name:      "pruned receipt",
+			element:   &db.EthData{Kind: eth.KindTxReceipt, Hash: "0xr1", PrunedTS: 1},
+			values:    map[string]string{receiptTxSQLQuery: "0xt1"},
+			result:    auditRewanted,
+			rewant:    rewantSQLQuery,
+			rewantKey: [2]string{eth.KindTxReceipt, "0xt1"},
+		},
+		{
+			name:      "pruned trie node",
+			element:   &db.EthData{Kind: eth.KindStorageTrie, Hash: "0xs1", PrunedTS: 1},
+			result:    auditRewanted,
+			rewant:    rewantSQLQuery,
+			rewantKey: [2]string{eth.KindStorageTrie, "0xs1"},
+		},
+		{
+			name:    "pruned orphaned header",
+			element: &db.EthData{Kind: eth.KindBlockHeader, Hash: "0xb1", NumberId: number, Orphaned: true, PrunedTS: 1},
+			result:  auditLost,
+		},
+		{
+			name:    "pruned uncle of an unknown block",
+			element: &db.EthData{Kind: eth.KindUncle, Hash: "0xu1", NumberId: number, PrunedTS: 1},
+			result:  auditLost,
+		},
+		{
+			name:    "pruned receipt of an unknown transaction",
+			element: &db.EthData{Kind: eth.KindTxReceipt, Hash: "0xr1", PrunedTS: 1},
+			result:  auditLost,
+		},
+	}
+
+	for _, test := range tests {
+		fake := fakedb.NewDB()
+		fake.Respond(selectsFirst(test.values))
+		ipfs := newFakeIPFS(t)
+		auditedIPFS(ipfs, test.stored, test.pinned)
+
+		test.element.CID = "the-cid"
+		result, err := NewAuditor(ipfs.URL, 1, 0, fake.DbMap).audit(context.Background(), test.element)
+		fake.Close()
+
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+			continue
+		}
+		if result != test.result {
+			t.Errorf("%v: got %v, expected %v", test.name, result, test.result)
+		}
+
+		pins := ipfs.called("pin/add")
+		if test.repinned != (len(pins) == 1) {
+			t.Errorf("%v: pinned %v times", test.name, len(pins))
+		}
+		if len(pins) > 0 && pins[0].URL.Query().Get("recursive") != "false" {
+			t.Errorf("%v: pinned recursively", test.name)
+		}
+
+		// only the ones not in IPFS go back to the loader
+		resets := fake.Executed(resetIPFSSuccessTSSQLQuery)
+		if test.stored != (len(resets) == 0) {
+			t.Errorf("%v: reset ipfs_success_ts %v times", test.name, len(resets))
+		}
+
+		wants := len(fake.Executed(rewantSQLQuery)) + len(fake.Executed(rewantUnclesSQLQuery))
+		if test.rewant == "" {
+			if wants != 0 {
+				t.Errorf("%v: wanted it again %v times", test.name, wants)
+			}
+			continue
+		}
+
+		rewants := fake.Executed(test.rewant)
+		if wants != 1 || len(rewants) != 1 {
+			t.Errorf("%v: wanted it again %v times, expected once", test.name, wants)
+			continue
+		}
+
+		// rewantSQLQuery takes the time first
+		args := rewants[0].Args
+		if test.rewant == rewantSQLQuery {
+			args = args[1:]
+		}
+		if args[0] != test.rewantKey[0] || args[1] != test.rewantKey[1] {
+			t.Errorf("%v: wanted (%v) (%v), expected (%v) (%v)",
+				test.name, args[0], args[1], test.rewantKey[0], test.rewantKey[1])
+		}
+	}
+}
+
+func TestAuditTransportError(t *testing.T) {
+	element := &db.EthData{Kind: eth.KindBlockHeader, Hash: "0xb1", CID: "the-cid", PrunedTS: 1}
+
+	// a proxy in front of IPFS failing
+	badGateway := newFakeIPFS(t)
+	badGateway.handle("block/stat", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	// IPFS not running
+	down := newFakeIPFS(t)
+	down.Close()
+
+	for _, host := range []string{badGateway.URL, down.URL} {
+		fake := fakedb.NewDB()
+
+		_, err := NewAuditor(host, 1, 0, fake.DbMap).audit(context.Background(), element)
+		fake.Close()
+
+		if err == nil {
+			t.Errorf("%v: expected an error", host)
+		}
+		// we can't tell whether it is there, so it stays
+		if len(fake.Statements()) != 0 {
+			t.Errorf("%v: got %v statements, expected none", host, len(fake.Statements()))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ipfs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gorp "gopkg.in/gorp.v1"
+)
+
+const IPFS_TIMEOUT = time.Duration(10 * time.Second)
+
+type IpfsManager struct {
+	ipfsHost      string
+	maxQueries    int
+	redoQueryTime int
+	maxRetries    int
+	dbMap         *gorp.DbMap
+
+	// set while the loader must not start new loads
+	paused int32
+
+	// in-flight loads, and the context they work with.
+	// The latter is only cancelled when a shutdown can't wait anymore.
+	inFlight   sync.WaitGroup
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+}
+
+func NewManager(ipfsHost string, maxQueries, redoQueryTime, maxRetries int, dbMap *gorp.DbMap) *IpfsManager {
+	workCtx, cancelWork := context.WithCancel(context.Background())
+
+	return &IpfsManager{
+		ipfsHost:      ipfsHost,
+		maxQueries:    maxQueries,
+		redoQueryTime: redoQueryTime,
+		maxRetries:    maxRetries,
+		dbMap:         dbMap,
+		workCtx:       workCtx,
+		cancelWork:    cancelWork,
+	}
+}
+
+// Pause stops the loader from starting new loads,
+// the in-flight ones finish anyway
+func (i *IpfsManager) Pause() {
+	atomic.StoreInt32(&i.paused, 1)
+	log.Printf("IpfsManager: loader paused")
+}
+
+// Resume lets the loader start new loads again
+func (i *IpfsManager) Resume() {
+	atomic.StoreInt32(&i.paused, 0)
+	log.Printf("IpfsManager: loader resumed")
+}
+
+// Paused tells whether the loader is paused
+func (i *IpfsManager) Paused() bool {
+	return atomic.LoadInt32(&i.paused) == 1
+}
+
+// Shutdown waits for the in-flight loads to finish.
+// Must be called once the loader loop has returned, so no new loads
+// are started. Loads still running after the timeout are cancelled,
+// and they release the rows they claimed.
+func (i *IpfsManager) Shutdown(timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		i.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Printf("IpfsManager: all in-flight loads finished")
+	case <-time.After(timeout):
+		log.Printf("IpfsManager: shutdown timeout reached, cancelling in-flight loads")
+		i.cancelWork()
+		<-drained
+	}
+}
+
+// sleep waits for the given duration, unless the context is done first.
+// Returns false in the latter case, so loops know they must return.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
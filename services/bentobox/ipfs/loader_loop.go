@@ -1 +1,334 @@
 package ipfs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+	"github.com/metamask/mustekala/services/bentobox/notify"
+	"github.com/metamask/mustekala/services/lib/ipld"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// Same strategy as the wanted elements query of the eth dispatcher.
+// * Selects the elements not yet added into IPFS, whose last attempt
+//   was made more than "redo time" ago, locking them.
+//   Pruned elements have no value to add, they wait to be stored again.
+//   (skipping the ones other loaders have already locked)
+// * Takes the ones of the latest blocks first, so the heads reach IPFS
+//   as soon as they are stored, then the ones of no block (trie nodes),
+//   walking the pending_ed_idx (number_id DESC NULLS LAST) index in order
+// * Marks them with the time of this attempt,
+//   so other loaders won't take them
+// * Returns the values to be added
+const notAddedElementsSQLQuery = `
+UPDATE ethdata
+SET last_ipfs_add_ts = $1
+WHERE (kind, hash) IN (
+	SELECT kind, hash
+	FROM ethdata
+	WHERE
+		ipfs_success_ts=0
+		AND
+		pruned_ts=0
+		AND
+		last_ipfs_add_ts<=$1-$2
+	ORDER BY number_id DESC NULLS LAST
+	LIMIT $3
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING kind, hash, cid, value, number_id;
+`
+
+// releaseNotAddedSQLQuery undoes the claim of an element,
+// so it can be added again right away
+const releaseNotAddedSQLQuery = `
+UPDATE ethdata
+SET last_ipfs_add_ts = 0
+WHERE
+	kind = $1
+	AND
+	hash = $2
+	AND
+	ipfs_success_ts = 0;
+`
+
+const updateIPFSSuccessTSSQLQuery = `
+UPDATE ethdata
+SET ipfs_success_ts = $3
+WHERE
+	kind = $1
+	AND
+	hash = $2;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * Takes the canonical header of the block with the given number,
+//   if already added into IPFS
+// * Checks its transactions, and their receipts, were added too,
+//   counting them against the number of transactions of the block
+// * Checks its uncles were added too, and none is still wanted
+// * Records the block, unless someone else already did,
+//   returning it only in the first case, so it is notified once
+const ipfsBlockSQLQuery = `
+WITH complete AS (
+	SELECT header.hash, header.number_id
+	FROM ethdata header
+	JOIN blocknumberoftx ON blocknumberoftx.block_id = header.hash
+	WHERE
+		header.kind = 'block_header'
+		AND
+		header.number_id = $1
+		AND
+		NOT header.orphaned
+		AND
+		header.ipfs_success_ts > 0
+		AND
+		blocknumberoftx.number_of_txs = (
+			SELECT count(*)
+			FROM blocktx
+			JOIN ethdata tx ON tx.kind = 'transaction' AND tx.hash = blocktx.tx_id
+			WHERE
+				blocktx.block_id = header.hash
+				AND
+				tx.ipfs_success_ts > 0
+		)
+		AND
+		blocknumberoftx.number_of_txs = (
+			SELECT count(DISTINCT blocktx.tx_id)
+			FROM blocktx
+			JOIN txreceipts ON txreceipts.tx_id = blocktx.tx_id
+			JOIN ethdata receipt ON receipt.kind = 'tx_receipt' AND receipt.hash = txreceipts.tx_receipts_id
+			WHERE
+				blocktx.block_id = header.hash
+				AND
+				receipt.ipfs_success_ts > 0
+		)
+		AND
+		NOT EXISTS (
+			SELECT 1
+			FROM ethdata uncle
+			WHERE
+				uncle.kind = 'uncle'
+				AND
+				uncle.number_id = header.number_id
+				AND
+				uncle.ipfs_success_ts = 0
+		)
+		AND
+		NOT EXISTS (
+			SELECT 1
+			FROM wantfromdevp2p
+			WHERE
+				kind = 'uncle'
+				AND
+				key LIKE header.hash || ':%'
+				AND
+				success_ts = 0
+		)
+)
+INSERT INTO ipfsblocks (hash, number_id, inserted_ts)
+SELECT hash, number_id, $2
+FROM complete
+ON CONFLICT (hash) DO NOTHING
+RETURNING hash, number_id, inserted_ts;
+`
+
+// LoaderLoop reads the "ethdata" table, finds the elements
+// not already added into IPFS, and pushes them through the
+// IPFS HTTP API, with at most "maxQueries" requests in flight.
+// Returns when the context is done, leaving the in-flight
+// loads to IpfsManager.Shutdown()
+func (i *IpfsManager) LoaderLoop(ctx context.Context) {
+	var err error
+
+	log.Printf("Starting LoaderLoop")
+	defer log.Printf("Stopped LoaderLoop")
+
+	inFlight := make(chan struct{}, i.maxQueries)
+
+	for {
+		notAddedElementsCount := cap(inFlight) - len(inFlight)
+
+		if notAddedElementsCount <= 0 || i.Paused() {
+			// wait until this clears
+			if !sleep(ctx, 500*time.Millisecond) {
+				return
+			}
+			continue
+		}
+
+		var notAddedElements []*db.EthData
+
+		_, err = i.dbMap.Select(&notAddedElements,
+			notAddedElementsSQLQuery,
+			time.Now().UnixNano(),
+			i.redoQueryTime*1000*1000*1000,
+			notAddedElementsCount)
+
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Error on SQL query for not added elements: %v", err)
+				metrics.DBError("claim_not_added", err)
+			}
+
+			if !sleep(ctx, 500*time.Millisecond) {
+				return
+			}
+			continue
+		}
+
+		for _, _element := range notAddedElements {
+			// we need to clone this value when doing async voodoo
+			element := _element
+
+			inFlight <- struct{}{}
+			i.inFlight.Add(1)
+			go func() {
+				defer func() { <-inFlight }()
+				defer i.inFlight.Done()
+				i.loader(element)
+			}()
+		}
+
+		// avoid the dreaded all-devouring loop
+		if !sleep(ctx, 500*time.Millisecond) {
+			return
+		}
+	}
+}
+
+// loader adds a single element into IPFS, retrying on failure,
+// verifies that IPFS addressed it with the CID we computed,
+// and records the success timestamp
+func (i *IpfsManager) loader(element *db.EthData) {
+	data, err := hex.DecodeString(element.Value)
+	if err != nil {
+		log.Printf("Error decoding value of (%v) (%v): %v", element.Kind, element.Hash, err)
+		return
+	}
+
+	var cid string
+	for attempt := 0; attempt <= i.maxRetries; attempt++ {
+		if attempt > 0 {
+			// back off a bit, the API may be just busy
+			if !sleep(i.workCtx, time.Duration(1<<uint(attempt-1))*500*time.Millisecond) {
+				break
+			}
+		}
+
+		cid, err = blockPut(i.workCtx, i.ipfsHost, element.Kind, data)
+		if err == nil {
+			break
+		}
+
+		log.Printf("Error adding (%v) (%v) into IPFS, attempt %v: %v",
+			element.Kind, element.Hash, attempt+1, err)
+	}
+	if err != nil {
+		if i.workCtx.Err() != nil {
+			// we are shutting down, let another instance take it
+			if _, err := i.dbMap.Exec(releaseNotAddedSQLQuery, element.Kind, element.Hash); err != nil {
+				log.Printf("Error releasing (%v) (%v): %v", element.Kind, element.Hash, err)
+				metrics.DBError("release_not_added", err)
+			}
+			return
+		}
+
+		// otherwise, we will get it again after the redo time
+		metrics.IPFSFailures.WithLabelValues(element.Kind).Inc()
+		return
+	}
+
+	metrics.IPFSAdded.WithLabelValues(element.Kind).Inc()
+	metrics.IPFSAddedBytes.Add(float64(len(data)))
+
+	// rows stored before we computed CIDs have none to compare with
+	if element.CID != "" && !sameCID(cid, element.CID) {
+		log.Printf("Error adding (%v) (%v) into IPFS, got CID %v, expected %v",
+			element.Kind, element.Hash, cid, element.CID)
+		metrics.IPFSFailures.WithLabelValues(element.Kind).Inc()
+		return
+	}
+
+	_, err = i.dbMap.Exec(
+		updateIPFSSuccessTSSQLQuery,
+		element.Kind,
+		element.Hash,
+		time.Now().UnixNano())
+	if err != nil {
+		log.Printf("Error updating ipfs_success_ts in (%v) (%v)", element.Kind, element.Hash)
+		metrics.DBError("update_ipfs_success_ts", err)
+		return
+	}
+
+	i.notifyIPFSBlock(element)
+}
+
+// notifyIPFSBlock lets the agents listening know when the block
+// of the element is fully in IPFS (see the notify package)
+func (i *IpfsManager) notifyIPFSBlock(element *db.EthData) {
+	switch element.Kind {
+	case eth.KindBlockHeader, eth.KindTransaction, eth.KindTxReceipt, eth.KindUncle:
+	default:
+		return
+	}
+	if !element.NumberId.Valid {
+		return
+	}
+
+	// the block is recorded and notified all at once
+	dbTx, err := i.dbMap.Begin()
+	if err != nil {
+		metrics.DBError("ipfs_block", err)
+		return
+	}
+
+	var blocks []*db.IPFSBlock
+	_, err = dbTx.Select(&blocks, ipfsBlockSQLQuery, element.NumberId.Int64, time.Now().UnixNano())
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error on SQL query for the block %v in IPFS: %v", element.NumberId.Int64, err)
+		metrics.DBError("ipfs_block", err)
+		dbTx.Rollback()
+		return
+	}
+
+	for _, block := range blocks {
+		err := notify.Publish(dbTx, notify.ChannelIPFSBlocks, &notify.IPFSBlock{
+			Number: block.NumberId,
+			Hash:   block.Hash,
+		})
+		if err != nil {
+			log.Printf("Error notifying the block %v in IPFS: %v", block.NumberId, err)
+			metrics.DBError("notify_ipfs_block", err)
+			dbTx.Rollback()
+			return
+		}
+	}
+
+	if err := dbTx.Commit(); err != nil {
+		metrics.DBError("ipfs_block", err)
+	}
+}
+
+// sameCID compares the CID given by IPFS against the one we computed,
+// regardless of the multibase they are printed with
+func sameCID(got, expected string) bool {
+	gotCID, err := ipld.Decode(got)
+	if err != nil {
+		return false
+	}
+	expectedCID, err := ipld.Decode(expected)
+	if err != nil {
+		return false
+	}
+
+	return gotCID.Equals(expectedCID)
+}
@@ -0,0 +1,180 @@
+package ipfs
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/fakedb"
+	"github.com/metamask/mustekala/services/lib/ipld"
+)
+
+// trieNode is the element the loader adds in the tests. Trie nodes
+// aren't part of a block, so their loads don't notify any.
+func trieNode(data []byte) *db.EthData {
+	return &db.EthData{
+		Kind:  eth.KindStateTrie,
+		Hash:  "0x0123",
+		CID:   ipld.Sum(ipld.EthStateTrie, data).String(),
+		Value: hex.EncodeToString(data),
+	}
+}
+
+// blockPutFailing answers block/put with a server error the first
+// "failures" times, and with the CID of the data afterwards
+func blockPutFailing(failures int32, cid string) (http.HandlerFunc, *int32) {
+	calls := new(int32)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= failures {
+			writeAPIError(w, http.StatusInternalServerError, "blockstore is busy")
+			return
+		}
+		writeResult(w, blockPutResponse{Key: cid, Size: 8})
+	}, calls
+}
+
+func TestLoaderAddsElement(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	ipfs := newFakeIPFS(t)
+
+	element := trieNode([]byte("some rlp"))
+	handler, calls := blockPutFailing(0, element.CID)
+	ipfs.handle("block/put", handler)
+
+	NewManager(ipfs.URL, 1, 30, 3, fake.DbMap).loader(element)
+
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("got %d block/put, expected 1", atomic.LoadInt32(calls))
+	}
+
+	updates := fake.Executed(updateIPFSSuccessTSSQLQuery)
+	if len(updates) != 1 {
+		t.Fatalf("got %d updates of ipfs_success_ts, expected 1", len(updates))
+	}
+	if updates[0].Args[0] != element.Kind || updates[0].Args[1] != element.Hash {
+		t.Errorf("updated ipfs_success_ts of %v, expected (%v, %v)", updates[0].Args, element.Kind, element.Hash)
+	}
+}
+
+func TestLoaderRetriesOn5xx(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	ipfs := newFakeIPFS(t)
+
+	element := trieNode([]byte("some rlp"))
+	handler, calls := blockPutFailing(2, element.CID)
+	ipfs.handle("block/put", handler)
+
+	start := time.Now()
+	NewManager(ipfs.URL, 1, 30, 3, fake.DbMap).loader(element)
+
+	if atomic.LoadInt32(calls) != 3 {
+		t.Errorf("got %d block/put, expected 3", atomic.LoadInt32(calls))
+	}
+	// backing off 500ms, then 1s
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("retried within %v, expected a backoff of 1.5s", elapsed)
+	}
+	if len(fake.Executed(updateIPFSSuccessTSSQLQuery)) != 1 {
+		t.Errorf("ipfs_success_ts not set after the retries")
+	}
+}
+
+func TestLoaderGivesUp(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	ipfs := newFakeIPFS(t)
+
+	element := trieNode([]byte("some rlp"))
+	handler, calls := blockPutFailing(100, element.CID)
+	ipfs.handle("block/put", handler)
+
+	NewManager(ipfs.URL, 1, 30, 1, fake.DbMap).loader(element)
+
+	if atomic.LoadInt32(calls) != 2 {
+		t.Errorf("got %d block/put, expected 2", atomic.LoadInt32(calls))
+	}
+	if len(fake.Executed(updateIPFSSuccessTSSQLQuery)) != 0 {
+		t.Errorf("ipfs_success_ts set for an element that failed")
+	}
+	// the claim stays, so it is taken again after the redo time
+	if len(fake.Executed(releaseNotAddedSQLQuery)) != 0 {
+		t.Errorf("element released while not shutting down")
+	}
+}
+
+func TestLoaderReleasesOnShutdown(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	ipfs := newFakeIPFS(t)
+
+	element := trieNode([]byte("some rlp"))
+	handler, _ := blockPutFailing(100, element.CID)
+	ipfs.handle("block/put", handler)
+
+	manager := NewManager(ipfs.URL, 1, 30, 10, fake.DbMap)
+	manager.inFlight.Add(1)
+	go func() {
+		defer manager.inFlight.Done()
+		manager.loader(element)
+	}()
+
+	// cancels the in-flight loads right away
+	manager.Shutdown(0)
+
+	releases := fake.Executed(releaseNotAddedSQLQuery)
+	if len(releases) != 1 {
+		t.Fatalf("got %d releases, expected 1", len(releases))
+	}
+	if len(fake.Executed(updateIPFSSuccessTSSQLQuery)) != 0 {
+		t.Errorf("ipfs_success_ts set for an element that failed")
+	}
+}
+
+func TestLoaderCIDMismatch(t *testing.T) {
+	fake := fakedb.NewDB()
+	defer fake.Close()
+	ipfs := newFakeIPFS(t)
+
+	element := trieNode([]byte("some rlp"))
+	// as if IPFS hashed it with another codec
+	handler, calls := blockPutFailing(0, ipld.Sum(ipld.EthStorageTrie, []byte("some rlp")).String())
+	ipfs.handle("block/put", handler)
+
+	NewManager(ipfs.URL, 1, 30, 3, fake.DbMap).loader(element)
+
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("got %d block/put, expected 1", atomic.LoadInt32(calls))
+	}
+	if len(fake.Executed(updateIPFSSuccessTSSQLQuery)) != 0 {
+		t.Errorf("ipfs_success_ts set for an element added with another CID")
+	}
+}
+
+func TestSameCID(t *testing.T) {
+	data := []byte("some rlp")
+	cid := ipld.Sum(ipld.EthTx, data)
+
+	tests := []struct {
+		got, expected string
+		same          bool
+	}{
+		{cid.String(), cid.String(), true},
+		{ipld.Sum(ipld.EthTxReceipt, data).String(), cid.String(), false},
+		{ipld.Sum(ipld.EthTx, []byte("other rlp")).String(), cid.String(), false},
+		{"not a cid", cid.String(), false},
+		{cid.String(), "not a cid", false},
+	}
+
+	for _, test := range tests {
+		if sameCID(test.got, test.expected) != test.same {
+			t.Errorf("sameCID(%v, %v) should be %v", test.got, test.expected, test.same)
+		}
+	}
+}
@@ -1 +1,164 @@
 package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/lib/ipld"
+)
+
+// blockPutResponse is the answer of the IPFS HTTP API to block/put
+type blockPutResponse struct {
+	Key  string `json:"Key"`
+	Size int    `json:"Size"`
+}
+
+// apiError is the answer of the IPFS HTTP API when something went wrong
+type apiError struct {
+	Message string `json:"Message"`
+	Code    int    `json:"Code"`
+}
+
+// Error implements the error interface
+func (e *apiError) Error() string {
+	return fmt.Sprintf("ipfs api error %v: %v", e.Code, e.Message)
+}
+
+// blockPut sends the raw data of an element to the IPFS HTTP API,
+// using the ethereum IPLD codec matching its kind.
+// Returns the CID given by IPFS.
+func blockPut(ctx context.Context, host, kind string, data []byte) (string, error) {
+	codec, err := eth.KindCodec(kind)
+	if err != nil {
+		return "", err
+	}
+	format, err := ipld.CodecName(codec)
+	if err != nil {
+		return "", err
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "data")
+	if err != nil {
+		return "", err
+	}
+	if _, err = part.Write(data); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("format", format)
+	params.Set("mhtype", "keccak-256")
+	params.Set("mhlen", "32")
+
+	target := blockPutResponse{}
+	err = requestAndParseJSON(ctx, apiURL(host, "block/put", params), writer.FormDataContentType(), body, &target)
+	if err != nil {
+		return "", err
+	}
+
+	return target.Key, nil
+}
+
+// blockStatResponse is the answer of the IPFS HTTP API to block/stat
+type blockStatResponse struct {
+	Key  string `json:"Key"`
+	Size int    `json:"Size"`
+}
+
+// pinLsResponse is the answer of the IPFS HTTP API to pin/ls
+type pinLsResponse struct {
+	Keys map[string]struct {
+		Type string `json:"Type"`
+	} `json:"Keys"`
+}
+
+// blockStat asks the IPFS HTTP API whether it has the block of a CID,
+// without looking for it in the network. An *apiError means it hasn't.
+func blockStat(ctx context.Context, host, cid string) error {
+	params := url.Values{}
+	params.Set("arg", cid)
+	params.Set("offline", "true")
+
+	target := blockStatResponse{}
+	return requestAndParseJSON(ctx, apiURL(host, "block/stat", params), "", &bytes.Buffer{}, &target)
+}
+
+// pinLs asks the IPFS HTTP API whether the block of a CID is pinned,
+// either directly or by one of its ancestors. An *apiError means it isn't.
+func pinLs(ctx context.Context, host, cid string) error {
+	params := url.Values{}
+	params.Set("arg", cid)
+	params.Set("type", "all")
+
+	target := pinLsResponse{}
+	err := requestAndParseJSON(ctx, apiURL(host, "pin/ls", params), "", &bytes.Buffer{}, &target)
+	if err != nil {
+		return err
+	}
+
+	if len(target.Keys) == 0 {
+		return &apiError{Message: fmt.Sprintf("path '%v' is not pinned", cid)}
+	}
+
+	return nil
+}
+
+// pinAdd pins the block of a CID into IPFS, not the ones it links to,
+// as we may not have them
+func pinAdd(ctx context.Context, host, cid string) error {
+	params := url.Values{}
+	params.Set("arg", cid)
+	params.Set("recursive", "false")
+
+	var target interface{}
+	return requestAndParseJSON(ctx, apiURL(host, "pin/add", params), "", &bytes.Buffer{}, &target)
+}
+
+// apiURL builds the URL of an IPFS HTTP API command
+func apiURL(host, command string, params url.Values) string {
+	return fmt.Sprintf("%v/api/v0/%v?%v", strings.TrimSuffix(host, "/"), command, params.Encode())
+}
+
+// requestAndParseJSON is a helper to send IPFS HTTP API Queries.
+// The request is aborted as soon as the context is done.
+func requestAndParseJSON(ctx context.Context, url, contentType string, body *bytes.Buffer, target interface{}) error {
+	client := &http.Client{
+		Timeout: IPFS_TIMEOUT,
+	}
+	request, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Add("Content-Type", contentType)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		apiErr := &apiError{}
+		respBody, _ := ioutil.ReadAll(response.Body)
+		if err := json.Unmarshal(respBody, apiErr); err != nil || apiErr.Message == "" {
+			return fmt.Errorf("ipfs api status %v: %s", response.StatusCode, respBody)
+		}
+		return apiErr
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
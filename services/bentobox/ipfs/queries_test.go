@@ -0,0 +1,247 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/metamask/mustekala/services/bentobox/eth"
+)
+
+// fakeIPFS is a stand-in for the IPFS HTTP API, answering
+// every command with the handler set for it
+type fakeIPFS struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	handlers map[string]http.HandlerFunc
+	calls    map[string][]*http.Request
+}
+
+// newFakeIPFS starts the stand-in, closed once the test is done.
+// Commands without a handler fail as IPFS does with unknown ones.
+func newFakeIPFS(t *testing.T) *fakeIPFS {
+	f := &fakeIPFS{
+		handlers: make(map[string]http.HandlerFunc),
+		calls:    make(map[string][]*http.Request),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// handle sets the handler of a command, as in "block/put"
+func (f *fakeIPFS) handle(command string, handler http.HandlerFunc) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.handlers[command] = handler
+}
+
+// called returns the requests the command got so far
+func (f *fakeIPFS) called(command string) []*http.Request {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]*http.Request{}, f.calls[command]...)
+}
+
+func (f *fakeIPFS) serve(w http.ResponseWriter, r *http.Request) {
+	command := strings.TrimPrefix(r.URL.Path, "/api/v0/")
+
+	f.lock.Lock()
+	f.calls[command] = append(f.calls[command], r)
+	handler, ok := f.handlers[command]
+	f.lock.Unlock()
+
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "404 page not found")
+		return
+	}
+
+	handler(w, r)
+}
+
+// writeAPIError answers as the IPFS HTTP API does when something went wrong
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Message": message,
+		"Code":    0,
+		"Type":    "error",
+	})
+}
+
+// writeResult answers with the JSON of the value
+func writeResult(w http.ResponseWriter, value interface{}) {
+	json.NewEncoder(w).Encode(value)
+}
+
+func TestBlockPutParams(t *testing.T) {
+	tests := []struct {
+		kind   string
+		format string
+	}{
+		{eth.KindBlockHeader, "eth-block"},
+		{eth.KindTransaction, "eth-tx"},
+		{eth.KindTxReceipt, "eth-tx-receipt"},
+		{eth.KindUncle, "eth-block"},
+		{eth.KindStateTrie, "eth-state-trie"},
+		{eth.KindStorageTrie, "eth-storage-trie"},
+	}
+
+	for _, test := range tests {
+		ipfs := newFakeIPFS(t)
+
+		var got []byte
+		ipfs.handle("block/put", func(w http.ResponseWriter, r *http.Request) {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			got, _ = ioutil.ReadAll(file)
+			writeResult(w, blockPutResponse{Key: "the-cid", Size: len(got)})
+		})
+
+		cid, err := blockPut(context.Background(), ipfs.URL, test.kind, []byte("some rlp"))
+		if err != nil {
+			t.Fatalf("%v: unexpected error %v", test.kind, err)
+		}
+		if cid != "the-cid" {
+			t.Errorf("%v: got CID %v, expected the-cid", test.kind, cid)
+		}
+		if string(got) != "some rlp" {
+			t.Errorf("%v: IPFS got %q, expected the data", test.kind, got)
+		}
+
+		query := ipfs.called("block/put")[0].URL.Query()
+		for param, expected := range map[string]string{
+			"format": test.format,
+			"mhtype": "keccak-256",
+			"mhlen":  "32",
+		} {
+			if query.Get(param) != expected {
+				t.Errorf("%v: got %v=%v, expected %v", test.kind, param, query.Get(param), expected)
+			}
+		}
+	}
+}
+
+func TestBlockPutUnknownKind(t *testing.T) {
+	ipfs := newFakeIPFS(t)
+
+	_, err := blockPut(context.Background(), ipfs.URL, eth.KindStateSlice, []byte("some rlp"))
+	if _, ok := err.(*eth.UnknownKindError); !ok {
+		t.Fatalf("got error %v, expected an UnknownKindError", err)
+	}
+	if len(ipfs.called("block/put")) != 0 {
+		t.Errorf("an element of unknown kind reached IPFS")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		apiError bool
+		message  string
+	}{
+		{
+			name:     "api error",
+			status:   http.StatusInternalServerError,
+			body:     `{"Message": "blockservice: key not found", "Code": 0, "Type": "error"}`,
+			apiError: true,
+			message:  "blockservice: key not found",
+		},
+		{
+			name:   "not json",
+			status: http.StatusBadGateway,
+			body:   "bad gateway",
+		},
+		{
+			name:   "json without message",
+			status: http.StatusInternalServerError,
+			body:   `{"Code": 0}`,
+		},
+	}
+
+	for _, test := range tests {
+		ipfs := newFakeIPFS(t)
+		ipfs.handle("block/stat", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		})
+
+		err := blockStat(context.Background(), ipfs.URL, "the-cid")
+		if err == nil {
+			t.Fatalf("%v: expected an error", test.name)
+		}
+
+		apiErr, ok := err.(*apiError)
+		if ok != test.apiError {
+			t.Fatalf("%v: got error %#v, api error expected: %v", test.name, err, test.apiError)
+		}
+		if ok && apiErr.Message != test.message {
+			t.Errorf("%v: got message %q, expected %q", test.name, apiErr.Message, test.message)
+		}
+	}
+}
+
+func TestBlockStatOffline(t *testing.T) {
+	ipfs := newFakeIPFS(t)
+	ipfs.handle("block/stat", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, blockStatResponse{Key: r.URL.Query().Get("arg"), Size: 8})
+	})
+
+	if err := blockStat(context.Background(), ipfs.URL, "the-cid"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	query := ipfs.called("block/stat")[0].URL.Query()
+	if query.Get("arg") != "the-cid" || query.Get("offline") != "true" {
+		t.Errorf("got params %v, expected the CID offline", query)
+	}
+}
+
+func TestPinLs(t *testing.T) {
+	ipfs := newFakeIPFS(t)
+
+	// some versions answer with no keys instead of an error
+	ipfs.handle("pin/ls", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, map[string]interface{}{"Keys": map[string]interface{}{}})
+	})
+
+	err := pinLs(context.Background(), ipfs.URL, "the-cid")
+	if _, ok := err.(*apiError); !ok {
+		t.Fatalf("got error %v for no keys, expected an api error", err)
+	}
+
+	ipfs.handle("pin/ls", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, map[string]interface{}{
+			"Keys": map[string]interface{}{
+				r.URL.Query().Get("arg"): map[string]string{"Type": "direct"},
+			},
+		})
+	})
+
+	if err := pinLs(context.Background(), ipfs.URL, "the-cid"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	for _, host := range []string{"http://127.0.0.1:5001", "http://127.0.0.1:5001/"} {
+		url := apiURL(host, "pin/add", nil)
+		if url != "http://127.0.0.1:5001/api/v0/pin/add?" {
+			t.Errorf("got %v out of %v", url, host)
+		}
+	}
+}
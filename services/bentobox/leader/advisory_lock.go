@@ -0,0 +1,130 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// keepalivesSQLQuery makes the server find out our session is gone
+// (and release its lock) within the lease, should we vanish
+const keepalivesSQLQuery = `
+SELECT
+	set_config('tcp_keepalives_idle', $1, false),
+	set_config('tcp_keepalives_interval', $2, false),
+	set_config('tcp_keepalives_count', $3, false);
+`
+
+const tryLockSQLQuery = `
+SELECT pg_try_advisory_lock($1);
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * Advisory locks on a bigint key are listed with its high half
+//   as the classid, its low half as the objid, and an objsubid of 1
+// * Tells whether our session holds the one of the given key
+const heldLockSQLQuery = `
+SELECT EXISTS (
+	SELECT 1
+	FROM pg_locks
+	WHERE
+		locktype = 'advisory'
+		AND
+		pid = pg_backend_pid()
+		AND
+		granted
+		AND
+		((classid::bigint << 32) | objid::bigint) = $1
+		AND
+		objsubid = 1
+);
+`
+
+// AdvisoryLock is a Postgres advisory lock, shared by
+// the instances using the same database
+type AdvisoryLock struct {
+	db    *sql.DB
+	key   int64
+	lease time.Duration
+}
+
+// NewAdvisoryLock sets up the advisory lock of the given key.
+// The lock lives as long as the session holding it does, so it needs
+// a pool of connections of its own (see db.OpenDb), which can't be
+// shared with anyone else. The server gives up on a session gone
+// within about the lease.
+func NewAdvisoryLock(db *sql.DB, key int64, lease time.Duration) *AdvisoryLock {
+	// a connection given back is closed, releasing its locks
+	db.SetMaxIdleConns(0)
+	db.SetMaxOpenConns(1)
+
+	if lease < MIN_LEASE {
+		lease = MIN_LEASE
+	}
+
+	return &AdvisoryLock{
+		db:    db,
+		key:   key,
+		lease: lease,
+	}
+}
+
+// TryLock takes the lock in a new session, if no one holds it
+func (l *AdvisoryLock) TryLock(ctx context.Context) (Session, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// probe after half the lease idle, then three times during the other half
+	idle := l.lease / 2
+	interval := idle / 3
+	_, err = conn.ExecContext(ctx, keepalivesSQLQuery,
+		seconds(idle),
+		seconds(interval),
+		"3")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, tryLockSQLQuery, l.key).Scan(&locked); err != nil || !locked {
+		conn.Close()
+		return nil, err
+	}
+
+	return &advisorySession{conn: conn, key: l.key}, nil
+}
+
+// advisorySession is the connection of the session holding the lock
+type advisorySession struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// Held asks the server whether our session still holds the lock
+func (s *advisorySession) Held(ctx context.Context) (bool, error) {
+	var held bool
+	if err := s.conn.QueryRowContext(ctx, heldLockSQLQuery, s.key).Scan(&held); err != nil {
+		return false, err
+	}
+
+	return held, nil
+}
+
+// Close gives the connection back, which closes it
+func (s *advisorySession) Close() error {
+	return s.conn.Close()
+}
+
+// seconds formats a duration in whole seconds, at least one
+func seconds(d time.Duration) string {
+	s := int64(d / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return strconv.FormatInt(s, 10)
+}
@@ -0,0 +1,73 @@
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// LEADER_LOCK_KEY is the Postgres advisory lock the bentobox
+// instances sharing a database compete for ("bentobox" in ASCII)
+const LEADER_LOCK_KEY = int64(0x62656e746f626f78)
+
+// MIN_LEASE is the shortest lease we take, the lock is checked every third of it
+const MIN_LEASE = 3 * time.Second
+
+// Lock is the lock the electors compete for. It is held by a session
+// until the session is closed, or gone.
+type Lock interface {
+	// TryLock takes the lock in a new session, if no one holds it.
+	// Returns the session, or nil if it didn't.
+	TryLock(ctx context.Context) (Session, error)
+}
+
+// Session is a session holding a Lock
+type Session interface {
+	// Held tells whether the session still holds the lock
+	Held(ctx context.Context) (bool, error)
+
+	// Close ends the session, releasing the lock if still held
+	Close() error
+}
+
+// Elector elects a leader among the instances sharing a database,
+// holding a lock, a Postgres advisory one (see NewAdvisoryLock) unless
+// they share a process. Whoever holds it runs the loops only one
+// instance must run, as the head tracker. The rest of them share
+// the work through "FOR UPDATE SKIP LOCKED" anyway.
+type Elector struct {
+	lock  Lock
+	lease time.Duration
+
+	// set while we hold the lock
+	leading int32
+}
+
+// NewElector sets up an elector competing for the given lock.
+// A leader gone is replaced within about the lease.
+func NewElector(lock Lock, lease time.Duration) *Elector {
+	if lease < MIN_LEASE {
+		lease = MIN_LEASE
+	}
+
+	return &Elector{
+		lock:  lock,
+		lease: lease,
+	}
+}
+
+// Leading tells whether we are the leader
+func (e *Elector) Leading() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// sleep waits for the given duration, unless the context is done first.
+// Returns false in the latter case, so loops know they must return.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
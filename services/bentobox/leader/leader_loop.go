@@ -0,0 +1,110 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// errLockLost is returned when our session no longer holds the lock
+var errLockLost = errors.New("the leader lock is no longer held")
+
+// LeaderLoop campaigns for the leadership, running the given loops
+// while we hold it. They are given a context cancelled as soon as we
+// lose it, after which we campaign again.
+// Returns when the context is done, once the loops have returned.
+func (e *Elector) LeaderLoop(ctx context.Context, loops ...func(context.Context)) {
+	log.Printf("Starting LeaderLoop")
+	defer log.Printf("Stopped LeaderLoop")
+
+	for {
+		session := e.campaign(ctx)
+		if session == nil {
+			return
+		}
+
+		log.Printf("LeaderLoop: we are the leader")
+		e.lead(ctx, session, loops)
+
+		// closing the session releases the lock, if still held
+		session.Close()
+
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("LeaderLoop: we are no longer the leader")
+	}
+}
+
+// campaign tries to take the lock every third of the lease,
+// until it does. Returns the session holding the lock,
+// or nil once the context is done.
+func (e *Elector) campaign(ctx context.Context) Session {
+	for {
+		session, err := e.lock.TryLock(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error taking the leader lock: %v", err)
+			metrics.DBError("leader_lock", err)
+		}
+		if session != nil {
+			return session
+		}
+
+		if !sleep(ctx, e.lease/3) {
+			return nil
+		}
+	}
+}
+
+// lead runs the loops, checking every third of the lease that
+// we still hold the lock. Once we don't, or can't tell in time,
+// or the context is done, the loops are stopped.
+func (e *Elector) lead(ctx context.Context, session Session, loops []func(context.Context)) {
+	leaderCtx, cancel := context.WithCancel(ctx)
+
+	var running sync.WaitGroup
+	for _, loop := range loops {
+		running.Add(1)
+		go func(loop func(context.Context)) {
+			defer running.Done()
+			loop(leaderCtx)
+		}(loop)
+	}
+
+	atomic.StoreInt32(&e.leading, 1)
+
+	for sleep(ctx, e.lease/3) {
+		if err := e.renew(ctx, session); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error renewing the leader lock: %v", err)
+				metrics.DBError("leader_renew", err)
+			}
+			break
+		}
+	}
+
+	atomic.StoreInt32(&e.leading, 0)
+	cancel()
+	running.Wait()
+}
+
+// renew checks our session still holds the lock.
+// We must know before the server gives up on our session.
+func (e *Elector) renew(ctx context.Context, session Session) error {
+	checkCtx, cancel := context.WithTimeout(ctx, e.lease/3)
+	defer cancel()
+
+	held, err := session.Held(checkCtx)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return errLockLost
+	}
+
+	return nil
+}
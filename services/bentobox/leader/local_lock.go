@@ -0,0 +1,68 @@
+package leader
+
+import (
+	"context"
+	"sync"
+)
+
+// LocalLock is a lock shared by the electors of a single process,
+// for the elections run without Postgres, as in the tests
+type LocalLock struct {
+	mu     sync.Mutex
+	holder *localSession
+}
+
+// NewLocalLock sets up a lock no one holds
+func NewLocalLock() *LocalLock {
+	return &LocalLock{}
+}
+
+// TryLock takes the lock in a new session, if no one holds it
+func (l *LocalLock) TryLock(ctx context.Context) (Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder != nil {
+		return nil, nil
+	}
+	l.holder = &localSession{lock: l}
+
+	return l.holder, nil
+}
+
+// Expire releases the lock, whoever holds it, as the server
+// does once it finds the session of a leader gone
+func (l *LocalLock) Expire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.holder = nil
+}
+
+// localSession is a session of a LocalLock
+type localSession struct {
+	lock *LocalLock
+}
+
+// Held tells whether the lock is still ours
+func (s *localSession) Held(ctx context.Context) (bool, error) {
+	s.lock.mu.Lock()
+	defer s.lock.mu.Unlock()
+
+	return s.lock.holder == s, nil
+}
+
+// Close releases the lock, if still ours
+func (s *localSession) Close() error {
+	s.lock.mu.Lock()
+	defer s.lock.mu.Unlock()
+
+	if s.lock.holder == s {
+		s.lock.holder = nil
+	}
+	return nil
+}
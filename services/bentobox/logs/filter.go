@@ -0,0 +1,129 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// rpcFilter is the filter object of eth_getLogs
+type rpcFilter struct {
+	FromBlock *string           `json:"fromBlock"`
+	ToBlock   *string           `json:"toBlock"`
+	Address   json.RawMessage   `json:"address"`
+	Topics    []json.RawMessage `json:"topics"`
+	BlockHash *common.Hash      `json:"blockHash"`
+}
+
+// ParseFilter reads the filter object of eth_getLogs, where the blocks
+// are numbers in hex or "latest" (the default), "earliest" or "pending",
+// the address is one or a list of them, and every position of the topics
+// is null, a topic or a list of them. "latest" and "pending" are given
+// as -1, that GetLogs takes as our last block.
+func ParseFilter(data []byte) (ethereum.FilterQuery, error) {
+	query := ethereum.FilterQuery{}
+
+	filter := rpcFilter{}
+	if err := json.Unmarshal(data, &filter); err != nil {
+		return query, fmt.Errorf("invalid filter: %v", err)
+	}
+
+	if filter.BlockHash != nil {
+		return query, fmt.Errorf("invalid filter: blockHash is not supported, use fromBlock and toBlock")
+	}
+
+	var err error
+	if query.FromBlock, err = blockNumber(filter.FromBlock); err != nil {
+		return query, err
+	}
+	if query.ToBlock, err = blockNumber(filter.ToBlock); err != nil {
+		return query, err
+	}
+
+	if query.Addresses, err = addresses(filter.Address); err != nil {
+		return query, err
+	}
+
+	for _, position := range filter.Topics {
+		topics, err := topicsAt(position)
+		if err != nil {
+			return query, err
+		}
+		query.Topics = append(query.Topics, topics)
+	}
+
+	return query, nil
+}
+
+// blockNumber parses a block of the filter
+func blockNumber(block *string) (*big.Int, error) {
+	if block == nil {
+		return big.NewInt(-1), nil
+	}
+
+	switch *block {
+	case "latest", "pending":
+		return big.NewInt(-1), nil
+	case "earliest":
+		return big.NewInt(0), nil
+	}
+
+	number, err := hexutil.DecodeUint64(*block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block %v: %v", *block, err)
+	}
+
+	return new(big.Int).SetUint64(number), nil
+}
+
+// addresses parses the address of the filter, one or a list of them
+func addresses(raw json.RawMessage) ([]common.Address, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var address common.Address
+	if err := json.Unmarshal(raw, &address); err == nil {
+		return []common.Address{address}, nil
+	}
+
+	var list []common.Address
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+
+	return list, nil
+}
+
+// topicsAt parses a position of the topics of the filter,
+// null (any topic), a topic or a list of them
+func topicsAt(raw json.RawMessage) ([]common.Hash, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var topic common.Hash
+	if err := json.Unmarshal(raw, &topic); err == nil {
+		return []common.Hash{topic}, nil
+	}
+
+	var list []*common.Hash
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("invalid topic: %v", err)
+	}
+
+	topics := []common.Hash{}
+	for _, topic := range list {
+		// a null in the list matches any topic
+		if topic == nil {
+			return nil, nil
+		}
+		topics = append(topics, *topic)
+	}
+
+	return topics, nil
+}
@@ -0,0 +1,285 @@
+package logs
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/db"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// BLOOM_CHUNK is the blocks whose blooms we check at a time
+const BLOOM_CHUNK = 1000
+
+// MAX_LOGS is the logs a query can return, past which it fails,
+// so it is narrowed down
+const MAX_LOGS = 10000
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The last block we stored that is not orphaned
+const latestSQLQuery = `
+SELECT COALESCE(MAX(number_id), -1)
+FROM ethdata
+WHERE
+	kind = 'block_header'
+	AND
+	NOT orphaned;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The blocks of the range that are not orphaned, with their bloom,
+//   empty for the blocks stored before we kept them
+const blockBloomsSQLQuery = `
+SELECT
+	header.number_id AS number_id,
+	header.hash AS block_hash,
+	COALESCE(blooms.bloom, '') AS bloom
+FROM ethdata header
+LEFT JOIN blooms ON blooms.block_hash = header.hash
+WHERE
+	header.kind = 'block_header'
+	AND
+	NOT header.orphaned
+	AND
+	header.number_id BETWEEN $1 AND $2
+ORDER BY header.number_id;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The logs of the given blocks (a comma separated list of hashes),
+//   in the order of the chain
+const blockLogsSQLQuery = `
+SELECT
+	block_hash, log_index, number_id, tx_hash, tx_index, address,
+	topic0, topic1, topic2, topic3, data, inserted_ts
+FROM logs
+WHERE block_hash = ANY(string_to_array($1, ','))
+ORDER BY number_id, log_index;
+`
+
+// Querier answers the queries of eth_getLogs out of the logs
+// of the receipts we stored. Blocks whose bloom doesn't have the
+// addresses and topics of the query are skipped.
+// Mind the logs of a block are only found once its receipts are stored.
+type Querier struct {
+	dbMap *gorp.DbMap
+}
+
+// NewQuerier sets up the queries of the logs
+func NewQuerier(dbMap *gorp.DbMap) *Querier {
+	return &Querier{dbMap: dbMap}
+}
+
+// GetLogs returns the logs matching the query, as eth_getLogs does:
+// * in the blocks from FromBlock (the genesis when nil) to ToBlock
+//   (our last block when nil), both included. Negative numbers stand
+//   for our last block, as "latest" does (see ParseFilter)
+// * emitted by any of the Addresses, if any
+// * whose topics match the Topics by position, any of the ones
+//   given for a position, where no topics match everything
+func (q *Querier) GetLogs(ctx context.Context, query ethereum.FilterQuery) ([]*types.Log, error) {
+	latest, err := q.dbMap.SelectInt(latestSQLQuery)
+	if err != nil {
+		metrics.DBError("logs_latest", err)
+		return nil, err
+	}
+
+	from := int64(0)
+	if query.FromBlock != nil {
+		from = query.FromBlock.Int64()
+		if from < 0 {
+			from = latest
+		}
+	}
+
+	to := latest
+	if query.ToBlock != nil && query.ToBlock.Int64() >= 0 && query.ToBlock.Int64() < latest {
+		to = query.ToBlock.Int64()
+	}
+
+	logs := []*types.Log{}
+	for start := from; start <= to; start += BLOOM_CHUNK {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		end := start + BLOOM_CHUNK - 1
+		if end > to {
+			end = to
+		}
+
+		chunkLogs, err := q.chunkLogs(query, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		logs = append(logs, chunkLogs...)
+		if len(logs) > MAX_LOGS {
+			return nil, fmt.Errorf("query returned more than %d results", MAX_LOGS)
+		}
+	}
+
+	return logs, nil
+}
+
+// chunkLogs returns the logs matching the query in a range of blocks,
+// only looking at the ones whose bloom may have them
+func (q *Querier) chunkLogs(query ethereum.FilterQuery, start, end int64) ([]*types.Log, error) {
+	var blooms []*db.Bloom
+	if _, err := q.dbMap.Select(&blooms, blockBloomsSQLQuery, start, end); err != nil {
+		metrics.DBError("logs_blooms", err)
+		return nil, err
+	}
+
+	blocks := []string{}
+	for _, bloom := range blooms {
+		if bloomMatches(bloom.Bloom, query) {
+			blocks = append(blocks, bloom.BlockHash)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+
+	var rows []*db.Log
+	if _, err := q.dbMap.Select(&rows, blockLogsSQLQuery, strings.Join(blocks, ",")); err != nil {
+		metrics.DBError("logs_blocks", err)
+		return nil, err
+	}
+
+	logs := []*types.Log{}
+	for _, row := range rows {
+		l, err := rowLog(row)
+		if err != nil {
+			return nil, err
+		}
+
+		if logMatches(l, query) {
+			logs = append(logs, l)
+		}
+	}
+
+	return logs, nil
+}
+
+// bloomMatches tells whether a block may have logs matching the query,
+// out of its bloom. Blocks with no bloom stored may have them.
+func bloomMatches(bloomHex string, query ethereum.FilterQuery) bool {
+	if bloomHex == "" {
+		return true
+	}
+
+	bloomBin, err := hex.DecodeString(bloomHex)
+	if err != nil || len(bloomBin) != types.BloomByteLength {
+		return true
+	}
+	bloom := types.BytesToBloom(bloomBin)
+
+	if len(query.Addresses) > 0 {
+		found := false
+		for _, address := range query.Addresses {
+			if types.BloomLookup(bloom, address) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, position := range query.Topics {
+		if len(position) == 0 {
+			continue
+		}
+
+		found := false
+		for _, topic := range position {
+			if types.BloomLookup(bloom, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logMatches tells whether a log matches the addresses and topics of the query
+func logMatches(l *types.Log, query ethereum.FilterQuery) bool {
+	if len(query.Addresses) > 0 {
+		found := false
+		for _, address := range query.Addresses {
+			if l.Address == address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(query.Topics) > len(l.Topics) {
+		return false
+	}
+
+	for i, position := range query.Topics {
+		if len(position) == 0 {
+			continue
+		}
+
+		found := false
+		for _, topic := range position {
+			if l.Topics[i] == topic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rowLog builds the log of a logs tuple
+func rowLog(row *db.Log) (*types.Log, error) {
+	data, err := hex.DecodeString(row.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data of log %v:%d: %v", row.BlockHash, row.LogIndex, err)
+	}
+
+	topics := []common.Hash{}
+	for _, topic := range []string{row.Topic0, row.Topic1, row.Topic2, row.Topic3} {
+		if topic == "" {
+			break
+		}
+		topics = append(topics, common.HexToHash(topic))
+	}
+
+	return &types.Log{
+		Address:     common.HexToAddress(row.Address),
+		Topics:      topics,
+		Data:        data,
+		BlockNumber: uint64(row.NumberId),
+		TxHash:      common.HexToHash(row.TxHash),
+		TxIndex:     uint(row.TxIndex),
+		BlockHash:   common.HexToHash(row.BlockHash),
+		Index:       uint(row.LogIndex),
+	}, nil
+}
@@ -1,8 +1,23 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/admin"
 	"github.com/metamask/mustekala/services/bentobox/db"
 	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/ipfs"
+	"github.com/metamask/mustekala/services/bentobox/leader"
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+	"github.com/metamask/mustekala/services/bentobox/notify"
+	"github.com/metamask/mustekala/services/bentobox/prune"
+	"github.com/metamask/mustekala/services/lib/devp2p"
 )
 
 func main() {
@@ -18,32 +33,171 @@ func main() {
 	dbmap := db.InitDb(dbOpts)
 	defer dbmap.Db.Close()
 
+	// subcommands (i.e. migrate) do their thing and leave
+	if len(cfg.Command) > 0 {
+		if err := runCommand(cfg, dbmap); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	// the loops run until this context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+
+	// setup the devp2p node, if asked to
+	var devp2pManager *devp2p.Manager
+	if cfg.BootnodesPath != "" {
+		devp2pManager = devp2p.NewManager(&devp2p.Config{
+			BootnodesPath:    cfg.BootnodesPath,
+			NodeDatabasePath: cfg.NodeDatabasePath,
+			LibP2PDebug:      cfg.DevP2PLibDebug,
+		})
+		devp2pManager.Start()
+		defer devp2pManager.Stop()
+	}
+
 	// setup the eth manager
 	ethManager := eth.NewManager(
-		cfg.EthHost,
-		cfg.PollInterval,
-		cfg.EthRPCMaxQueries,
-		cfg.EthRPCRedoQueryTime,
+		&eth.Config{
+			EthJsonRPCs:     cfg.EthHosts,
+			ChainConfig:     cfg.ChainConfig,
+			EthWebSocket:    cfg.EthWSHost,
+			HeadPolicy:      cfg.HeadPolicy,
+			HeadQuorum:      cfg.HeadQuorum,
+			PollInterval:    cfg.PollInterval,
+			MaxQueries:      cfg.EthRPCMaxQueries,
+			BatchSize:       cfg.EthRPCBatchSize,
+			KindLimits:      cfg.EthRPCKindLimitsMap,
+			RetryBackoff:    cfg.EthRPCRetryBackoff,
+			MaxRetryBackoff: cfg.EthRPCMaxRetryBackoff,
+			MaxAttempts:     cfg.EthRPCMaxAttempts,
+			PriorityAging:   cfg.PriorityAging,
+			MaxReorgDepth:   cfg.MaxReorgDepth,
+			Devp2p:          devp2pManager,
+			FetchRoutes:     cfg.FetchRoutesMap,
+			StateSlices:     cfg.StateSlicesList,
+
+			Traces:              cfg.Traces,
+			TraceTimeout:        cfg.TraceTimeout,
+			TraceRequestTimeout: cfg.TraceRequestTimeout,
+		},
 		dbmap)
 
-	// start network height (last block) loop
-	go ethManager.LastBlockLoop()
+	// the network height (last block) loop,
+	//   subscribed to the new heads or polling for them,
+	//   and the aging of the wanted elements priority,
+	//   are run by the leader only, see below
+	leaderLoops := []func(context.Context){ethManager.HeadLoop, ethManager.PriorityAgingLoop}
 
 	// start the eth query dispatcher loop
 	//   reads the wanted from devp2p table
 	//   and sends queries
-	go ethManager.RpcDispatcherLoop()
+	runLoop(ctx, &loops, ethManager.RpcDispatcherLoop)
+
+	// setup the ipfs manager
+	ipfsManager := ipfs.NewManager(
+		cfg.IpfsHost,
+		cfg.IpfsMaxQueries,
+		cfg.IpfsRedoQueryTime,
+		cfg.IpfsMaxRetries,
+		dbmap)
 
 	// start the ipfs loader loop
 	//  reads the eth data table, find the elements
 	//  not already added, to include them
-	// TODO
+	runLoop(ctx, &loops, ipfsManager.LoaderLoop)
+
+	// start the ipfs auditor loop, if asked to
+	//  checks the elements already added are still there
+	if cfg.IpfsAudit {
+		auditor := ipfs.NewAuditor(
+			cfg.IpfsHost,
+			cfg.IpfsAuditBatchSize,
+			time.Duration(cfg.IpfsAuditPeriod)*time.Second,
+			dbmap)
+
+		runLoop(ctx, &loops, auditor.AuditorLoop)
+	}
+
+	// prune the data already in IPFS, if asked to,
+	//  which the leader does
+	if cfg.Prune {
+		pruneManager := prune.NewManager(
+			&prune.Policy{
+				After:      time.Duration(cfg.PruneAfter) * time.Second,
+				KeepBlocks: cfg.PruneKeepBlocks,
+				KeepKinds:  cfg.PruneKeepKinds,
+			},
+			cfg.PruneBatchSize,
+			time.Duration(cfg.PruneInterval)*time.Second,
+			cfg.PruneDryRun,
+			dbmap)
+
+		leaderLoops = append(leaderLoops, pruneManager.PrunerLoop)
+	}
+
+	// elect a leader among the instances sharing the database,
+	//  it runs the loops no one else must run
+	lease := time.Duration(cfg.LeaderLease) * time.Second
+	elector := leader.NewElector(
+		leader.NewAdvisoryLock(db.OpenDb(dbOpts), leader.LEADER_LOCK_KEY, lease),
+		lease)
+
+	runLoop(ctx, &loops, func(ctx context.Context) {
+		elector.LeaderLoop(ctx, leaderLoops...)
+	})
+
+	// expose the metrics, if asked to
+	if cfg.MetricsAddr != "" {
+		metrics.RegisterQueue(dbmap)
+		runLoop(ctx, &loops, func(ctx context.Context) {
+			metrics.Serve(ctx, cfg.MetricsAddr)
+		})
+	}
+
+	// stream the notifications of the heads and the blocks in IPFS, if asked to
+	if cfg.EventsAddr != "" {
+		subscriber, err := notify.NewSubscriber(db.ConnInfo(dbOpts), notify.Channels...)
+		if err != nil {
+			log.Fatalf("Error listening to notifications: %v", err)
+		}
+		sseServer := notify.NewSSEServer(cfg.EventsAddr, subscriber)
+
+		runLoop(ctx, &loops, subscriber.SubscriberLoop)
+		runLoop(ctx, &loops, sseServer.Serve)
+	}
+
+	// serve the admin API, if asked to
+	if cfg.AdminAddr != "" {
+		adminServer := admin.NewServer(cfg.AdminAddr, cfg.AdminToken, ethManager, ipfsManager, dbmap)
+		runLoop(ctx, &loops, adminServer.Serve)
+	}
+
+	// graceful shutdown:
+	// stop taking new work, then drain what is in flight
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
 
-	// TODO
-	// we don't have proper metrics yet
-	// shame on you herman
+	cancel()
+	loops.Wait()
+
+	// both drains share the timeout, each one given what is left of it
+	deadline := time.Now().Add(time.Duration(cfg.ShutdownTimeout) * time.Second)
+	ethManager.Shutdown(time.Until(deadline))
+	ipfsManager.Shutdown(time.Until(deadline))
+
+	log.Printf("Bye")
+}
 
-	// TODO
-	// Make it a graceful shutdown with SIGINT
-	select {}
+// runLoop starts a loop in its own goroutine,
+// keeping track of it so we can wait for it to return
+func runLoop(ctx context.Context, loops *sync.WaitGroup, loop func(context.Context)) {
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		loop(ctx)
+	}()
 }
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NAMESPACE prefixes every metric of bentobox
+const NAMESPACE = "bentobox"
+
+var (
+	// InFlight is the number of wanted elements being queried
+	// by this instance, by kind
+	InFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "wanted_in_flight",
+		Help:      "Wanted elements being queried by this instance, by kind.",
+	}, []string{"kind"})
+
+	// RPCDuration is the latency of the ethereum JSON RPC requests,
+	// by method. Batch requests are labeled with the method of their
+	// queries, and batch="true"
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of the ethereum JSON RPC requests, by method.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "batch"})
+
+	// Dispatched counts the wanted elements settled by the dispatcher,
+	// by kind and result (success, failure or dead)
+	Dispatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "dispatched_total",
+		Help:      "Wanted elements settled by the dispatcher, by kind and result.",
+	}, []string{"kind", "result"})
+
+	// HeadNumber is the number of the last chain head we stored
+	HeadNumber = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "head_number",
+		Help:      "Number of the last chain head stored.",
+	})
+
+	// headTS is the time we stored the last chain head, in unix nanoseconds
+	headTS int64
+
+	// HeadAge is the time since we stored the last chain head
+	HeadAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "head_age_seconds",
+		Help:      "Seconds since the last chain head was stored.",
+	}, func() float64 {
+		ts := atomic.LoadInt64(&headTS)
+		if ts == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, ts)).Seconds()
+	})
+
+	// IntegrityFailures counts the elements rejected as they didn't match
+	// the hashes they must match, by upstream (the host of the ethereum
+	// client, or devp2p) and kind
+	IntegrityFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "integrity_failures_total",
+		Help:      "Elements rejected for not matching their hashes, by upstream and kind.",
+	}, []string{"upstream", "kind"})
+
+	// IPFSAdded counts the elements added into IPFS, by kind
+	IPFSAdded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "ipfs_added_total",
+		Help:      "Elements added into IPFS, by kind.",
+	}, []string{"kind"})
+
+	// IPFSAddedBytes counts the bytes added into IPFS
+	IPFSAddedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "ipfs_added_bytes_total",
+		Help:      "Bytes added into IPFS.",
+	})
+
+	// IPFSFailures counts the elements we could not add into IPFS,
+	// after the retries, by kind
+	IPFSFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "ipfs_failures_total",
+		Help:      "Elements that could not be added into IPFS, by kind.",
+	}, []string{"kind"})
+
+	// IPFSAudited counts the elements checked by the IPFS auditor, by kind
+	// and result (available, repinned, missing, rewanted or lost)
+	IPFSAudited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "ipfs_audited_total",
+		Help:      "Elements checked by the IPFS auditor, by kind and result.",
+	}, []string{"kind", "result"})
+
+	// IPFSAvailability is the ratio of the elements found in IPFS,
+	// out of the ones checked by the last batch of the auditor
+	IPFSAvailability = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "ipfs_availability_ratio",
+		Help:      "Ratio of the elements found in IPFS, out of the last batch of the auditor.",
+	})
+
+	// PrunedRows counts the ethdata rows whose value was pruned, by kind
+	PrunedRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "pruned_rows_total",
+		Help:      "Rows of ethdata whose value was pruned, by kind.",
+	}, []string{"kind"})
+
+	// PrunedBytes counts the bytes of the pruned values, by kind
+	PrunedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "pruned_bytes_total",
+		Help:      "Bytes of the pruned ethdata values, by kind.",
+	}, []string{"kind"})
+
+	// DBErrors counts the errors of the Postgres queries, by query
+	DBErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "db_errors_total",
+		Help:      "Errors of the Postgres queries, by query.",
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		InFlight,
+		RPCDuration,
+		Dispatched,
+		HeadNumber,
+		HeadAge,
+		IntegrityFailures,
+		IPFSAdded,
+		IPFSAddedBytes,
+		IPFSFailures,
+		IPFSAudited,
+		IPFSAvailability,
+		PrunedRows,
+		PrunedBytes,
+		DBErrors,
+	)
+}
+
+// SetHead records the number of a new chain head, and when we stored it
+func SetHead(number int64) {
+	HeadNumber.Set(float64(number))
+	atomic.StoreInt64(&headTS, time.Now().UnixNano())
+}
+
+// DBError counts an error of the given query, except for the
+// "no rows" one, which is not an error for us
+func DBError(query string, err error) {
+	if err == nil || err == sql.ErrNoRows {
+		return
+	}
+	DBErrors.WithLabelValues(query).Inc()
+}
+
+// Serve exposes the metrics in the /metrics endpoint of the given address.
+// Returns when the context is done.
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving metrics on %v/metrics", addr)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving metrics: %v", err)
+	}
+}
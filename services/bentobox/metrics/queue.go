@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	gorp "gopkg.in/gorp.v1"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// Counts the wanted elements by kind and state, where the state is
+// * succeeded: we got it
+// * dead: we gave up on it
+// * scheduled: being queried, or waiting for its next attempt
+// * pending: waiting to be dispatched
+const queueDepthSQLQuery = `
+SELECT
+	kind,
+	CASE
+		WHEN success_ts > 0 THEN 'succeeded'
+		WHEN dead_ts > 0 THEN 'dead'
+		WHEN next_attempt_ts > $1 THEN 'scheduled'
+		ELSE 'pending'
+	END AS state,
+	count(*) AS depth
+FROM wantfromdevp2p
+GROUP BY 1, 2;
+`
+
+// queueDepth is a row of the queueDepthSQLQuery
+type queueDepth struct {
+	Kind  string `db:"kind"`
+	State string `db:"state"`
+	Depth int64  `db:"depth"`
+}
+
+// queueCollector reads the depth of the wanted elements
+// queue from the DB when the metrics are scraped
+type queueCollector struct {
+	dbMap *gorp.DbMap
+	desc  *prometheus.Desc
+}
+
+// RegisterQueue adds the depth of the wanted elements queue,
+// by kind and state, to the metrics
+func RegisterQueue(dbMap *gorp.DbMap) {
+	prometheus.MustRegister(&queueCollector{
+		dbMap: dbMap,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(NAMESPACE, "", "wanted_elements"),
+			"Wanted elements, by kind and state (pending, scheduled, succeeded or dead).",
+			[]string{"kind", "state"},
+			nil),
+	})
+}
+
+// Describe implements prometheus.Collector
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	var depths []*queueDepth
+	_, err := c.dbMap.Select(&depths, queueDepthSQLQuery, time.Now().UnixNano())
+	if err != nil {
+		log.Printf("Error on SQL query for the queue depth: %v", err)
+		DBError("queue_depth", err)
+		return
+	}
+
+	for _, d := range depths {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			float64(d.Depth), d.Kind, d.State)
+	}
+}
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"encoding/json"
+
+	gorp "gopkg.in/gorp.v1"
+)
+
+// Postgres channels bentobox notifies on
+const (
+	// ChannelHeads gets a Head on every new canonical chain head
+	ChannelHeads = "bentobox_heads"
+	// ChannelIPFSBlocks gets an IPFSBlock on every block whose
+	// header, transactions, receipts and uncles are all in IPFS
+	ChannelIPFSBlocks = "bentobox_ipfs_blocks"
+)
+
+// Channels are all the channels bentobox notifies on
+var Channels = []string{ChannelHeads, ChannelIPFSBlocks}
+
+// Head is the payload of the ChannelHeads notifications
+type Head struct {
+	Number     int64  `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+}
+
+// IPFSBlock is the payload of the ChannelIPFSBlocks notifications
+type IPFSBlock struct {
+	Number int64  `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+const notifySQLQuery = `
+SELECT pg_notify($1, $2);
+`
+
+// Publish notifies the listeners of the channel, with the JSON
+// of the payload. Within a transaction, it is sent on commit.
+func Publish(exec gorp.SqlExecutor, channel string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.Exec(notifySQLQuery, channel, string(data))
+	return err
+}
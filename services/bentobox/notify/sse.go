@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSE_HEARTBEAT is the time between the comments we send the idle
+// clients, so proxies don't close their connections
+const SSE_HEARTBEAT = time.Duration(15 * time.Second)
+
+// SSE_CLIENT_BUFFER is the events a client can fall behind
+// before we drop it
+const SSE_CLIENT_BUFFER = 64
+
+// SSEServer streams the events of a subscriber to HTTP clients,
+// as Server-Sent Events on "/events". Clients can pick some channels,
+// as in "/events?channels=bentobox_heads"
+type SSEServer struct {
+	addr       string
+	subscriber *Subscriber
+
+	// the events of every connected client
+	clients     map[chan *Event]struct{}
+	clientsLock sync.Mutex
+}
+
+// NewSSEServer builds the events stream, to be served on the given address
+func NewSSEServer(addr string, subscriber *Subscriber) *SSEServer {
+	return &SSEServer{
+		addr:       addr,
+		subscriber: subscriber,
+		clients:    make(map[chan *Event]struct{}),
+	}
+}
+
+// Serve serves the events stream until the context is done
+func (s *SSEServer) Serve(ctx context.Context) {
+	go s.broadcast()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents)
+
+	server := &http.Server{
+		Addr:    s.addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		// the streams never end on their own
+		s.dropAll()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving events on %v/events", s.addr)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving events: %v", err)
+	}
+}
+
+// broadcast hands the events of the subscriber to every client.
+// The ones falling behind are dropped, they can reconnect.
+func (s *SSEServer) broadcast() {
+	for event := range s.subscriber.Events() {
+		s.clientsLock.Lock()
+		for client := range s.clients {
+			select {
+			case client <- event:
+			default:
+				delete(s.clients, client)
+				close(client)
+			}
+		}
+		s.clientsLock.Unlock()
+	}
+
+	s.dropAll()
+}
+
+// dropAll disconnects every client
+func (s *SSEServer) dropAll() {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client)
+	}
+}
+
+// handleEvents streams the events to a client, until it leaves
+// or we drop it
+func (s *SSEServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	channels := make(map[string]bool)
+	for _, channel := range strings.Split(r.URL.Query().Get("channels"), ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			channels[channel] = true
+		}
+	}
+
+	client := make(chan *Event, SSE_CLIENT_BUFFER)
+	s.clientsLock.Lock()
+	s.clients[client] = struct{}{}
+	s.clientsLock.Unlock()
+
+	defer func() {
+		s.clientsLock.Lock()
+		if _, ok := s.clients[client]; ok {
+			delete(s.clients, client)
+			close(client)
+		}
+		s.clientsLock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(SSE_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-client:
+			if !ok {
+				return
+			}
+			// the reconnections concern everyone
+			if len(channels) > 0 && !channels[event.Channel] && event.Channel != Reconnected {
+				continue
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %v\n\n", event.Channel, event.Payload)
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reconnected is the channel of the events telling the subscriber
+// lost its connection for a while, so some notifications may be
+// missed. Subscribers should catch up from the database.
+const Reconnected = "reconnected"
+
+// LISTENER_MIN_BACKOFF and LISTENER_MAX_BACKOFF bound the wait between
+// reconnections, LISTENER_PING the time we check an idle connection
+const (
+	LISTENER_MIN_BACKOFF = time.Duration(1 * time.Second)
+	LISTENER_MAX_BACKOFF = time.Duration(30 * time.Second)
+	LISTENER_PING        = time.Duration(60 * time.Second)
+)
+
+// Event is a notification received by a Subscriber
+type Event struct {
+	Channel string
+	Payload string
+}
+
+// Decode parses the JSON payload of the event into target,
+// as in a Head or an IPFSBlock
+func (e *Event) Decode(target interface{}) error {
+	return json.Unmarshal([]byte(e.Payload), target)
+}
+
+// Subscriber listens to the notifications bentobox sends,
+// so agents can react to them without polling the database
+type Subscriber struct {
+	listener *pq.Listener
+	events   chan *Event
+}
+
+// NewSubscriber connects to the database (see db.ConnInfo),
+// listening on the given channels
+func NewSubscriber(connInfo string, channels ...string) (*Subscriber, error) {
+	listener := pq.NewListener(connInfo, LISTENER_MIN_BACKOFF, LISTENER_MAX_BACKOFF,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("Error on the notifications connection: %v", err)
+			}
+		})
+
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return &Subscriber{
+		listener: listener,
+		events:   make(chan *Event, 64),
+	}, nil
+}
+
+// Events are the notifications received, closed
+// once the subscriber loop returns
+func (s *Subscriber) Events() <-chan *Event {
+	return s.events
+}
+
+// SubscriberLoop delivers the notifications received into Events(),
+// until the context is done. Mind they are delivered as long as
+// someone reads them, so they must be read.
+func (s *Subscriber) SubscriberLoop(ctx context.Context) {
+	log.Printf("Starting SubscriberLoop")
+	defer log.Printf("Stopped SubscriberLoop")
+
+	defer close(s.events)
+	defer s.listener.Close()
+
+	for {
+		var event *Event
+
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-s.listener.Notify:
+			if notification == nil {
+				// the connection was lost, and is back
+				event = &Event{Channel: Reconnected}
+			} else {
+				event = &Event{Channel: notification.Channel, Payload: notification.Extra}
+			}
+		case <-time.After(LISTENER_PING):
+			// the listener reconnects when the connection has failed
+			if err := s.listener.Ping(); err != nil {
+				log.Printf("Error pinging the notifications connection: %v", err)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case s.events <- event:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package prune
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	gorp "gopkg.in/gorp.v1"
+)
+
+// Policy decides which rows of the "ethdata" table get their value
+// pruned. A row is pruned, keeping its CID, when all of these hold:
+// * it was added into IPFS at least After ago
+// * it isn't part of the last KeepBlocks blocks
+// * its kind isn't one of the KeepKinds
+type Policy struct {
+	// how long a value stays once added into IPFS
+	After time.Duration
+
+	// the rows of these many blocks, from the head down, are kept whole.
+	// Zero keeps none of them.
+	KeepBlocks int64
+
+	// the rows of these kinds are kept whole
+	KeepKinds []string
+}
+
+type PruneManager struct {
+	policy    *Policy
+	batchSize int
+	interval  time.Duration
+	dryRun    bool
+	dbMap     *gorp.DbMap
+}
+
+// NewManager sets up the pruner of the "ethdata" table. It prunes
+// batchSize rows at a time, every interval. In a dry run it only
+// reports what it would prune.
+func NewManager(policy *Policy, batchSize int, interval time.Duration, dryRun bool, dbMap *gorp.DbMap) *PruneManager {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &PruneManager{
+		policy:    policy,
+		batchSize: batchSize,
+		interval:  interval,
+		dryRun:    dryRun,
+		dbMap:     dbMap,
+	}
+}
+
+// keepKinds is the list of kinds to keep, as the
+// comma separated string the queries take
+func (p *PruneManager) keepKinds() string {
+	return strings.Join(p.policy.KeepKinds, ",")
+}
+
+// sleep waits for the given duration, unless the context is done first.
+// Returns false in the latter case, so loops know they must return.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
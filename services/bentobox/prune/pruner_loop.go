@@ -0,0 +1,197 @@
+package prune
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"time"
+
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// PRUNE_BATCH_PAUSE is the time between two batches of a pass,
+// so the pruner doesn't get in the way of the other loops
+const PRUNE_BATCH_PAUSE = time.Duration(100 * time.Millisecond)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * Selects the rows not pruned yet, added into IPFS before $2,
+//   not in the blocks above $3 nor of the kinds in $4 (comma separated),
+//   the oldest in IPFS first, locking them
+//   (skipping the ones being updated by someone else)
+// * Drops their values, marking them with the time of this pass ($1)
+// * Returns the kind and the bytes of the value of each one
+const pruneSQLQuery = `
+WITH prunable AS (
+	SELECT kind, hash, octet_length(value) AS value_bytes
+	FROM ethdata
+	WHERE
+		pruned_ts = 0
+		AND
+		ipfs_success_ts > 0
+		AND
+		ipfs_success_ts <= $2
+		AND
+		(number_id IS NULL OR number_id <= $3)
+		AND
+		NOT (kind = ANY(string_to_array($4, ',')))
+	ORDER BY ipfs_success_ts
+	LIMIT $5
+	FOR UPDATE SKIP LOCKED
+)
+UPDATE ethdata
+SET value = '', pruned_ts = $1
+FROM prunable
+WHERE
+	ethdata.kind = prunable.kind
+	AND
+	ethdata.hash = prunable.hash
+RETURNING prunable.kind, prunable.value_bytes;
+`
+
+// prunableSQLQuery sums up, by kind, the rows pruneSQLQuery would prune
+const prunableSQLQuery = `
+SELECT kind, count(*) AS row_count, COALESCE(sum(octet_length(value)), 0) AS value_bytes
+FROM ethdata
+WHERE
+	pruned_ts = 0
+	AND
+	ipfs_success_ts > 0
+	AND
+	ipfs_success_ts <= $1
+	AND
+	(number_id IS NULL OR number_id <= $2)
+	AND
+	NOT (kind = ANY(string_to_array($3, ',')))
+GROUP BY kind;
+`
+
+const headSQLQuery = `
+SELECT COALESCE(max(number_id), -1)
+FROM lastblock;
+`
+
+// prunedRows are the rows of a kind pruned (or to be pruned),
+// and the bytes of their values
+type prunedRows struct {
+	Kind       string `db:"kind"`
+	Rows       int64  `db:"row_count"`
+	ValueBytes int64  `db:"value_bytes"`
+}
+
+// PrunerLoop drops the values of the "ethdata" rows the policy
+// allows to, in small batches. In a dry run, it only reports
+// what it would prune. Returns when the context is done.
+func (p *PruneManager) PrunerLoop(ctx context.Context) {
+	log.Printf("Starting PrunerLoop")
+	defer log.Printf("Stopped PrunerLoop")
+
+	for {
+		if p.dryRun {
+			p.report()
+		} else {
+			p.prune(ctx)
+		}
+
+		if !sleep(ctx, p.interval) {
+			return
+		}
+	}
+}
+
+// prune runs a pass of batches, until there is nothing left to prune
+func (p *PruneManager) prune(ctx context.Context) {
+	before, maxNumber, err := p.bounds()
+	if err != nil {
+		return
+	}
+
+	var rows, bytes int64
+	for {
+		var pruned []*prunedRows
+
+		_, err := p.dbMap.Select(&pruned,
+			pruneSQLQuery,
+			time.Now().UnixNano(),
+			before,
+			maxNumber,
+			p.keepKinds(),
+			p.batchSize)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error pruning ethdata: %v", err)
+			metrics.DBError("prune", err)
+			break
+		}
+
+		for _, row := range pruned {
+			rows++
+			bytes += row.ValueBytes
+			metrics.PrunedRows.WithLabelValues(row.Kind).Inc()
+			metrics.PrunedBytes.WithLabelValues(row.Kind).Add(float64(row.ValueBytes))
+		}
+
+		if len(pruned) < p.batchSize {
+			break
+		}
+
+		if !sleep(ctx, PRUNE_BATCH_PAUSE) {
+			break
+		}
+	}
+
+	if rows > 0 {
+		log.Printf("PrunerLoop: pruned %v rows, reclaiming %v bytes", rows, bytes)
+	}
+}
+
+// report logs what a pass would prune, by kind
+func (p *PruneManager) report() {
+	before, maxNumber, err := p.bounds()
+	if err != nil {
+		return
+	}
+
+	var prunable []*prunedRows
+
+	_, err = p.dbMap.Select(&prunable,
+		prunableSQLQuery,
+		before,
+		maxNumber,
+		p.keepKinds())
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error summing up prunable ethdata: %v", err)
+		metrics.DBError("prunable", err)
+		return
+	}
+
+	var rows, bytes int64
+	for _, kind := range prunable {
+		log.Printf("PrunerLoop (dry run): would prune %v %v rows, reclaiming %v bytes",
+			kind.Rows, kind.Kind, kind.ValueBytes)
+		rows += kind.Rows
+		bytes += kind.ValueBytes
+	}
+
+	log.Printf("PrunerLoop (dry run): would prune %v rows, reclaiming %v bytes", rows, bytes)
+}
+
+// bounds returns the time before which the rows must have been added
+// into IPFS, and the highest block number whose rows can be pruned
+func (p *PruneManager) bounds() (int64, int64, error) {
+	before := time.Now().Add(-p.policy.After).UnixNano()
+
+	if p.policy.KeepBlocks <= 0 {
+		return before, math.MaxInt64, nil
+	}
+
+	// without a head, only the rows out of any block are pruned
+	head, err := p.dbMap.SelectInt(headSQLQuery)
+	if err != nil {
+		log.Printf("Error on SQL query for the last block: %v", err)
+		metrics.DBError("last_block", err)
+		return 0, 0, err
+	}
+
+	return before, head - p.policy.KeepBlocks, nil
+}
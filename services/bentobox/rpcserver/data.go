@@ -0,0 +1,324 @@
+package rpcserver
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/metamask/mustekala/services/bentobox/metrics"
+)
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The last head we know of
+const headSQLQuery = `
+SELECT number_id
+FROM lastblock
+ORDER BY inserted_ts DESC
+LIMIT 1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The header of the canonical block with the given number
+const headerByNumberSQLQuery = `
+SELECT hash, value, pruned_ts
+FROM ethdata
+WHERE
+	kind = 'block_header'
+	AND
+	number_id = $1
+	AND
+	NOT orphaned
+ORDER BY inserted_ts DESC
+LIMIT 1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The header of the block with the given hash, canonical or not
+const headerByHashSQLQuery = `
+SELECT hash, value, pruned_ts
+FROM ethdata
+WHERE
+	kind = 'block_header'
+	AND
+	hash = $1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The number of transactions of a block, as we stored it
+const txCountSQLQuery = `
+SELECT number_of_txs
+FROM blocknumberoftx
+WHERE block_id = $1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The transactions of a block, in order
+const blockTxsSQLQuery = `
+SELECT tx.hash AS hash, tx.value AS value, tx.pruned_ts AS pruned_ts, blocktx.tx_index AS tx_index
+FROM blocktx
+JOIN ethdata tx ON tx.kind = 'transaction' AND tx.hash = blocktx.tx_id
+WHERE blocktx.block_id = $1
+ORDER BY blocktx.tx_index;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The uncles that came in the blocks with the given number,
+//   the canonical one or not
+const unclesSQLQuery = `
+SELECT hash, value, pruned_ts
+FROM ethdata
+WHERE
+	kind = 'uncle'
+	AND
+	number_id = $1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The canonical block a transaction belongs to
+const txBlockSQLQuery = `
+SELECT block_id
+FROM blocktx
+WHERE
+	tx_id = $1
+	AND
+	NOT orphaned
+LIMIT 1;
+`
+
+// we put this here for aesthetic purposes
+// EXPLAIN:
+// * The receipts of the transactions of a block, not orphaned
+const blockReceiptsSQLQuery = `
+SELECT txreceipts.tx_id AS hash, receipt.value AS value, receipt.pruned_ts AS pruned_ts
+FROM blocktx
+JOIN txreceipts ON txreceipts.tx_id = blocktx.tx_id
+JOIN ethdata receipt ON receipt.kind = 'tx_receipt' AND receipt.hash = txreceipts.tx_receipts_id
+WHERE
+	blocktx.block_id = $1
+	AND
+	NOT receipt.orphaned;
+`
+
+// valueRow is an element of the ethdata table, with its value
+// (the hex of its RLP) unless pruned
+type valueRow struct {
+	Hash     string `db:"hash"`
+	Value    string `db:"value"`
+	PrunedTS int64  `db:"pruned_ts"`
+	TxIndex  int64  `db:"tx_index"`
+}
+
+// head returns the number of the last head we know of
+func (s *Server) head() (int64, *rpcError) {
+	number, err := s.dbMap.SelectNullInt(headSQLQuery)
+	if err != nil {
+		metrics.DBError("rpc_head", err)
+		return 0, internalError(err)
+	}
+	if !number.Valid {
+		return 0, notFound("no head stored yet")
+	}
+
+	return number.Int64, nil
+}
+
+// headerByNumber returns the header of the canonical block with the number
+func (s *Server) headerByNumber(number int64) (*types.Header, *rpcError) {
+	return s.header("rpc_header_by_number", headerByNumberSQLQuery, number)
+}
+
+// headerByHash returns the header of the block with the hash
+func (s *Server) headerByHash(hash common.Hash) (*types.Header, *rpcError) {
+	return s.header("rpc_header_by_hash", headerByHashSQLQuery, hash.Hex())
+}
+
+// header returns the header the query selects
+func (s *Server) header(query, sqlQuery string, arg interface{}) (*types.Header, *rpcError) {
+	row := valueRow{}
+	err := s.dbMap.SelectOne(&row, sqlQuery, arg)
+	if err == sql.ErrNoRows {
+		return nil, notFound("block %v not found", arg)
+	}
+	if err != nil {
+		metrics.DBError(query, err)
+		return nil, internalError(err)
+	}
+
+	header := new(types.Header)
+	if rpcErr := decodeValue(&row, "block header", header); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	return header, nil
+}
+
+// txCount returns how many transactions the block has
+func (s *Server) txCount(header *types.Header) (int64, *rpcError) {
+	count, err := s.dbMap.SelectNullInt(txCountSQLQuery, header.Hash().Hex())
+	if err != nil {
+		metrics.DBError("rpc_tx_count", err)
+		return 0, internalError(err)
+	}
+	if !count.Valid {
+		return 0, notFound("transactions of block %v not found", header.Hash().Hex())
+	}
+
+	return count.Int64, nil
+}
+
+// txs returns the hashes of the transactions of the block, in order,
+// and when full, the transactions themselves
+func (s *Server) txs(header *types.Header, full bool) (types.Transactions, []common.Hash, *rpcError) {
+	count, rpcErr := s.txCount(header)
+	if rpcErr != nil {
+		return nil, nil, rpcErr
+	}
+
+	var rows []*valueRow
+	if _, err := s.dbMap.Select(&rows, blockTxsSQLQuery, header.Hash().Hex()); err != nil {
+		metrics.DBError("rpc_block_txs", err)
+		return nil, nil, internalError(err)
+	}
+	if int64(len(rows)) != count {
+		return nil, nil, notFound("transactions of block %v not found", header.Hash().Hex())
+	}
+
+	txs := types.Transactions{}
+	hashes := []common.Hash{}
+	for i, row := range rows {
+		if row.TxIndex != int64(i) {
+			return nil, nil, unavailable("position of the transactions of block %v unknown, "+
+				"want the block again", header.Hash().Hex())
+		}
+		hashes = append(hashes, common.HexToHash(row.Hash))
+
+		if !full {
+			continue
+		}
+
+		tx := new(types.Transaction)
+		if rpcErr := decodeValue(row, "transaction", tx); rpcErr != nil {
+			return nil, nil, rpcErr
+		}
+		txs = append(txs, tx)
+	}
+
+	return txs, hashes, nil
+}
+
+// uncles returns the uncle headers of the block, in order.
+// As we don't keep their position, we find the ones (among the
+// uncles of the blocks with its number) matching its uncle hash.
+func (s *Server) uncles(header *types.Header) ([]*types.Header, *rpcError) {
+	if header.UncleHash == types.EmptyUncleHash {
+		return []*types.Header{}, nil
+	}
+
+	var rows []*valueRow
+	if _, err := s.dbMap.Select(&rows, unclesSQLQuery, header.Number.Int64()); err != nil {
+		metrics.DBError("rpc_uncles", err)
+		return nil, internalError(err)
+	}
+
+	candidates := []*types.Header{}
+	for _, row := range rows {
+		uncle := new(types.Header)
+		if rpcErr := decodeValue(row, "uncle", uncle); rpcErr != nil {
+			return nil, rpcErr
+		}
+		candidates = append(candidates, uncle)
+	}
+
+	// a block has two uncles at most
+	for _, first := range candidates {
+		if types.CalcUncleHash([]*types.Header{first}) == header.UncleHash {
+			return []*types.Header{first}, nil
+		}
+
+		for _, second := range candidates {
+			if second == first {
+				continue
+			}
+			uncles := []*types.Header{first, second}
+			if types.CalcUncleHash(uncles) == header.UncleHash {
+				return uncles, nil
+			}
+		}
+	}
+
+	return nil, notFound("uncles of block %v not found", header.Hash().Hex())
+}
+
+// txBlock returns the header of the canonical block of a transaction
+func (s *Server) txBlock(txHash common.Hash) (*types.Header, *rpcError) {
+	blockHash, err := s.dbMap.SelectStr(txBlockSQLQuery, txHash.Hex())
+	if err != nil {
+		metrics.DBError("rpc_tx_block", err)
+		return nil, internalError(err)
+	}
+	if blockHash == "" {
+		return nil, notFound("transaction %v not found", txHash.Hex())
+	}
+
+	return s.headerByHash(common.HexToHash(blockHash))
+}
+
+// receipts returns the receipts of the transactions of the block, in order
+func (s *Server) receipts(header *types.Header, txs types.Transactions) (types.Receipts, *rpcError) {
+	var rows []*valueRow
+	if _, err := s.dbMap.Select(&rows, blockReceiptsSQLQuery, header.Hash().Hex()); err != nil {
+		metrics.DBError("rpc_block_receipts", err)
+		return nil, internalError(err)
+	}
+
+	byTx := make(map[common.Hash]*valueRow)
+	for _, row := range rows {
+		byTx[common.HexToHash(row.Hash)] = row
+	}
+
+	receipts := types.Receipts{}
+	for _, tx := range txs {
+		row, ok := byTx[tx.Hash()]
+		if !ok {
+			return nil, notFound("receipt of transaction %v not found", tx.Hash().Hex())
+		}
+
+		receipt := new(types.Receipt)
+		if rpcErr := decodeValue(row, "receipt", receipt); rpcErr != nil {
+			return nil, rpcErr
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, nil
+}
+
+// decodeValue decodes the RLP of an element into target,
+// failing when its value was pruned
+func decodeValue(row *valueRow, element string, target interface{}) *rpcError {
+	if row.PrunedTS > 0 {
+		return unavailable("%v %v was pruned, it is only in IPFS", element, row.Hash)
+	}
+
+	value, err := hex.DecodeString(row.Value)
+	if err != nil {
+		return internalError(fmt.Errorf("invalid %v %v: %v", element, row.Hash, err))
+	}
+
+	if err := rlp.DecodeBytes(value, target); err != nil {
+		return internalError(fmt.Errorf("invalid %v %v: %v", element, row.Hash, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,359 @@
+package rpcserver
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/metamask/mustekala/services/bentobox/eth"
+	"github.com/metamask/mustekala/services/bentobox/logs"
+)
+
+// call runs a method with its params
+func (s *Server) call(ctx context.Context, method string, params []json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "eth_blockNumber":
+		return s.blockNumber()
+	case "eth_getBlockByNumber":
+		return orNull(s.getBlockByNumber(params))
+	case "eth_getBlockByHash":
+		return orNull(s.getBlockByHash(params))
+	case "eth_getTransactionByHash":
+		return orNull(s.getTransactionByHash(params))
+	case "eth_getTransactionReceipt":
+		return orNull(s.getTransactionReceipt(params))
+	case "eth_getBlockTransactionCountByNumber":
+		return s.getBlockTransactionCountByNumber(params)
+	case "eth_getLogs":
+		return s.getLogs(ctx, params)
+	default:
+		return nil, &rpcError{Code: CodeMethodNotFound, Message: "the method " + method + " does not exist/is not available"}
+	}
+}
+
+// orNull answers null instead of a not found error, as the ethereum
+// clients do for the blocks, transactions and receipts they don't know
+func orNull(result interface{}, rpcErr *rpcError) (interface{}, *rpcError) {
+	if rpcErr != nil && rpcErr.Code == CodeNotFound {
+		return nil, nil
+	}
+
+	return result, rpcErr
+}
+
+// blockNumber handles eth_blockNumber, the number of our last head
+func (s *Server) blockNumber() (interface{}, *rpcError) {
+	number, rpcErr := s.head()
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	return hexutil.Uint64(number), nil
+}
+
+// getBlockByNumber handles eth_getBlockByNumber [number, full]
+func (s *Server) getBlockByNumber(params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) != 2 {
+		return nil, invalidParams("expected 2 params")
+	}
+
+	number, rpcErr := s.blockNumberParam(params[0])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	full, rpcErr := boolParam(params[1])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	header, rpcErr := s.headerByNumber(number)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	return s.rpcBlock(header, full)
+}
+
+// getBlockByHash handles eth_getBlockByHash [hash, full]
+func (s *Server) getBlockByHash(params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) != 2 {
+		return nil, invalidParams("expected 2 params")
+	}
+
+	hash, rpcErr := hashParam(params[0])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	full, rpcErr := boolParam(params[1])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	header, rpcErr := s.headerByHash(hash)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	return s.rpcBlock(header, full)
+}
+
+// getTransactionByHash handles eth_getTransactionByHash [hash]
+func (s *Server) getTransactionByHash(params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) != 1 {
+		return nil, invalidParams("expected 1 param")
+	}
+
+	txHash, rpcErr := hashParam(params[0])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	header, rpcErr := s.txBlock(txHash)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	txs, _, rpcErr := s.txs(header, true)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	for i, tx := range txs {
+		if tx.Hash() == txHash {
+			return s.rpcTransaction(header, tx, i)
+		}
+	}
+
+	return nil, notFound("transaction %v not found", txHash.Hex())
+}
+
+// getTransactionReceipt handles eth_getTransactionReceipt [hash].
+// The receipts of the rest of the transactions of its block are
+// needed to know its gas used and the position of its logs.
+func (s *Server) getTransactionReceipt(params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) != 1 {
+		return nil, invalidParams("expected 1 param")
+	}
+
+	txHash, rpcErr := hashParam(params[0])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	header, rpcErr := s.txBlock(txHash)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	txs, _, rpcErr := s.txs(header, true)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	receipts, rpcErr := s.receipts(header, txs)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	value, err := eth.ReceiptValue(s.chainConfig, header, &types.Body{Transactions: txs}, receipts, txHash)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	receipt := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(value), &receipt); err != nil {
+		return nil, internalError(err)
+	}
+
+	// along with the ends of the transaction
+	for _, tx := range txs {
+		if tx.Hash() == txHash {
+			from, err := s.sender(header, tx)
+			if err != nil {
+				return nil, internalError(err)
+			}
+			receipt["from"] = from
+			receipt["to"] = tx.To()
+		}
+	}
+
+	return receipt, nil
+}
+
+// getBlockTransactionCountByNumber handles eth_getBlockTransactionCountByNumber [number]
+func (s *Server) getBlockTransactionCountByNumber(params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) != 1 {
+		return nil, invalidParams("expected 1 param")
+	}
+
+	number, rpcErr := s.blockNumberParam(params[0])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	header, rpcErr := s.headerByNumber(number)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	count, rpcErr := s.txCount(header)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	return hexutil.Uint64(count), nil
+}
+
+// getLogs handles eth_getLogs [filter], see the logs package
+func (s *Server) getLogs(ctx context.Context, params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) != 1 {
+		return nil, invalidParams("expected 1 param")
+	}
+
+	query, err := logs.ParseFilter(params[0])
+	if err != nil {
+		return nil, invalidParams("%v", err)
+	}
+
+	result, err := s.logs.GetLogs(ctx, query)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return result, nil
+}
+
+// rpcBlock builds the JSON of a block, as eth_getBlockByHash does,
+// with the hashes of its transactions or, when full, the transactions.
+// We don't know the total difficulty of the chain, so it's left out.
+func (s *Server) rpcBlock(header *types.Header, full bool) (interface{}, *rpcError) {
+	// the transactions are needed for the size of the block,
+	// though their hashes are enough when not full
+	txs, hashes, rpcErr := s.txs(header, true)
+	if rpcErr != nil && rpcErr.Code == CodeUnavailable && !full {
+		txs = nil
+		_, hashes, rpcErr = s.txs(header, false)
+	}
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	uncles, rpcErr := s.uncles(header)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	block := make(map[string]interface{})
+	if err := json.Unmarshal(headerJSON, &block); err != nil {
+		return nil, internalError(err)
+	}
+
+	if txs != nil {
+		block["size"] = hexutil.Uint64(types.NewBlockWithHeader(header).WithBody(txs, uncles).Size())
+	}
+
+	if full {
+		rpcTxs := []interface{}{}
+		for i, tx := range txs {
+			rpcTx, rpcErr := s.rpcTransaction(header, tx, i)
+			if rpcErr != nil {
+				return nil, rpcErr
+			}
+			rpcTxs = append(rpcTxs, rpcTx)
+		}
+		block["transactions"] = rpcTxs
+	} else {
+		block["transactions"] = hashes
+	}
+
+	uncleHashes := []common.Hash{}
+	for _, uncle := range uncles {
+		uncleHashes = append(uncleHashes, uncle.Hash())
+	}
+	block["uncles"] = uncleHashes
+
+	return block, nil
+}
+
+// rpcTransaction builds the JSON of a transaction, as
+// eth_getTransactionByHash does, at the given position of its block
+func (s *Server) rpcTransaction(header *types.Header, tx *types.Transaction, index int) (interface{}, *rpcError) {
+	txJSON, err := json.Marshal(tx)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	rpcTx := make(map[string]interface{})
+	if err := json.Unmarshal(txJSON, &rpcTx); err != nil {
+		return nil, internalError(err)
+	}
+
+	from, err := s.sender(header, tx)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	rpcTx["blockHash"] = header.Hash()
+	rpcTx["blockNumber"] = (*hexutil.Big)(header.Number)
+	rpcTx["transactionIndex"] = hexutil.Uint(index)
+	rpcTx["from"] = from
+
+	return rpcTx, nil
+}
+
+// sender recovers who sent the transaction, with the rules
+// of our chain at the height of its block
+func (s *Server) sender(header *types.Header, tx *types.Transaction) (common.Address, error) {
+	signer := types.MakeSigner(s.chainConfig, header.Number)
+	return types.Sender(signer, tx)
+}
+
+// blockNumberParam parses a block number param: a number in hex,
+// "latest" or "pending" (our last head), or "earliest"
+func (s *Server) blockNumberParam(param json.RawMessage) (int64, *rpcError) {
+	var block string
+	if err := json.Unmarshal(param, &block); err != nil {
+		return 0, invalidParams("invalid block number: %v", err)
+	}
+
+	switch block {
+	case "latest", "pending":
+		return s.head()
+	case "earliest":
+		return 0, nil
+	}
+
+	number, err := hexutil.DecodeUint64(block)
+	if err != nil {
+		return 0, invalidParams("invalid block number %v: %v", block, err)
+	}
+
+	return int64(number), nil
+}
+
+// hashParam parses a block or transaction hash param
+func hashParam(param json.RawMessage) (common.Hash, *rpcError) {
+	var hash common.Hash
+	if err := json.Unmarshal(param, &hash); err != nil {
+		return hash, invalidParams("invalid hash: %v", err)
+	}
+
+	return hash, nil
+}
+
+// boolParam parses a boolean param
+func boolParam(param json.RawMessage) (bool, *rpcError) {
+	var value bool
+	if err := json.Unmarshal(param, &value); err != nil {
+		return false, invalidParams("invalid boolean: %v", err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,217 @@
+package rpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/params"
+	gorp "gopkg.in/gorp.v1"
+
+	"github.com/metamask/mustekala/services/bentobox/logs"
+)
+
+// DEFAULT_ADDR is the address the rpc command serves on, unless told otherwise
+const DEFAULT_ADDR = "127.0.0.1:8645"
+
+// MAX_BODY_SIZE caps the size of the requests
+const MAX_BODY_SIZE = 1 << 20
+
+// JSON RPC error codes, the standard ones, and the ones of EIP-1474
+// for the data we don't have
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeNotFound       = -32001 // we don't have it
+	CodeUnavailable    = -32002 // we have it, but can't serve it (i.e. pruned)
+)
+
+// Server answers the read only methods of the ethereum JSON RPC out of
+// the data bentobox stored, with no ethereum client behind.
+// See methods.go for the supported methods.
+type Server struct {
+	addr        string
+	dbMap       *gorp.DbMap
+	logs        *logs.Querier
+	chainConfig *params.ChainConfig
+}
+
+// NewServer builds the JSON RPC server, to be served on the given address,
+// for the data of the chain with the given rules
+func NewServer(addr string, dbMap *gorp.DbMap, chainConfig *params.ChainConfig) *Server {
+	return &Server{
+		addr:        addr,
+		dbMap:       dbMap,
+		logs:        logs.NewQuerier(dbMap),
+		chainConfig: chainConfig,
+	}
+}
+
+// rpcRequest is a JSON RPC request
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+// rpcResponse is a JSON RPC response, with either a result or an error
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError is the error of a JSON RPC response
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serve serves the JSON RPC until the context is done
+func (s *Server) Serve(ctx context.Context) {
+	server := &http.Server{
+		Addr:    s.addr,
+		Handler: http.HandlerFunc(s.handle),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving the eth JSON RPC on %v", s.addr)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving the eth JSON RPC: %v", err)
+	}
+}
+
+// handle answers a request, or a batch of them
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE))
+	if err != nil {
+		writeJSON(w, errorResponse(nil, &rpcError{Code: CodeParseError, Message: err.Error()}))
+		return
+	}
+	if !json.Valid(body) {
+		writeJSON(w, errorResponse(nil, &rpcError{Code: CodeParseError, Message: "invalid JSON"}))
+		return
+	}
+
+	// a batch
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		var batch []json.RawMessage
+		json.Unmarshal(body, &batch)
+		if len(batch) == 0 {
+			writeJSON(w, errorResponse(nil, &rpcError{Code: CodeInvalidRequest, Message: "empty batch"}))
+			return
+		}
+
+		responses := []*rpcResponse{}
+		for _, request := range batch {
+			if response := s.answer(r.Context(), request); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if len(responses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		writeJSON(w, responses)
+		return
+	}
+
+	response := s.answer(r.Context(), body)
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, response)
+}
+
+// answer runs a request. Notifications (requests without id)
+// get no response.
+func (s *Server) answer(ctx context.Context, data json.RawMessage) *rpcResponse {
+	request := rpcRequest{}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return errorResponse(nil, &rpcError{Code: CodeInvalidRequest, Message: err.Error()})
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return errorResponse(request.ID, &rpcError{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+
+	result, rpcErr := s.call(ctx, request.Method, request.Params)
+	if request.ID == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return errorResponse(request.ID, rpcErr)
+	}
+
+	// a null result must still be there
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+
+	return &rpcResponse{JSONRPC: "2.0", ID: request.ID, Result: result}
+}
+
+// errorResponse builds the response of a failed request
+func errorResponse(id json.RawMessage, rpcErr *rpcError) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: rpcErr}
+}
+
+// writeJSON writes the value as the JSON body of the response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error writing eth JSON RPC response: %v", err)
+	}
+}
+
+// notFound is the error of the data we don't have
+func notFound(format string, args ...interface{}) *rpcError {
+	return &rpcError{Code: CodeNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+// unavailable is the error of the data we have but can't serve,
+// as its value was pruned
+func unavailable(format string, args ...interface{}) *rpcError {
+	return &rpcError{Code: CodeUnavailable, Message: fmt.Sprintf(format, args...)}
+}
+
+// invalidParams is the error of the requests with wrong params
+func invalidParams(format string, args ...interface{}) *rpcError {
+	return &rpcError{Code: CodeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// internalError is the error of the requests we failed to answer
+func internalError(err error) *rpcError {
+	log.Printf("Error answering an eth JSON RPC request: %v", err)
+	return &rpcError{Code: CodeInternalError, Message: err.Error()}
+}
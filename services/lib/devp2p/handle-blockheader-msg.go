@@ -2,29 +2,28 @@ package devp2p
 
 import (
 	"fmt"
+	"io/ioutil"
 
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 func (m *Manager) handleBlockHeaderMsg(peer *Peer, msg *p2p.Msg) error {
-	var headers []*types.Header
-	if err := msg.Decode(&headers); err != nil {
-		return fmt.Errorf("Error Decoding message: %v %v", msg, err)
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("Error reading message: %v %v", msg, err)
 	}
 
-	// ship the received headers
-	if m.config.IsSyncBlockHeaderActive {
-		m.deliverHeaderCh <- deliverHeaderMsg{
-			PeerID:  peer.String(),
-			Headers: headers,
-		}
+	var headers []*types.Header
+	if err := rlp.DecodeBytes(payload, &headers); err != nil {
+		return fmt.Errorf("Error Decoding message: %v %v", msg, err)
 	}
 
 	// in protocolHandler() we did shot a request for the byzantium block.
 	// if we have that response here, let's check its hash, and drop
 	// the peer if it does not comply.
-	if len(headers) == 1 && headers[0].Number.Cmp(ByzantiumBlockNumberBigInt) == 0 {
+	if !peer.byzantiumChecked && len(headers) == 1 && headers[0].Number.Cmp(ByzantiumBlockNumberBigInt) == 0 {
 		// check hash
 		if headers[0].Hash().String() == ByzantiumBlockHashStr {
 			log.Debugf("Peer byzantium block is OK: %v", peer.String())
@@ -47,5 +46,18 @@ func (m *Manager) handleBlockHeaderMsg(peer *Peer, msg *p2p.Msg) error {
 		}
 	}
 
+	// the headers someone asked for with FetchHeadersByNumber()
+	if peer.deliverResponse(msg.Code, payload) {
+		return nil
+	}
+
+	// ship the received headers
+	if m.config.IsSyncBlockHeaderActive {
+		m.deliverHeaderCh <- deliverHeaderMsg{
+			PeerID:  peer.String(),
+			Headers: headers,
+		}
+	}
+
 	return nil
 }
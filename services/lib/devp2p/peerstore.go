@@ -10,6 +10,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 // peerStore keeps track of the devp2p peers after a succesful
@@ -44,6 +45,12 @@ type Peer struct {
 
 	// is this peer useful for us?
 	byzantiumChecked bool
+
+	// requests waiting for a response, by code of the latter.
+	// See request() in requests.go
+	requests     map[uint64][]chan rlp.RawValue
+	dropped      bool
+	requestsLock sync.Mutex
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -164,7 +171,7 @@ func (p *peerStore) bestPeer() *Peer {
 	// TODO
 	// Keep rotating the best peer
 
-	for i := 0; i < len(s)-1; i++ {
+	for i := 0; i < len(s); i++ {
 		if s[i].byzantiumChecked {
 			return s[i]
 		}
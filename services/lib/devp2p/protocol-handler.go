@@ -37,6 +37,7 @@ func (m *Manager) protocolHandler(p *p2p.Peer, rw p2p.MsgReadWriter) error {
 	// will be removed from the store.
 	m.peerstore.add(ethPeer)
 	defer m.peerstore.remove(ethPeer.String())
+	defer ethPeer.dropRequests()
 
 	// we don't want peers that aren't in the byzantium hard fork.
 	// we will send a message to the peer asking for its block
@@ -111,8 +112,7 @@ func (m *Manager) handleIncomingMsg(peer *Peer) error {
 
 	case msg.Code == BlockBodiesMsg:
 		// log.Debug("BlockBodies", "peer", peer.id)
-		// empty response
-		return m.handleEmptyResponseMsg(peer, &msg)
+		return m.handleResponseMsg(peer, &msg)
 
 	// This is the Broadcast message of a Block
 	case msg.Code == NewBlockMsg:
@@ -127,8 +127,7 @@ func (m *Manager) handleIncomingMsg(peer *Peer) error {
 
 	case msg.Code == NodeDataMsg:
 		// log.Debug("NodeData", "peer", peer.id)
-		// empty response
-		return m.handleEmptyResponseMsg(peer, &msg)
+		return m.handleResponseMsg(peer, &msg)
 
 	case msg.Code == GetReceiptsMsg:
 		// log.Debug("GetReceipts", "peer", peer.id)
@@ -137,8 +136,7 @@ func (m *Manager) handleIncomingMsg(peer *Peer) error {
 
 	case msg.Code == ReceiptsMsg:
 		// log.Debug("Receipts", "peer", peer.id)
-		// empty response
-		return m.handleEmptyResponseMsg(peer, &msg)
+		return m.handleResponseMsg(peer, &msg)
 
 	default:
 		return fmt.Errorf("message code not supported")
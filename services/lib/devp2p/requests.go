@@ -0,0 +1,179 @@
+package devp2p
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// MaxFetchItems is the most elements we ask a peer for in a single request,
+// peers answer with less than these anyway
+const MaxFetchItems = 128
+
+// ErrPeerDropped is returned to the requests in flight of a disconnected peer
+var ErrPeerDropped = fmt.Errorf("peer dropped")
+
+////////////////////////////////////////////////////////////////////////////////
+// REQUESTS
+////////////////////////////////////////////////////////////////////////////////
+
+// FetchHeadersByNumber requests a batch of consecutive headers, starting
+// at the given block number, and waits for them.
+// The peer may return less headers than asked for.
+func (p *Peer) FetchHeadersByNumber(ctx context.Context, origin uint64, amount int) ([]*types.Header, error) {
+	payload, err := p.request(ctx, GetBlockHeadersMsg, BlockHeadersMsg,
+		&getBlockHeadersData{Origin: hashOrNumber{Number: origin}, Amount: uint64(amount)})
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []*types.Header
+	if err := rlp.DecodeBytes(payload, &headers); err != nil {
+		return nil, fmt.Errorf("invalid block headers: %v", err)
+	}
+
+	return headers, nil
+}
+
+// FetchBlockBodies requests the bodies (transactions and uncles) of the
+// blocks with the given hashes, and waits for them. The bodies come in the
+// order of the request, but the peer may leave out the last ones.
+func (p *Peer) FetchBlockBodies(ctx context.Context, hashes []common.Hash) ([]*types.Body, error) {
+	payload, err := p.request(ctx, GetBlockBodiesMsg, BlockBodiesMsg, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var bodies []*types.Body
+	if err := rlp.DecodeBytes(payload, &bodies); err != nil {
+		return nil, fmt.Errorf("invalid block bodies: %v", err)
+	}
+
+	return bodies, nil
+}
+
+// FetchReceipts requests the receipts of the blocks with the given hashes,
+// and waits for them. The receipts of a block come in the order of the
+// request, but the peer may leave out the last ones. Only their consensus
+// fields are filled.
+func (p *Peer) FetchReceipts(ctx context.Context, hashes []common.Hash) ([]types.Receipts, error) {
+	payload, err := p.request(ctx, GetReceiptsMsg, ReceiptsMsg, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var receipts []types.Receipts
+	if err := rlp.DecodeBytes(payload, &receipts); err != nil {
+		return nil, fmt.Errorf("invalid receipts: %v", err)
+	}
+
+	return receipts, nil
+}
+
+// FetchNodeData requests the trie nodes (or contract codes) with the given
+// hashes, and waits for them. The peer may leave out some of them,
+// so the caller should match them by their hash.
+func (p *Peer) FetchNodeData(ctx context.Context, hashes []common.Hash) ([][]byte, error) {
+	payload, err := p.request(ctx, GetNodeDataMsg, NodeDataMsg, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var data [][]byte
+	if err := rlp.DecodeBytes(payload, &data); err != nil {
+		return nil, fmt.Errorf("invalid node data: %v", err)
+	}
+
+	return data, nil
+}
+
+// request sends a message to the peer, and waits for the payload of its
+// response. The eth protocol has no request ids, so the responses of a
+// code are matched to the requests in the order they were sent.
+// A request given up on (i.e. the context is done) keeps its place in
+// the line, so its late response doesn't get mistaken for the next one.
+func (p *Peer) request(ctx context.Context, code, responseCode uint64, data interface{}) (rlp.RawValue, error) {
+	response := make(chan rlp.RawValue, 1)
+
+	p.requestsLock.Lock()
+	if p.requests == nil {
+		p.requests = make(map[uint64][]chan rlp.RawValue)
+	}
+	if p.dropped {
+		p.requestsLock.Unlock()
+		return nil, ErrPeerDropped
+	}
+	if err := p2p.Send(p.rw, code, data); err != nil {
+		p.requestsLock.Unlock()
+		return nil, err
+	}
+	p.requests[responseCode] = append(p.requests[responseCode], response)
+	p.requestsLock.Unlock()
+
+	select {
+	case payload, ok := <-response:
+		if !ok {
+			return nil, ErrPeerDropped
+		}
+		return payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// RESPONSES
+////////////////////////////////////////////////////////////////////////////////
+
+// deliverResponse hands the payload of a response to the oldest request
+// waiting for it. Returns false if nobody was waiting.
+func (p *Peer) deliverResponse(code uint64, payload rlp.RawValue) bool {
+	p.requestsLock.Lock()
+	defer p.requestsLock.Unlock()
+
+	waiting := p.requests[code]
+	if len(waiting) == 0 {
+		return false
+	}
+
+	waiting[0] <- payload
+	close(waiting[0])
+	p.requests[code] = waiting[1:]
+
+	return true
+}
+
+// dropRequests fails the requests waiting for a response,
+// once the peer is disconnected
+func (p *Peer) dropRequests() {
+	p.requestsLock.Lock()
+	defer p.requestsLock.Unlock()
+
+	p.dropped = true
+	for code, waiting := range p.requests {
+		for _, response := range waiting {
+			close(response)
+		}
+		delete(p.requests, code)
+	}
+}
+
+// handleResponseMsg ships the response to the request waiting for it,
+// dropping it otherwise
+func (m *Manager) handleResponseMsg(peer *Peer, msg *p2p.Msg) error {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("Error reading message: %v %v", msg, err)
+	}
+
+	if !peer.deliverResponse(msg.Code, payload) {
+		log.Debugf("unrequested response %v from %v", msg.Code, peer.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package ipld
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// CID is a version 1 content identifier of an ethereum element.
+// As ethereum links everything by keccak-256 hashes, the multihash
+// is always a keccak-256 one, so we only keep its digest.
+type CID struct {
+	Codec uint64
+	Hash  common.Hash
+}
+
+// base32 without padding, lowercase, is the default multibase
+// used by IPFS to print CIDs v1
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Sum computes the CID of the raw RLP of an element
+func Sum(codec uint64, rawRLP []byte) *CID {
+	return &CID{
+		Codec: codec,
+		Hash:  crypto.Keccak256Hash(rawRLP),
+	}
+}
+
+// FromHash builds the CID of an element we already know the hash of.
+// i.e. the hash of a block is the keccak-256 of its header RLP.
+func FromHash(codec uint64, hash common.Hash) *CID {
+	return &CID{
+		Codec: codec,
+		Hash:  hash,
+	}
+}
+
+// HeaderCID returns the CID of a block (or uncle) header RLP
+func HeaderCID(rawRLP []byte) *CID { return Sum(EthBlock, rawRLP) }
+
+// TxCID returns the CID of a transaction RLP
+func TxCID(rawRLP []byte) *CID { return Sum(EthTx, rawRLP) }
+
+// TxReceiptCID returns the CID of a transaction receipt RLP
+func TxReceiptCID(rawRLP []byte) *CID { return Sum(EthTxReceipt, rawRLP) }
+
+// TxTrieCID returns the CID of a transactions trie node RLP
+func TxTrieCID(rawRLP []byte) *CID { return Sum(EthTxTrie, rawRLP) }
+
+// TxReceiptTrieCID returns the CID of a receipts trie node RLP
+func TxReceiptTrieCID(rawRLP []byte) *CID { return Sum(EthTxReceiptTrie, rawRLP) }
+
+// StateTrieCID returns the CID of a state trie node RLP
+func StateTrieCID(rawRLP []byte) *CID { return Sum(EthStateTrie, rawRLP) }
+
+// StorageTrieCID returns the CID of a storage trie node RLP
+func StorageTrieCID(rawRLP []byte) *CID { return Sum(EthStorageTrie, rawRLP) }
+
+// Bytes returns the binary representation of the CID:
+// <version><codec><multihash code><multihash length><digest>
+func (c *CID) Bytes() []byte {
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+common.HashLength)
+	buf = appendUvarint(buf, 1)
+	buf = appendUvarint(buf, c.Codec)
+	buf = appendUvarint(buf, Keccak256)
+	buf = appendUvarint(buf, common.HashLength)
+
+	return append(buf, c.Hash.Bytes()...)
+}
+
+// String returns the CID encoded in base32 multibase
+func (c *CID) String() string {
+	return "b" + strings.ToLower(base32Encoding.EncodeToString(c.Bytes()))
+}
+
+// Equals tells whether both CIDs address the same element
+func (c *CID) Equals(other *CID) bool {
+	return c.Codec == other.Codec && c.Hash == other.Hash
+}
+
+// Decode parses a CID string, in base32 or base58btc multibase
+func Decode(s string) (*CID, error) {
+	if len(s) < 2 {
+		return nil, fmt.Errorf("cid too short: %v", s)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	switch s[0] {
+	case 'b':
+		data, err = base32Encoding.DecodeString(strings.ToUpper(s[1:]))
+	case 'B':
+		data, err = base32Encoding.DecodeString(s[1:])
+	case 'z':
+		data, err = decodeBase58(s[1:])
+	default:
+		return nil, fmt.Errorf("unsupported multibase %q in cid %v", s[0], s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cid %v: %v", s, err)
+	}
+
+	return Cast(data)
+}
+
+// Cast parses the binary representation of a CID
+func Cast(data []byte) (*CID, error) {
+	reader := bytes.NewReader(data)
+
+	version, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported cid version %v", version)
+	}
+
+	codec, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := codecNames[codec]; !ok {
+		return nil, fmt.Errorf("unknown ethereum codec 0x%x", codec)
+	}
+
+	mhCode, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if mhCode != Keccak256 {
+		return nil, fmt.Errorf("unsupported multihash 0x%x", mhCode)
+	}
+
+	mhLength, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if mhLength != common.HashLength || reader.Len() != common.HashLength {
+		return nil, fmt.Errorf("invalid keccak-256 digest length")
+	}
+
+	digest := make([]byte, mhLength)
+	n, err := reader.Read(digest)
+	if err != nil {
+		return nil, err
+	}
+	if n != int(mhLength) {
+		return nil, fmt.Errorf("truncated keccak-256 digest")
+	}
+
+	return &CID{
+		Codec: codec,
+		Hash:  common.BytesToHash(digest),
+	}, nil
+}
+
+// appendUvarint appends the unsigned varint of x to buf
+func appendUvarint(buf []byte, x uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, x)
+
+	return append(buf, tmp[:n]...)
+}
+
+// decodeBase58 decodes a bitcoin alphabet base58 string,
+// as older IPFS versions print CIDs this way
+func decodeBase58(s string) ([]byte, error) {
+	result := new(big.Int)
+	radix := big.NewInt(58)
+
+	for _, r := range s {
+		idx := strings.IndexRune(base58Alphabet, r)
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		result.Mul(result, radix)
+		result.Add(result, big.NewInt(int64(idx)))
+	}
+
+	// leading ones are leading zero bytes
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	return append(make([]byte, zeros), result.Bytes()...), nil
+}
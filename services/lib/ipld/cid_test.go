@@ -0,0 +1,134 @@
+package ipld
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// the vectors below are the CIDs go-cid gives for the same
+// codecs and keccak-256 multihashes
+
+func TestSum(t *testing.T) {
+	expected := "bagiacgzai4ltfbni242b4xuxf7dhokddqt4af6hpiks6yxydxp5cktfqd6wq"
+	if c := Sum(EthBlock, []byte("hello world")); c.String() != expected {
+		t.Errorf("got %v, expected %v", c, expected)
+	}
+}
+
+func TestHeaderCID(t *testing.T) {
+	// the genesis block of the mainnet
+	genesis := &types.Header{
+		UncleHash:   types.EmptyUncleHash,
+		Root:        common.HexToHash("0xd7f8974fb5ac78d9ac099b9ad5018bedc2ce0a72dad1827a1709da30580f0544"),
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  big.NewInt(0x400000000),
+		Number:      big.NewInt(0),
+		GasLimit:    5000,
+		Time:        big.NewInt(0),
+		Extra:       hexutil.MustDecode("0x11bbe8db4e347b4e8c937c1c8370e4b5ed33adb3db69cbdb7a38e1e50b1b82fa"),
+		Nonce:       types.EncodeNonce(66),
+	}
+	headerRLP, err := rlp.EncodeToBytes(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := HeaderCID(headerRLP)
+	expected := "bagiacgza2tswoqhyo2xprqaqxbvebvpvm5c2cggqsbvdjzu25sga3molr6rq"
+	if c.String() != expected {
+		t.Errorf("got %v, expected %v", c, expected)
+	}
+
+	hash := common.HexToHash("0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3")
+	if !c.Equals(FromHash(EthBlock, hash)) {
+		t.Errorf("got hash %v, expected the one of the block %v", c.Hash.Hex(), hash.Hex())
+	}
+
+	// as older IPFS versions print it
+	decoded, err := Decode("z43AaGF73rnZ14vjAkMQ8xoNfBShmq8qaiqFuELAx1vxSTzfGY2")
+	if err != nil || !decoded.Equals(c) {
+		t.Errorf("got %v (%v) out of base58, expected %v", decoded, err, c)
+	}
+}
+
+func TestTxCID(t *testing.T) {
+	// the first transaction of the mainnet, in block 46147
+	tx := []interface{}{
+		uint64(0),
+		big.NewInt(50000000000000),
+		uint64(21000),
+		common.HexToAddress("0x5df9b87991262f6ba471f09758cde1c0fc1de734"),
+		big.NewInt(31337),
+		[]byte{},
+		big.NewInt(0x1c),
+		hexutil.MustDecodeBig("0x88ff6cf0fefd94db46111149ae4bfc179e9b94721fffd821d38d16464b3f71d0"),
+		hexutil.MustDecodeBig("0x45e0aff800961cfce805daef7016b9b675c137a6a41a548f7b60a3484c06a33a"),
+	}
+	txRLP, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := TxCID(txRLP)
+	expected := "bagjqcgzalrie5vbsznirhc6pbgvf5csbbxkkdyqe56cl73i34fw7xinsebqa"
+	if c.String() != expected {
+		t.Errorf("got %v, expected %v", c, expected)
+	}
+
+	hash := common.HexToHash("0x5c504ed432cb51138bcf09aa5e8a410dd4a1e204ef84bfed1be16dfba1b22060")
+	if !c.Equals(FromHash(EthTx, hash)) {
+		t.Errorf("got hash %v, expected the one of the transaction %v", c.Hash.Hex(), hash.Hex())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for codec, name := range codecNames {
+		c := Sum(codec, []byte(name))
+
+		cast, err := Cast(c.Bytes())
+		if err != nil || !cast.Equals(c) {
+			t.Errorf("%v: got %v (%v) out of its bytes, expected %v", name, cast, err, c)
+		}
+
+		decoded, err := Decode(c.String())
+		if err != nil || !decoded.Equals(c) {
+			t.Errorf("%v: got %v (%v) out of %v", name, decoded, err, c)
+		}
+	}
+}
+
+func TestCastRejects(t *testing.T) {
+	valid := Sum(EthTx, []byte("hello world")).Bytes()
+
+	// <version><codec><multihash code><multihash length><digest>
+	withByte := func(i int, b byte) []byte {
+		data := append([]byte{}, valid...)
+		data[i] = b
+		return data
+	}
+
+	tests := map[string][]byte{
+		"cid version 0":       withByte(0, 0),
+		"unknown codec":       withByte(1, 0x70),
+		"sha2-256 multihash":  withByte(2, 0x12),
+		"sha3-256 multihash":  withByte(2, 0x16),
+		"short digest length": withByte(3, 31),
+		"truncated digest":    valid[:len(valid)-1],
+		"digest too long":     append(append([]byte{}, valid...), 0),
+		"no digest":           valid[:4],
+		"no multihash":        valid[:2],
+		"empty":               {},
+	}
+
+	for name, data := range tests {
+		if c, err := Cast(data); err == nil {
+			t.Errorf("%v: got %v, expected an error", name, c)
+		}
+	}
+}
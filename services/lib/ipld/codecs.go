@@ -0,0 +1,56 @@
+package ipld
+
+import "fmt"
+
+// Ethereum IPLD codecs, as registered in the multicodec table
+// and used by go-ipld-eth
+const (
+	EthBlock           uint64 = 0x90
+	EthBlockList       uint64 = 0x91
+	EthTxTrie          uint64 = 0x92
+	EthTx              uint64 = 0x93
+	EthTxReceiptTrie   uint64 = 0x94
+	EthTxReceipt       uint64 = 0x95
+	EthStateTrie       uint64 = 0x96
+	EthAccountSnapshot uint64 = 0x97
+	EthStorageTrie     uint64 = 0x98
+)
+
+// Keccak256 is the multihash code of the keccak-256 hash function,
+// the one ethereum uses to link its elements
+const Keccak256 uint64 = 0x1b
+
+// codecNames are the names of the codecs, as the IPFS HTTP API
+// expects them in the "format" option
+var codecNames = map[uint64]string{
+	EthBlock:           "eth-block",
+	EthBlockList:       "eth-block-list",
+	EthTxTrie:          "eth-tx-trie",
+	EthTx:              "eth-tx",
+	EthTxReceiptTrie:   "eth-tx-receipt-trie",
+	EthTxReceipt:       "eth-tx-receipt",
+	EthStateTrie:       "eth-state-trie",
+	EthAccountSnapshot: "eth-account-snapshot",
+	EthStorageTrie:     "eth-storage-trie",
+}
+
+// CodecName returns the name of an ethereum IPLD codec
+func CodecName(codec uint64) (string, error) {
+	name, ok := codecNames[codec]
+	if !ok {
+		return "", fmt.Errorf("unknown ethereum codec 0x%x", codec)
+	}
+
+	return name, nil
+}
+
+// CodecByName returns the ethereum IPLD codec of the given name
+func CodecByName(name string) (uint64, error) {
+	for codec, codecName := range codecNames {
+		if codecName == name {
+			return codec, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown ethereum codec %v", name)
+}